@@ -17,6 +17,9 @@ package conf
 import (
 	"rasp-cloud/tools"
 	"github.com/astaxie/beego"
+	"os"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -26,21 +29,49 @@ const (
 	StartTypeDefault    = "default"
 )
 
+
 type RaspAppConfig struct {
-	EsAddr             string
-	EsUser             string
-	EsPwd              string
-	MongoDBAddr        string
-	MongoDBUser        string
-	MongoDBPwd         string
-	MongoDBName        string
-	MongoDBPoolLimit   int
-	MaxPlugins         int
-	AlarmLogMode       string
-	AlarmBufferSize    int
-	AlarmCheckInterval int64
-	CookieLifeTime     int
-	Flag               *Flag
+	EsAddr              string
+	EsUser              string
+	EsPwd               string
+	EsApiKey            string
+	EsCaFile            string
+	EsTlsSkipVerify     bool
+	EsSniff             bool
+	EsHealthCheck       bool
+	EsBulkMaxRetry      int
+	EsBulkTimeout       int64
+	EsBulkSize          int
+	EsBulkWorkers       int
+	EsBulkFlushInterval int64
+	EsSearchTimeout     int64
+	EsAggrTimeout       int64
+	EsExportTimeout     int64
+	EsSpoolDir          string
+	EsSpoolMaxSize      int64
+	EsRolloverMaxAge    string
+	EsRolloverMaxDocs   int64
+	EsAlarmRetention    int
+	EsReportRetention   int
+	MongoDBAddr         string
+	MongoDBUser         string
+	MongoDBPwd          string
+	MongoDBName         string
+	MongoDBPoolLimit    int
+	MaxPlugins          int
+	AlarmLogMode        string
+	AlarmBufferSize     int
+	AlarmCheckInterval  int64
+	AlarmExportMaxRows  int64
+	GeoIpDbPath         string
+	CookieLifeTime      int
+	RaspCleanupDays     int
+	RaspOnlineFactor    int
+	Flag                *Flag
+
+	// the thresholds of the es requests
+	EsAsyncDeleteThreshold int64
+	EsSlowQueryThreshold   int64
 }
 
 type Flag struct {
@@ -50,6 +81,13 @@ type Flag struct {
 	Version   *bool
 }
 
+const (
+	defaultEsBulkTimeout   = 30
+	defaultEsSearchTimeout = 15
+	defaultEsAggrTimeout   = 30
+	defaultEsExportTimeout = 600
+)
+
 var (
 	AppConfig = &RaspAppConfig{}
 )
@@ -59,6 +97,27 @@ func InitConfig(startFlag *Flag) {
 	AppConfig.EsAddr = beego.AppConfig.String("EsAddr")
 	AppConfig.EsUser = beego.AppConfig.DefaultString("EsUser", "")
 	AppConfig.EsPwd = beego.AppConfig.DefaultString("EsPwd", "")
+	AppConfig.EsApiKey = beego.AppConfig.DefaultString("EsApiKey", "")
+	AppConfig.EsCaFile = beego.AppConfig.DefaultString("EsCaFile", "")
+	AppConfig.EsTlsSkipVerify = beego.AppConfig.DefaultBool("EsTlsSkipVerify", false)
+	AppConfig.EsSniff = beego.AppConfig.DefaultBool("EsSniff", false)
+	AppConfig.EsHealthCheck = beego.AppConfig.DefaultBool("EsHealthCheck", true)
+	AppConfig.EsBulkMaxRetry = beego.AppConfig.DefaultInt("EsBulkMaxRetry", 3)
+	AppConfig.EsBulkTimeout = beego.AppConfig.DefaultInt64("EsBulkTimeout", defaultEsBulkTimeout)
+	AppConfig.EsBulkSize = beego.AppConfig.DefaultInt("EsBulkSize", 200)
+	AppConfig.EsBulkWorkers = beego.AppConfig.DefaultInt("EsBulkWorkers", 2)
+	AppConfig.EsBulkFlushInterval = beego.AppConfig.DefaultInt64("EsBulkFlushInterval", 1000)
+	AppConfig.EsSearchTimeout = beego.AppConfig.DefaultInt64("EsSearchTimeout", defaultEsSearchTimeout)
+	AppConfig.EsAggrTimeout = beego.AppConfig.DefaultInt64("EsAggrTimeout", defaultEsAggrTimeout)
+	AppConfig.EsExportTimeout = beego.AppConfig.DefaultInt64("EsExportTimeout", defaultEsExportTimeout)
+	AppConfig.EsAsyncDeleteThreshold = beego.AppConfig.DefaultInt64("EsAsyncDeleteThreshold", 100000)
+	AppConfig.EsSlowQueryThreshold = beego.AppConfig.DefaultInt64("EsSlowQueryThreshold", 2000)
+	AppConfig.EsSpoolDir = beego.AppConfig.DefaultString("EsSpoolDir", "")
+	AppConfig.EsSpoolMaxSize = beego.AppConfig.DefaultInt64("EsSpoolMaxSize", 1024)
+	AppConfig.EsRolloverMaxAge = beego.AppConfig.DefaultString("EsRolloverMaxAge", "")
+	AppConfig.EsRolloverMaxDocs = beego.AppConfig.DefaultInt64("EsRolloverMaxDocs", 0)
+	AppConfig.EsAlarmRetention = beego.AppConfig.DefaultInt("EsAlarmRetention", 0)
+	AppConfig.EsReportRetention = beego.AppConfig.DefaultInt("EsReportRetention", 0)
 	AppConfig.MongoDBAddr = beego.AppConfig.DefaultString("MongoDBAddr", "")
 	AppConfig.MongoDBPoolLimit = beego.AppConfig.DefaultInt("MongoDBPoolLimit", 1024)
 	AppConfig.MongoDBName = beego.AppConfig.DefaultString("MongoDBName", "openrasp")
@@ -67,14 +126,68 @@ func InitConfig(startFlag *Flag) {
 	AppConfig.AlarmLogMode = beego.AppConfig.DefaultString("AlarmLogMode", "file")
 	AppConfig.AlarmBufferSize = beego.AppConfig.DefaultInt("AlarmBufferSize", 300)
 	AppConfig.AlarmCheckInterval = beego.AppConfig.DefaultInt64("AlarmCheckInterval", 120)
+	AppConfig.AlarmExportMaxRows = beego.AppConfig.DefaultInt64("AlarmExportMaxRows", 100000)
+	AppConfig.GeoIpDbPath = beego.AppConfig.DefaultString("GeoIpDbPath", "")
 	AppConfig.CookieLifeTime = beego.AppConfig.DefaultInt("CookieLifeTime", 7*24)
+	AppConfig.RaspCleanupDays = beego.AppConfig.DefaultInt("RaspCleanupDays", 0)
+	AppConfig.RaspOnlineFactor = beego.AppConfig.DefaultInt("RaspOnlineFactor", 2)
 	ValidRaspConf(AppConfig)
 }
 
 func ValidRaspConf(config *RaspAppConfig) {
-	if config.EsAddr == "" {
+	if strings.Trim(config.EsAddr, ", ") == "" {
 		failLoadConfig("the 'EsAddr' config item in app.conf can not be empty")
 	}
+	if config.EsApiKey != "" && (config.EsUser != "" || config.EsPwd != "") {
+		failLoadConfig("the 'EsApiKey' config can not be used together with 'EsUser' and 'EsPwd'")
+	}
+	if config.EsCaFile != "" {
+		if isExists, _ := tools.PathExists(config.EsCaFile); !isExists {
+			failLoadConfig("the file of 'EsCaFile' config does not exist: " + config.EsCaFile)
+		}
+	}
+	if config.EsTlsSkipVerify {
+		beego.Warning("the certificate of es will not be verified, because 'EsTlsSkipVerify' is enabled")
+	}
+	if config.EsBulkMaxRetry < 0 {
+		failLoadConfig("the 'EsBulkMaxRetry' config can not be less than 0")
+	}
+	config.EsBulkTimeout = validEsTimeout("EsBulkTimeout", config.EsBulkTimeout, defaultEsBulkTimeout)
+	if config.EsBulkSize <= 0 {
+		failLoadConfig("the 'EsBulkSize' config must be greater than 0")
+	}
+	if config.EsBulkWorkers <= 0 {
+		failLoadConfig("the 'EsBulkWorkers' config must be greater than 0")
+	}
+	if config.EsBulkFlushInterval <= 0 {
+		failLoadConfig("the 'EsBulkFlushInterval' config must be greater than 0")
+	}
+	config.EsSearchTimeout = validEsTimeout("EsSearchTimeout", config.EsSearchTimeout, defaultEsSearchTimeout)
+	config.EsAggrTimeout = validEsTimeout("EsAggrTimeout", config.EsAggrTimeout, defaultEsAggrTimeout)
+	config.EsExportTimeout = validEsTimeout("EsExportTimeout", config.EsExportTimeout, defaultEsExportTimeout)
+	if config.EsAsyncDeleteThreshold <= 0 {
+		failLoadConfig("the 'EsAsyncDeleteThreshold' config must be greater than 0")
+	}
+	if config.EsSlowQueryThreshold <= 0 {
+		failLoadConfig("the 'EsSlowQueryThreshold' config must be greater than 0")
+	}
+	if config.EsSpoolDir != "" {
+		if config.EsSpoolMaxSize <= 0 {
+			failLoadConfig("the 'EsSpoolMaxSize' config must be greater than 0")
+		}
+		if err := os.MkdirAll(config.EsSpoolDir, os.ModePerm); err != nil {
+			failLoadConfig("failed to create the directory of 'EsSpoolDir' config: " + err.Error())
+		}
+	}
+	if config.EsRolloverMaxDocs < 0 {
+		failLoadConfig("the 'EsRolloverMaxDocs' config can not be less than 0")
+	}
+	if config.EsAlarmRetention < 0 {
+		failLoadConfig("the 'EsAlarmRetention' config can not be less than 0")
+	}
+	if config.EsReportRetention < 0 {
+		failLoadConfig("the 'EsReportRetention' config can not be less than 0")
+	}
 	if config.MongoDBAddr == "" {
 		failLoadConfig("the 'MongoDBAddr' config item in app.conf can not be empty")
 	}
@@ -104,9 +217,27 @@ func ValidRaspConf(config *RaspAppConfig) {
 		beego.Warning("the value of 'AlarmCheckInterval' config is less than 10, it will be set to 10")
 		config.AlarmCheckInterval = 10
 	}
+	if config.AlarmExportMaxRows <= 0 {
+		failLoadConfig("the 'AlarmExportMaxRows' config must be greater than 0")
+	}
 	if config.CookieLifeTime <= 0 {
 		failLoadConfig("the 'CookieLifeTime' config must be greater than 0")
 	}
+	if config.RaspCleanupDays < 0 {
+		failLoadConfig("the 'RaspCleanupDays' config can not be less than 0")
+	}
+	if config.RaspOnlineFactor < 1 {
+		failLoadConfig("the 'RaspOnlineFactor' config must be greater than 0")
+	}
+}
+
+func validEsTimeout(name string, value int64, defaultValue int64) int64 {
+	if value <= 0 {
+		beego.Warning("the value of '" + name + "' config must be greater than 0, it will be set to " +
+			strconv.FormatInt(defaultValue, 10))
+		return defaultValue
+	}
+	return value
 }
 
 func failLoadConfig(msg string) {
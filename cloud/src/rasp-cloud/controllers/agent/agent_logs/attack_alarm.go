@@ -18,6 +18,8 @@ import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models/logs"
 	"time"
+	"net/http"
+	"rasp-cloud/es"
 )
 
 // Operations about attack alarm message
@@ -31,12 +33,17 @@ func (o *AttackAlarmController) Post() {
 	o.UnmarshalJson(&alarms)
 
 	count := 0
+	var err error
 	for _, alarm := range alarms {
 		alarm["@timestamp"] = time.Now().UnixNano() / 1000000
-		err := logs.AddAttackAlarm(alarm)
+		err = logs.AddAttackAlarm(alarm)
 		if err == nil {
 			count++
 		}
 	}
+	// let the agent retry later when no alarm is accepted because es can not keep up
+	if count == 0 && err == es.ErrBulkQueueFull {
+		o.ServeError(http.StatusServiceUnavailable, "failed to add attack alarms", err)
+	}
 	o.Serve(map[string]uint64{"count": uint64(count)})
 }
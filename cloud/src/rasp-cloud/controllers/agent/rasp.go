@@ -15,6 +15,7 @@
 package agent
 
 import (
+	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/validation"
 	"net/http"
 	"rasp-cloud/controllers"
@@ -100,5 +101,24 @@ func (o *RaspController) Post() {
 	}
 	models.AddOperation(rasp.AppId, models.OperationTypeRegisterRasp, o.Ctx.Input.IP(),
 		"New RASP agent registered from "+rasp.HostName+": "+rasp.Id, "")
+	o.mergeRaspsOfHost(rasp)
 	o.Serve(rasp)
 }
+
+// mergeRaspsOfHost replaces the old rasps of the same host for the app with the host identity,
+// the registration is not failed by the merge
+func (o *RaspController) mergeRaspsOfHost(rasp *models.Rasp) {
+	app, err := models.GetAppByIdWithoutMask(rasp.AppId)
+	if err != nil || app.RaspIdentity != models.RaspIdentityHost {
+		return
+	}
+	merged, err := models.MergeRaspsOfHost(rasp)
+	if err != nil {
+		beego.Error("failed to merge the rasps of host " + rasp.HostName + ": " + err.Error())
+		return
+	}
+	for _, old := range merged {
+		models.AddOperation(rasp.AppId, models.OperationTypeMergeRasp, o.Ctx.Input.IP(),
+			"Merged RASP agent "+old.Id+" into "+rasp.Id+" registered from the same host "+rasp.HostName, "")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
+	"rasp-cloud/es"
 )
 
 type ReportController struct {
@@ -42,6 +43,9 @@ func (o *ReportController) Post() {
 		o.ServeError(http.StatusBadRequest, "request_sum param cannot be less than 0")
 	}
 	err = models.AddReportData(reportData, rasp.AppId)
+	if err == es.ErrBulkQueueFull {
+		o.ServeError(http.StatusServiceUnavailable, "failed to insert report data", err)
+	}
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to insert report data", err)
 	}
@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
+	"rasp-cloud/models/logs"
 	"strconv"
 	"sync"
 	"time"
@@ -39,6 +40,11 @@ type pageParam struct {
 	Perpage int    `json:"perpage"`
 }
 
+const (
+	// the old secret can be kept for at most 30 days after the rotation
+	maxSecretGracePeriod = 30 * 24 * 3600
+)
+
 var (
 	supportLanguages = []string{"java", "php"}
 	mutex            sync.Mutex
@@ -140,6 +146,37 @@ func (o *AppController) RegenerateAppSecret() {
 	})
 }
 
+// @router /secret/rotate [post]
+func (o *AppController) RotateAppSecret() {
+	var param struct {
+		AppId       string `json:"app_id"`
+		GracePeriod int64  `json:"grace_period"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	if param.GracePeriod < 0 || param.GracePeriod > maxSecretGracePeriod {
+		o.ServeError(http.StatusBadRequest,
+			"grace_period must be between [0,"+strconv.FormatInt(maxSecretGracePeriod, 10)+"]")
+	}
+	secret, expireTime, err := models.RotateSecret(param.AppId, time.Duration(param.GracePeriod)*time.Second)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to rotate secret", err)
+	}
+	content := "Rotated AppSecret of " + param.AppId
+	if expireTime > 0 {
+		content += ", the old AppSecret is valid until " + time.Unix(expireTime, 0).Format(time.RFC3339)
+	} else {
+		content += ", the old AppSecret is invalid now"
+	}
+	models.AddOperation(param.AppId, models.OperationTypeRegenerateSecret, o.Ctx.Input.IP(), content)
+	o.Serve(map[string]interface{}{
+		"secret":                 secret,
+		"old_secret_expire_time": expireTime,
+	})
+}
+
 // @router /general/config [post]
 func (o *AppController) UpdateAppGeneralConfig() {
 	var param struct {
@@ -231,6 +268,24 @@ func (o *AppController) Post() {
 	if app.DingAlarmConf.Enable {
 		o.validDingConf(&app.DingAlarmConf)
 	}
+	if app.SyslogConf.Enable {
+		o.validSyslogConf(&app.SyslogConf)
+	}
+	if app.SlackAlarmConf.Enable {
+		o.validSlackConf(&app.SlackAlarmConf)
+	}
+	if app.AlarmDedupConf != nil {
+		o.validAlarmDedupConf(app.AlarmDedupConf)
+	}
+	if app.RaspCleanupDays != nil && *app.RaspCleanupDays < 0 {
+		o.ServeError(http.StatusBadRequest, "rasp_cleanup_days can not be less than 0")
+	}
+	if app.RaspIdentity != models.RaspIdentityId && app.RaspIdentity != models.RaspIdentityHost {
+		o.ServeError(http.StatusBadRequest, "rasp_identity must be empty or host")
+	}
+	if app.Retention != nil {
+		o.validRetention(app.Retention)
+	}
 	if app.GeneralConfig != nil {
 		o.validateAppConfig(app.GeneralConfig)
 		configTime := time.Now().UnixNano()
@@ -252,13 +307,47 @@ func (o *AppController) Post() {
 	o.Serve(app)
 }
 
+// @router /clone [post]
+func (o *AppController) Clone() {
+	var param struct {
+		AppId string `json:"app_id"`
+		Name  string `json:"name"`
+	}
+	o.UnmarshalJson(&param)
+
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	if param.Name == "" {
+		o.ServeError(http.StatusBadRequest, "app name cannot be empty")
+	}
+	if len(param.Name) > 64 {
+		o.ServeError(http.StatusBadRequest, "the length of app name cannot be greater than 64")
+	}
+	source, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	app, err := models.CloneApp(param.AppId, param.Name)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to clone app", err)
+	}
+	models.AddOperation(app.Id, models.OperationTypeCloneApp, o.Ctx.Input.IP(),
+		"New app created with name "+app.Name+" by cloning the app "+source.Name)
+	o.Serve(app)
+}
+
 // @router /config [post]
 func (o *AppController) ConfigApp() {
 	var param struct {
-		AppId       string `json:"app_id"`
-		Language    string `json:"language,omitempty"`
-		Name        string `json:"name,omitempty"`
-		Description string `json:"description,omitempty"`
+		AppId           string  `json:"app_id"`
+		Language        string  `json:"language,omitempty"`
+		Name            string  `json:"name,omitempty"`
+		Description     string  `json:"description,omitempty"`
+		RaspCleanupDays *int    `json:"rasp_cleanup_days,omitempty"`
+		RaspIdentity    *string `json:"rasp_identity,omitempty"`
+
+		Retention *models.AppRetention `json:"retention,omitempty"`
 	}
 
 	o.UnmarshalJson(&param)
@@ -295,6 +384,22 @@ func (o *AppController) ConfigApp() {
 		o.ServeError(http.StatusBadRequest, "the length of app description can not be greater than 1024")
 	}
 	updateData := bson.M{"name": param.Name, "language": param.Language, "description": param.Description}
+	if param.RaspCleanupDays != nil {
+		if *param.RaspCleanupDays < 0 {
+			o.ServeError(http.StatusBadRequest, "rasp_cleanup_days can not be less than 0")
+		}
+		updateData["rasp_cleanup_days"] = *param.RaspCleanupDays
+	}
+	if param.RaspIdentity != nil {
+		if *param.RaspIdentity != models.RaspIdentityId && *param.RaspIdentity != models.RaspIdentityHost {
+			o.ServeError(http.StatusBadRequest, "rasp_identity must be empty or host")
+		}
+		updateData["rasp_identity"] = *param.RaspIdentity
+	}
+	if param.Retention != nil {
+		o.validRetention(param.Retention)
+		updateData["retention"] = param.Retention
+	}
 	app, err := models.UpdateAppById(param.AppId, updateData)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to update app config", err)
@@ -369,9 +474,68 @@ func (o *AppController) validHttpAlarm(conf *models.HttpAlarmConf) {
 	if len(conf.RecvAddr) > 128 {
 		o.ServeError(http.StatusBadRequest, "the count of http recv_addr cannot be greater than 128")
 	}
+	if len(conf.SignSecret) > 256 {
+		o.ServeError(http.StatusBadRequest, "the length of http sign_secret cannot be greater than 256")
+	}
 	conf.RecvAddr = o.validAppArrayParam(conf.RecvAddr, "http recv_addr", nil)
 }
 
+func (o *AppController) validRetention(retention *models.AppRetention) {
+	for name, days := range map[string]int{
+		"attack_alarm_days": retention.AttackAlarmDays,
+		"policy_alarm_days": retention.PolicyAlarmDays,
+		"error_alarm_days":  retention.ErrorAlarmDays,
+	} {
+		if days < 0 || days > models.MaxRetentionDays {
+			o.ServeError(http.StatusBadRequest,
+				"the retention "+name+" must be between [0,"+strconv.Itoa(models.MaxRetentionDays)+"]")
+		}
+	}
+}
+
+func (o *AppController) validSlackConf(conf *models.SlackAlarmConf) {
+	if len(conf.WebhookUrl) > 512 {
+		o.ServeError(http.StatusBadRequest, "the length of slack webhook_url cannot be greater than 512")
+	}
+	if len(conf.Channel) > 128 {
+		o.ServeError(http.StatusBadRequest, "the length of slack channel cannot be greater than 128")
+	}
+	if len(conf.Mentions) > 64 {
+		o.ServeError(http.StatusBadRequest, "the count of slack mentions cannot be greater than 64")
+	}
+	conf.Mentions = o.validAppArrayParam(conf.Mentions, "slack mentions", nil)
+	if err := conf.Valid(); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid slack config", err)
+	}
+}
+
+func (o *AppController) validAlarmDedupConf(conf *models.AlarmDedupConf) {
+	if conf.Window < 0 || conf.Window > models.MaxAlarmDedupWindow {
+		o.ServeError(http.StatusBadRequest,
+			"the alarm dedup window must be between [0,"+strconv.Itoa(models.MaxAlarmDedupWindow)+"]")
+	}
+	if len(conf.Fields) > 10 {
+		o.ServeError(http.StatusBadRequest, "the count of alarm dedup fields cannot be greater than 10")
+	}
+	for _, field := range conf.Fields {
+		if field == "" || len(field) > 64 {
+			o.ServeError(http.StatusBadRequest, "the length of alarm dedup field must be between [1,64]")
+		}
+	}
+	if conf.Fields == nil {
+		conf.Fields = make([]string, 0)
+	}
+}
+
+func (o *AppController) validSyslogConf(conf *logs.SyslogConf) {
+	if len(conf.Addr) > 256 {
+		o.ServeError(http.StatusBadRequest, "the length of syslog addr cannot be greater than 256")
+	}
+	if err := conf.Valid(); err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid syslog config", err)
+	}
+}
+
 // @router /delete [post]
 func (o *AppController) Delete() {
 	var app = &models.App{}
@@ -389,6 +553,15 @@ func (o *AppController) Delete() {
 	if count <= 1 {
 		o.ServeError(http.StatusBadRequest, "failed to remove app: keep at least one app")
 	}
+	// the es indices are removed before the app, so that the deletion can be retried when it fails
+	err = logs.RemoveAlarmEsIndex(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove alarm es index of app", err)
+	}
+	err = models.RemoveReportDataEsIndex(app.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove report es index of app", err)
+	}
 	app, err = models.RemoveAppById(app.Id)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to remove app", err)
@@ -445,6 +618,23 @@ func (o *AppController) validateAppConfig(config map[string]interface{}) {
 					"the value's length of config key '"+key+"' must be less than 2048")
 			}
 		}
+		if key == models.HeartbeatIntervalConfigKey {
+			if v, ok := value.(float64); !ok || v != float64(int64(v)) || v < 60 || v > 1800 {
+				o.ServeError(http.StatusBadRequest,
+					"the value of "+key+" config must be an integer between [60,1800]")
+			}
+		}
+		if key == "dependency.enable" {
+			if _, ok := value.(bool); !ok {
+				o.ServeError(http.StatusBadRequest, "the value of "+key+" config must be a boolean")
+			}
+		}
+		if key == "dependency.interval" {
+			if v, ok := value.(float64); !ok || v != float64(int64(v)) || v < 60 || v > 604800 {
+				o.ServeError(http.StatusBadRequest,
+					"the value of "+key+" config must be an integer between [60,604800]")
+			}
+		}
 	}
 }
 
@@ -474,6 +664,9 @@ func (o *AppController) ConfigAlarm() {
 		EmailAlarmConf *models.EmailAlarmConf `json:"email_alarm_conf,omitempty"`
 		DingAlarmConf  *models.DingAlarmConf  `json:"ding_alarm_conf,omitempty"`
 		HttpAlarmConf  *models.HttpAlarmConf  `json:"http_alarm_conf,omitempty"`
+		SyslogConf     *logs.SyslogConf       `json:"syslog_conf,omitempty"`
+		SlackAlarmConf *models.SlackAlarmConf `json:"slack_alarm_conf,omitempty"`
+		AlarmDedupConf *models.AlarmDedupConf `json:"alarm_dedup_conf,omitempty"`
 	}
 	o.UnmarshalJson(&param)
 
@@ -492,14 +685,31 @@ func (o *AppController) ConfigAlarm() {
 		o.validEmailConf(param.EmailAlarmConf)
 	}
 	if param.HttpAlarmConf != nil {
+		if param.HttpAlarmConf.SignSecret == models.SecreteMask {
+			param.HttpAlarmConf.SignSecret = app.HttpAlarmConf.SignSecret
+		}
 		o.validHttpAlarm(param.HttpAlarmConf)
 	}
+	if param.SyslogConf != nil && param.SyslogConf.Enable {
+		o.validSyslogConf(param.SyslogConf)
+	}
 	if param.DingAlarmConf != nil {
 		if param.DingAlarmConf.CorpSecret == models.SecreteMask {
 			param.DingAlarmConf.CorpSecret = app.DingAlarmConf.CorpSecret
 		}
 		o.validDingConf(param.DingAlarmConf)
 	}
+	if param.SlackAlarmConf != nil {
+		if param.SlackAlarmConf.WebhookUrl == models.SecreteMask {
+			param.SlackAlarmConf.WebhookUrl = app.SlackAlarmConf.WebhookUrl
+		}
+		if param.SlackAlarmConf.Enable {
+			o.validSlackConf(param.SlackAlarmConf)
+		}
+	}
+	if param.AlarmDedupConf != nil {
+		o.validAlarmDedupConf(param.AlarmDedupConf)
+	}
 	content, err := json.Marshal(param)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to encode param to json", err)
@@ -630,6 +840,28 @@ func (o *AppController) TestDing(config map[string]interface{}) {
 	o.ServeWithEmptyData()
 }
 
+// @router /slack/test [post]
+func (o *AppController) TestSlack() {
+	var param map[string]string
+	o.UnmarshalJson(&param)
+	appId := param["app_id"]
+	if appId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id cannot be empty")
+	}
+	app, err := models.GetAppByIdWithoutMask(appId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "can not find the app", err)
+	}
+	if !app.SlackAlarmConf.Enable {
+		o.ServeError(http.StatusBadRequest, "please enable the slack alarm first")
+	}
+	err = models.PushSlackAttackAlarm(app, 0, nil, true)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to test slack alarm", err)
+	}
+	o.ServeWithEmptyData()
+}
+
 // @router /http/test [post]
 func (o *AppController) TestHttp(config map[string]interface{}) {
 	var param map[string]string
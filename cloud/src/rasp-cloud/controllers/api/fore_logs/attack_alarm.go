@@ -15,12 +15,19 @@
 package fore_logs
 
 import (
+	"encoding/csv"
+	"fmt"
+	"github.com/astaxie/beego"
+	"rasp-cloud/conf"
 	"rasp-cloud/controllers"
 	"encoding/json"
 	"net/http"
 	"rasp-cloud/models"
 	"rasp-cloud/models/logs"
+	"rasp-cloud/es"
 	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -74,6 +81,64 @@ func (o *AttackAlarmController) AggregationWithTime() {
 	o.Serve(result)
 }
 
+// @router /aggr/histogram [post]
+func (o *AttackAlarmController) AggregationHistogram() {
+	var param = &logs.AggrHistogramParam{}
+	o.UnmarshalJson(&param)
+	searchData := o.handleAttackSearchData(param.Data)
+	if param.Interval == "" {
+		o.ServeError(http.StatusBadRequest, "interval cannot be empty")
+	}
+	if param.TimeZone == "" {
+		o.ServeError(http.StatusBadRequest, "time_zone cannot be empty")
+	}
+	if len(param.TimeZone) > 32 {
+		o.ServeError(http.StatusBadRequest, "the length of time_zone cannot be greater than 32")
+	}
+	if param.Size == 0 {
+		param.Size = 10
+	}
+	if param.Size < 0 || param.Size > logs.MaxHistogramSize {
+		o.ServeError(http.StatusBadRequest,
+			"size must be between 1 and "+strconv.Itoa(logs.MaxHistogramSize))
+	}
+	count, err := logs.GetHistogramBucketCount(param.Data.StartTime, param.Data.EndTime, param.Interval)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, err.Error())
+	}
+	if count > logs.MaxHistogramBuckets {
+		o.ServeError(http.StatusBadRequest, "too many buckets: "+strconv.FormatInt(count, 10)+
+			", the count of buckets cannot be greater than "+strconv.Itoa(logs.MaxHistogramBuckets)+
+			", please use a greater interval or a shorter time range")
+	}
+	result, err := logs.AggregationAttackHistogram(param.Data.StartTime, param.Data.EndTime,
+		param.Interval, param.TimeZone, param.Size, searchData, param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
+// @router /aggr/source [post]
+func (o *AttackAlarmController) AggregationWithSource() {
+	var param = &logs.AggrSourceParam{}
+	o.UnmarshalJson(&param)
+	searchData := o.handleAttackSearchData(param.Data)
+	if param.Size == 0 {
+		param.Size = 10
+	}
+	if param.Size < 0 || param.Size > logs.MaxAttackSourceSize {
+		o.ServeError(http.StatusBadRequest,
+			"size must be between 1 and "+strconv.Itoa(logs.MaxAttackSourceSize))
+	}
+	result, err := logs.AggregationAttackWithSource(param.Data.StartTime, param.Data.EndTime, param.Size,
+		searchData, param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get aggregation from es", err)
+	}
+	o.Serve(result)
+}
+
 // @router /aggr/type [post]
 func (o *AttackAlarmController) AggregationWithType() {
 	var param = &logs.AggrFieldParam{}
@@ -103,9 +168,13 @@ func (o *AttackAlarmController) AggregationWithUserAgent() {
 // @router /search [post]
 func (o *AttackAlarmController) Search() {
 	param, searchData := o.handleAttackSearchParam()
+	index, err := es.GetSearchIndex(logs.AttackAlarmInfo.EsIndex, param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid app_id", err)
+	}
 	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime,
 		false, searchData, "event_time", param.Page,
-		param.Perpage, false, logs.AttackAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+		param.Perpage, false, index)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
 	}
@@ -121,9 +190,13 @@ func (o *AttackAlarmController) Search() {
 // @router /aggr/vuln [post]
 func (o *AttackAlarmController) AggregationVuln() {
 	param, searchData := o.handleAttackSearchParam()
+	index, err := es.GetSearchIndex(logs.AttackAlarmInfo.EsIndex, param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid app_id", err)
+	}
 	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime,
 		true, searchData, "event_time", param.Page,
-		param.Perpage, false, logs.AttackAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+		param.Perpage, false, index)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
 	}
@@ -136,32 +209,215 @@ func (o *AttackAlarmController) AggregationVuln() {
 	})
 }
 
+// @router /false_positive [post]
+func (o *AttackAlarmController) MarkFalsePositive() {
+	var param = &logs.FalsePositiveParam{}
+	o.UnmarshalJson(&param)
+	if (len(param.Ids) == 0) == (param.Data == nil) {
+		o.ServeError(http.StatusBadRequest, "either ids or data must be provided")
+	}
+	user, err := models.GetLoginUserName()
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get the login user", err)
+	}
+	var (
+		updated int64
+		taskId  string
+		appId   string
+	)
+	if param.Data != nil {
+		// the alarms of all the apps can not be changed with one filter
+		if param.Data.AppId == "" {
+			o.ServeError(http.StatusBadRequest, "app_id cannot be empty")
+		}
+		searchData := o.handleAttackSearchData(param.Data)
+		delete(searchData, "false_positive")
+		appId = param.Data.AppId
+		taskId, err = logs.MarkFalsePositiveByQuery(appId, param.Data.StartTime, param.Data.EndTime,
+			searchData, param.FalsePositive, user)
+	} else {
+		if param.AppId == "" {
+			o.ServeError(http.StatusBadRequest, "app_id cannot be empty")
+		}
+		_, err := models.GetAppById(param.AppId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "cannot get the app: "+param.AppId, err)
+		}
+		if len(param.Ids) > logs.MaxFalsePositiveIds {
+			o.ServeError(http.StatusBadRequest,
+				"the count of ids cannot be greater than "+strconv.Itoa(logs.MaxFalsePositiveIds))
+		}
+		for _, id := range param.Ids {
+			if id == "" || len(id) > 128 {
+				o.ServeError(http.StatusBadRequest, "the length of id must be between 1 and 128")
+			}
+		}
+		appId = param.AppId
+		updated, err = logs.MarkFalsePositiveByIds(appId, param.Ids, param.FalsePositive, user)
+	}
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update the false positive flag of attack alarms", err)
+	}
+	action := "Unmarked"
+	if param.FalsePositive {
+		action = "Marked"
+	}
+	if len(param.Ids) > 0 {
+		content := action + " " + strconv.FormatInt(updated, 10) + " attack alarms as false positives, ids: " +
+			strings.Join(param.Ids, ", ")
+		models.AddOperation(appId, models.OperationTypeMarkFalsePositive, o.Ctx.Input.IP(), content, user)
+		o.Serve(map[string]interface{}{
+			"updated": updated,
+		})
+		return
+	}
+	filter, _ := json.Marshal(param.Data)
+	content := action + " attack alarms as false positives in background, task: " + taskId +
+		", filter: " + string(filter)
+	models.AddOperation(appId, models.OperationTypeMarkFalsePositive, o.Ctx.Input.IP(), content, user)
+	o.Serve(map[string]interface{}{
+		"task_id": taskId,
+	})
+}
+
+var (
+	attackExportHeader = []string{"time", "attack_type", "intercept_state", "url", "attack_source",
+		"server_hostname", "plugin_message", "stack_md5"}
+	// the newlines are kept as \n, so that every alarm is one line of the csv
+	exportNewlineReplacer = strings.NewReplacer("\r\n", "\\n", "\n", "\\n", "\r", "\\n")
+)
+
+// @router /export [post]
+func (o *AttackAlarmController) Export() {
+	var param struct {
+		Data     *logs.AttackSearchData `json:"data"`
+		TimeZone string                 `json:"time_zone"`
+	}
+	o.UnmarshalJson(&param)
+	searchData := o.handleAttackSearchData(param.Data)
+	location := o.GetExportLocation(param.TimeZone)
+	maxRows := conf.AppConfig.AlarmExportMaxRows
+	total, err := logs.CountAttackAlarm(param.Data.AppId, param.Data.StartTime, param.Data.EndTime, searchData)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to count the alarms to export", err)
+	}
+	if total > maxRows {
+		o.ServeError(http.StatusBadRequest, "too many alarms to export: "+strconv.FormatInt(total, 10)+
+			", the count of exported alarms cannot be greater than "+strconv.FormatInt(maxRows, 10)+
+			", please narrow the time range or the filters")
+	}
+
+	// the errors can not be served after the csv is started, they are logged instead
+	appId := param.Data.AppId
+	if appId == "*" {
+		appId = "all"
+	}
+	o.Ctx.Output.Header("Content-Type", "text/csv; charset=utf-8")
+	o.Ctx.Output.Header("Content-Disposition", "attachment;filename=attack-alarm-"+appId+"-"+
+		time.Now().In(location).Format("20060102150405")+".csv")
+	writer := csv.NewWriter(o.Ctx.ResponseWriter)
+	writer.Write(attackExportHeader)
+	count := 0
+	err = logs.ExportAttackAlarm(param.Data.AppId, param.Data.StartTime, param.Data.EndTime, searchData,
+		maxRows, func(alarm map[string]interface{}) error {
+			row := make([]string, len(attackExportHeader))
+			row[0] = formatAlarmTime(alarm["event_time"], location)
+			for i, field := range attackExportHeader[1:] {
+				row[i+1] = controllers.EscapeCsvCell(exportNewlineReplacer.Replace(formatExportValue(alarm[field])))
+			}
+			writer.Write(row)
+			if count++; count%100 == 0 {
+				writer.Flush()
+			}
+			return writer.Error()
+		})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		beego.Error("failed to export attack alarms of app " + param.Data.AppId + ": " + err.Error())
+	}
+}
+
+// the event_time is saved as it is reported, either the epoch millis or the formatted time
+func formatAlarmTime(value interface{}, location *time.Location) string {
+	var millis int64
+	switch v := value.(type) {
+	case float64:
+		millis = int64(v)
+	case string:
+		var err error
+		millis, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return v
+		}
+	default:
+		return formatExportValue(value)
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)).In(location).Format("2006-01-02 15:04:05")
+}
+
+// formatExportValue flattens the field of the alarm to one cell, the items of array are joined with ;
+// and the objects are kept as json
+func formatExportValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatExportValue(item)
+		}
+		return strings.Join(items, ";")
+	default:
+		content, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(content)
+	}
+}
+
 func (o *AttackAlarmController) handleAttackSearchParam() (param *logs.SearchAttackParam,
 	searchData map[string]interface{}) {
 	param = &logs.SearchAttackParam{}
 	o.UnmarshalJson(&param)
-	if param.Data == nil {
+	o.ValidPage(param.Page, param.Perpage)
+	searchData = o.handleAttackSearchData(param.Data)
+	return
+}
+
+// handleAttackSearchData validates the filters of attack alarms and converts them to the search query
+func (o *AttackAlarmController) handleAttackSearchData(data *logs.AttackSearchData) (
+	searchData map[string]interface{}) {
+	if data == nil {
 		o.ServeError(http.StatusBadRequest, "search data can not be empty")
 	}
-	if param.Data.AppId != "" {
-		_, err := models.GetAppById(param.Data.AppId)
+	if data.AppId != "" {
+		_, err := models.GetAppById(data.AppId)
 		if err != nil {
-			o.ServeError(http.StatusBadRequest, "cannot get the app: "+param.Data.AppId, err)
+			o.ServeError(http.StatusBadRequest, "cannot get the app: "+data.AppId, err)
 		}
 	} else {
-		param.Data.AppId = "*"
+		data.AppId = "*"
 	}
-	if param.Data.StartTime <= 0 {
+	if data.StartTime <= 0 {
 		o.ServeError(http.StatusBadRequest, "start_time must be greater than 0")
 	}
-	if param.Data.EndTime <= 0 {
+	if data.EndTime <= 0 {
 		o.ServeError(http.StatusBadRequest, "end_time must be greater than 0")
 	}
-	if param.Data.StartTime > param.Data.EndTime {
+	if data.StartTime > data.EndTime {
 		o.ServeError(http.StatusBadRequest, "start_time cannot be greater than end_time")
 	}
-	o.ValidPage(param.Page, param.Perpage)
-	content, err := json.Marshal(param.Data)
+	content, err := json.Marshal(data)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to encode search data", err)
 	}
@@ -172,6 +428,11 @@ func (o *AttackAlarmController) handleAttackSearchParam() (param *logs.SearchAtt
 	delete(searchData, "start_time")
 	delete(searchData, "end_time")
 	delete(searchData, "app_id")
+	delete(searchData, "include_false_positive")
+	if !data.IncludeFalsePositive {
+		searchData["false_positive"] = false
+	}
+	handleRaspTag(&o.BaseController, data.AppId, searchData)
 	return
 }
 
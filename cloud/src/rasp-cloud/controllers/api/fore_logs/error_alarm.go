@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"rasp-cloud/models"
 	"rasp-cloud/models/logs"
+	"rasp-cloud/es"
 	"math"
 )
 
@@ -64,8 +65,13 @@ func (o *ErrorController) Search() {
 	delete(searchData, "start_time")
 	delete(searchData, "end_time")
 	delete(searchData, "app_id")
+	handleRaspTag(&o.BaseController, param.Data.AppId, searchData)
+	index, err := es.GetSearchIndex(logs.ErrorAlarmInfo.EsIndex, param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid app_id", err)
+	}
 	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime, false, searchData, "event_time",
-		param.Page, param.Perpage, false, logs.ErrorAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+		param.Page, param.Perpage, false, index)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
 	}
@@ -17,10 +17,13 @@ package fore_logs
 import (
 	"rasp-cloud/controllers"
 	"rasp-cloud/models/logs"
+	"rasp-cloud/es"
 	"encoding/json"
 	"rasp-cloud/models"
 	"net/http"
 	"math"
+	"strconv"
+	"strings"
 )
 
 // Operations about policy alarm message
@@ -65,8 +68,23 @@ func (o *PolicyAlarmController) Search() {
 	delete(searchData, "start_time")
 	delete(searchData, "end_time")
 	delete(searchData, "app_id")
+	// the ignored alarms are hidden unless they are requested
+	if param.Data.Status == nil {
+		searchData["status"] = []interface{}{logs.PolicyAlarmStatusOpen, logs.PolicyAlarmStatusResolved}
+	} else {
+		for _, status := range *param.Data.Status {
+			if !logs.IsValidPolicyAlarmStatus(status) {
+				o.ServeError(http.StatusBadRequest, "invalid status: "+status)
+			}
+		}
+	}
+	handleRaspTag(&o.BaseController, param.Data.AppId, searchData)
+	index, err := es.GetSearchIndex(logs.PolicyAlarmInfo.EsIndex, param.Data.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "invalid app_id", err)
+	}
 	total, result, err := logs.SearchLogs(param.Data.StartTime, param.Data.EndTime, false, searchData, "event_time",
-		param.Page, param.Perpage, false, logs.PolicyAlarmInfo.EsAliasIndex+"-"+param.Data.AppId)
+		param.Page, param.Perpage, false, index)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to search data from es", err)
 	}
@@ -78,3 +96,45 @@ func (o *PolicyAlarmController) Search() {
 		"data":       result,
 	})
 }
+
+// @router /status [post]
+func (o *PolicyAlarmController) UpdateStatus() {
+	var param = &logs.PolicyStatusParam{}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id cannot be empty")
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "cannot get the app: "+param.AppId, err)
+	}
+	if !logs.IsValidPolicyAlarmStatus(param.Status) {
+		o.ServeError(http.StatusBadRequest,
+			"status must be one of "+strings.Join(logs.PolicyAlarmStatuses, ", "))
+	}
+	if len(param.Ids) == 0 {
+		o.ServeError(http.StatusBadRequest, "ids cannot be empty")
+	}
+	if len(param.Ids) > logs.MaxPolicyAlarmStatusIds {
+		o.ServeError(http.StatusBadRequest,
+			"the count of ids cannot be greater than "+strconv.Itoa(logs.MaxPolicyAlarmStatusIds))
+	}
+	for _, id := range param.Ids {
+		if id == "" || len(id) > 128 {
+			o.ServeError(http.StatusBadRequest, "the length of id must be between 1 and 128")
+		}
+	}
+	user, err := models.GetLoginUserName()
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get the login user", err)
+	}
+	updated, err := logs.UpdatePolicyAlarmStatus(param.AppId, param.Ids, param.Status, user)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update the status of policy alarms", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeUpdatePolicyAlarmStatus, o.Ctx.Input.IP(),
+		"Status of "+strconv.FormatInt(updated, 10)+" policy alarms updated to "+param.Status, user)
+	o.Serve(map[string]interface{}{
+		"updated": updated,
+	})
+}
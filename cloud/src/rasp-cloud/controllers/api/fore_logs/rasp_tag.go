@@ -0,0 +1,45 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package fore_logs
+
+import (
+	"net/http"
+	"rasp-cloud/controllers"
+	"rasp-cloud/models"
+)
+
+// handleRaspTag replaces the rasp_tag of the search data with the ids of the rasps with the tag,
+// the alarms are filtered by a terms query on rasp_id
+func handleRaspTag(o *controllers.BaseController, appId string, searchData map[string]interface{}) {
+	tag, ok := searchData["rasp_tag"].(string)
+	if !ok {
+		return
+	}
+	delete(searchData, "rasp_tag")
+	if appId == "*" {
+		appId = ""
+	}
+	ids, err := models.GetRaspIdsByTag(appId, tag)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get rasps by tag", err)
+	}
+	raspIds := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if raspId, ok := searchData["rasp_id"]; !ok || raspId == id {
+			raspIds = append(raspIds, id)
+		}
+	}
+	searchData["rasp_id"] = raspIds
+}
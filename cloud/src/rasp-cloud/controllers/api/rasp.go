@@ -15,8 +15,13 @@
 package api
 
 import (
+	"encoding/csv"
+	"github.com/astaxie/beego"
 	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 	"rasp-cloud/controllers"
 	"rasp-cloud/models"
 	"github.com/astaxie/beego/validation"
@@ -29,16 +34,20 @@ type RaspController struct {
 // @router /search [post]
 func (o *RaspController) Search() {
 	var param struct {
-		Data    *models.Rasp `json:"data" `
-		Page    int          `json:"page"`
-		Perpage int          `json:"perpage"`
+		Data    *models.Rasp       `json:"data" `
+		Filter  *models.RaspFilter `json:"filter"`
+		Page    int                `json:"page"`
+		Perpage int                `json:"perpage"`
 	}
 	o.UnmarshalJson(&param)
 	if param.Data == nil {
 		o.ServeError(http.StatusBadRequest, "search data can not be empty")
 	}
 	o.ValidPage(param.Page, param.Perpage)
-	total, rasps, err := models.FindRasp(param.Data, param.Page, param.Perpage)
+	if param.Filter != nil {
+		o.validRaspFilter(param.Filter)
+	}
+	total, rasps, err := models.FindRasp(param.Data, param.Filter, param.Page, param.Perpage)
 	if err != nil {
 		o.ServeError(http.StatusBadRequest, "failed to get rasp", err)
 	}
@@ -107,3 +116,270 @@ func (o *RaspController) Delete() {
 		})
 	}
 }
+
+// @router /batch_delete [post]
+func (o *RaspController) BatchDelete() {
+	var param struct {
+		AppId       string   `json:"app_id"`
+		Ids         []string `json:"ids"`
+		OfflineDays int64    `json:"offline_days"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "the app_id can not be empty")
+	}
+	if len(param.Ids) == 0 && param.OfflineDays == 0 {
+		o.ServeError(http.StatusBadRequest, "ids and offline_days can not be empty at the same time")
+	}
+	if len(param.Ids) > 0 && param.OfflineDays != 0 {
+		o.ServeError(http.StatusBadRequest, "ids and offline_days can not be set at the same time")
+	}
+	if param.OfflineDays < 0 {
+		o.ServeError(http.StatusBadRequest, "offline_days must be greater than 0")
+	}
+	if len(param.Ids) > models.MaxRaspBatchSize {
+		o.ServeError(http.StatusBadRequest,
+			"the count of ids can not be greater than "+strconv.Itoa(models.MaxRaspBatchSize))
+	}
+	ids := param.Ids
+	if param.OfflineDays > 0 {
+		var err error
+		ids, err = models.FindOfflineRaspIds(param.AppId, param.OfflineDays*24*3600, models.MaxRaspBatchSize)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to find offline rasps", err)
+		}
+	}
+	results, removed, err := models.RemoveRaspByIds(param.AppId, ids)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove rasps", err)
+	}
+	if removed > 0 {
+		content := "Deleted " + strconv.Itoa(removed) + " RASP agents in batch"
+		if param.OfflineDays > 0 {
+			content += " offline for more than " + strconv.FormatInt(param.OfflineDays, 10) + " days"
+		}
+		models.AddOperation(param.AppId, models.OperationTypeDeleteRasp, o.Ctx.Input.IP(), content)
+	}
+	o.Serve(map[string]interface{}{
+		"count": removed,
+		"data":  results,
+	})
+}
+
+type raspTagParam struct {
+	AppId string   `json:"app_id"`
+	Ids   []string `json:"ids"`
+	Tags  []string `json:"tags"`
+}
+
+// @router /tag/add [post]
+func (o *RaspController) AddTags() {
+	var param raspTagParam
+	o.UnmarshalJson(&param)
+	o.validTagParam(&param)
+	count, err := models.AddRaspTags(param.AppId, param.Ids, param.Tags)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to add rasp tags", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeEditRasp, o.Ctx.Input.IP(),
+		"Added tags ["+strings.Join(param.Tags, ",")+"] to "+strconv.Itoa(count)+" RASP agents")
+	o.Serve(map[string]interface{}{
+		"count": count,
+	})
+}
+
+// @router /tag/remove [post]
+func (o *RaspController) RemoveTags() {
+	var param raspTagParam
+	o.UnmarshalJson(&param)
+	o.validTagParam(&param)
+	count, err := models.RemoveRaspTags(param.AppId, param.Ids, param.Tags)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to remove rasp tags", err)
+	}
+	models.AddOperation(param.AppId, models.OperationTypeEditRasp, o.Ctx.Input.IP(),
+		"Removed tags ["+strings.Join(param.Tags, ",")+"] from "+strconv.Itoa(count)+" RASP agents")
+	o.Serve(map[string]interface{}{
+		"count": count,
+	})
+}
+
+func (o *RaspController) validTagParam(param *raspTagParam) {
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "the app_id can not be empty")
+	}
+	if len(param.Ids) == 0 {
+		o.ServeError(http.StatusBadRequest, "ids can not be empty")
+	}
+	if len(param.Ids) > models.MaxRaspBatchSize {
+		o.ServeError(http.StatusBadRequest,
+			"the count of ids can not be greater than "+strconv.Itoa(models.MaxRaspBatchSize))
+	}
+	if len(param.Tags) == 0 {
+		o.ServeError(http.StatusBadRequest, "tags can not be empty")
+	}
+	if len(param.Tags) > models.MaxRaspTags {
+		o.ServeError(http.StatusBadRequest,
+			"the count of tags can not be greater than "+strconv.Itoa(models.MaxRaspTags))
+	}
+	for _, tag := range param.Tags {
+		if tag == "" {
+			o.ServeError(http.StatusBadRequest, "the tag can not be empty")
+		}
+		if len(tag) > 64 {
+			o.ServeError(http.StatusBadRequest, "the length of tag can not be greater than 64")
+		}
+	}
+}
+
+func (o *RaspController) validRaspFilter(filter *models.RaspFilter) {
+	if filter.VersionMin != "" {
+		if _, err := models.GetVersionKey(filter.VersionMin); err != nil {
+			o.ServeError(http.StatusBadRequest, "invalid version_min", err)
+		}
+	}
+	if filter.VersionMax != "" {
+		if _, err := models.GetVersionKey(filter.VersionMax); err != nil {
+			o.ServeError(http.StatusBadRequest, "invalid version_max", err)
+		}
+	}
+	if len(filter.HostnamePattern) > 1024 {
+		o.ServeError(http.StatusBadRequest, "the length of hostname_pattern can not be greater than 1024")
+	}
+	if filter.SortBy != "" && filter.SortBy != models.RaspSortByRegisterTime &&
+		filter.SortBy != models.RaspSortByLastHeartbeatTime {
+		o.ServeError(http.StatusBadRequest, "sort_by must be register_time or last_heartbeat_time")
+	}
+}
+
+// @router /stats [post]
+func (o *RaspController) Stats() {
+	var param struct {
+		AppId    string `json:"app_id"`
+		TimeZone string `json:"time_zone"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "the app_id can not be empty")
+	}
+	_, zoneOffset := time.Now().In(o.GetExportLocation(param.TimeZone)).Zone()
+	stats, err := models.GetRaspStats(param.AppId, zoneOffset)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get rasp stats", err)
+	}
+	o.Serve(stats)
+}
+
+// @router /update [post]
+func (o *RaspController) Update() {
+	var param struct {
+		Id          string  `json:"id"`
+		AppId       string  `json:"app_id"`
+		Description *string `json:"description"`
+		Owner       *string `json:"owner"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Id == "" {
+		o.ServeError(http.StatusBadRequest, "the id can not be empty")
+	}
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "the app_id can not be empty")
+	}
+	if param.Description == nil && param.Owner == nil {
+		o.ServeError(http.StatusBadRequest, "description and owner can not be empty at the same time")
+	}
+	if param.Description != nil && len(*param.Description) > 1024 {
+		o.ServeError(http.StatusBadRequest, "the length of description can not be greater than 1024")
+	}
+	if param.Owner != nil && len(*param.Owner) > 128 {
+		o.ServeError(http.StatusBadRequest, "the length of owner can not be greater than 128")
+	}
+	rasp, err := models.GetRaspById(param.Id)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get rasp", err)
+	}
+	// the rasp can only be updated through the app it belongs to
+	if rasp.AppId != param.AppId {
+		o.ServeError(http.StatusForbidden, "the rasp does not belong to the app: "+param.AppId)
+	}
+	err = models.UpdateRaspAnnotation(param.Id, param.Description, param.Owner)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to update rasp", err)
+	}
+	changes := make([]string, 0, 2)
+	if param.Description != nil {
+		changes = append(changes, "description from "+strconv.Quote(rasp.Description)+
+			" to "+strconv.Quote(*param.Description))
+		rasp.Description = *param.Description
+	}
+	if param.Owner != nil {
+		changes = append(changes, "owner from "+strconv.Quote(rasp.Owner)+" to "+strconv.Quote(*param.Owner))
+		rasp.Owner = *param.Owner
+	}
+	models.AddOperation(param.AppId, models.OperationTypeEditRasp, o.Ctx.Input.IP(),
+		"Updated RASP agent "+param.Id+": "+strings.Join(changes, ", "))
+	o.Serve(rasp)
+}
+
+var raspExportHeader = []string{"id", "hostname", "register_ip", "version", "language", "online",
+	"last_heartbeat_time", "register_time", "description", "owner"}
+
+// @router /export [post]
+func (o *RaspController) Export() {
+	var param struct {
+		Data     *models.Rasp       `json:"data"`
+		Filter   *models.RaspFilter `json:"filter"`
+		TimeZone string             `json:"time_zone"`
+	}
+	o.UnmarshalJson(&param)
+	if param.Data == nil {
+		o.ServeError(http.StatusBadRequest, "search data can not be empty")
+	}
+	if param.Data.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "the app_id can not be empty")
+	}
+	if param.Filter != nil {
+		o.validRaspFilter(param.Filter)
+	}
+	location := o.GetExportLocation(param.TimeZone)
+
+	// the errors can not be served after the csv is started, they are logged instead
+	o.Ctx.Output.Header("Content-Type", "text/csv; charset=utf-8")
+	o.Ctx.Output.Header("Content-Disposition", "attachment;filename=rasp-"+param.Data.AppId+"-"+
+		time.Now().In(location).Format("20060102150405")+".csv")
+	writer := csv.NewWriter(o.Ctx.ResponseWriter)
+	writer.Write(raspExportHeader)
+	count := 0
+	err := models.ExportRasp(param.Data, param.Filter, func(rasp *models.Rasp) error {
+		writer.Write([]string{
+			controllers.EscapeCsvCell(rasp.Id),
+			controllers.EscapeCsvCell(rasp.HostName),
+			controllers.EscapeCsvCell(rasp.RegisterIp),
+			controllers.EscapeCsvCell(rasp.Version),
+			controllers.EscapeCsvCell(rasp.Language),
+			strconv.FormatBool(*rasp.Online),
+			formatExportTime(rasp.LastHeartbeatTime, location),
+			formatExportTime(rasp.RegisterTime, location),
+			controllers.EscapeCsvCell(rasp.Description),
+			controllers.EscapeCsvCell(rasp.Owner),
+		})
+		if count++; count%100 == 0 {
+			writer.Flush()
+		}
+		return writer.Error()
+	})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		beego.Error("failed to export rasps of app " + param.Data.AppId + ": " + err.Error())
+	}
+}
+
+func formatExportTime(t int64, location *time.Location) string {
+	if t <= 0 {
+		return ""
+	}
+	return time.Unix(t, 0).In(location).Format("2006-01-02 15:04:05")
+}
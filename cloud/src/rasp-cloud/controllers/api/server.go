@@ -20,6 +20,8 @@ import (
 	"net/http"
 	"gopkg.in/mgo.v2"
 	"strings"
+	"rasp-cloud/es"
+	"rasp-cloud/models/logs"
 )
 
 type ServerController struct {
@@ -75,6 +77,138 @@ func (o *ServerController) PutUrl() {
 	o.Serve(serverUrl)
 }
 
+// @router /es/index [post]
+func (o *ServerController) GetEsIndex() {
+	appId := o.getEsAppId()
+	result := make(map[string][]*es.IndexInfo)
+	for _, index := range es.GetRolloverIndexes() {
+		infos, err := es.GetIndexInfo(index, appId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get es index info of "+index, err)
+		}
+		result[index] = infos
+	}
+	o.Serve(result)
+}
+
+// @router /es/rollover [post]
+func (o *ServerController) RolloverEsIndex() {
+	appId := o.getEsAppId()
+	result := make(map[string][]*es.RolloverResult)
+	for _, index := range es.GetRolloverIndexes() {
+		rolloverResults, err := es.RolloverAll(index, appId, true)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to roll over es index "+index, err)
+		}
+		result[index] = rolloverResults
+	}
+	o.Serve(result)
+}
+
+// @router /es/task [post]
+func (o *ServerController) GetEsTask() {
+	var param struct {
+		TaskId string `json:"task_id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.TaskId != "" {
+		status, err := es.GetDeleteTaskStatus(param.TaskId)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to get es task", err)
+		}
+		o.Serve(status)
+		return
+	}
+	o.Serve(es.GetDeleteTasks())
+}
+
+// @router /es/migrate [post]
+func (o *ServerController) MigrateEsIndex() {
+	var param struct {
+		AppId     string `json:"app_id"`
+		Index     string `json:"index"`
+		DryRun    bool   `json:"dry_run"`
+		DeleteOld bool   `json:"delete_old"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		o.ServeError(http.StatusBadRequest, "app_id can not be empty")
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	indexes := es.GetRolloverIndexes()
+	if param.Index != "" {
+		valid := false
+		for _, index := range indexes {
+			if index == param.Index {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			o.ServeError(http.StatusBadRequest, "the index can not be migrated: "+param.Index)
+		}
+		indexes = []string{param.Index}
+	}
+	result := make(map[string]*es.Migration)
+	for _, index := range indexes {
+		migration, err := es.MigrateIndex(index, param.AppId, param.DryRun, param.DeleteOld)
+		if err != nil {
+			o.ServeError(http.StatusBadRequest, "failed to migrate es index "+index, err)
+		}
+		result[index] = migration
+	}
+	o.Serve(result)
+}
+
+// @router /es/migration [post]
+func (o *ServerController) GetEsMigration() {
+	o.Serve(es.GetMigrations())
+}
+
+// @router /forward/stats [post]
+func (o *ServerController) GetForwardStats() {
+	var param struct {
+		AppId string `json:"app_id"`
+	}
+	o.UnmarshalJson(&param)
+	stats, failures, resetTime := logs.GetForwardStats(param.AppId)
+	o.Serve(map[string]interface{}{
+		"stats":      stats,
+		"failures":   failures,
+		"reset_time": resetTime,
+	})
+}
+
+// @router /forward/reset [post]
+func (o *ServerController) ResetForwardStats() {
+	logs.ResetForwardStats()
+	o.ServeWithEmptyData()
+}
+
+// @router /es/slow_query [post]
+func (o *ServerController) GetEsSlowQuery() {
+	o.Serve(es.GetQueryStats())
+}
+
+// the empty app_id means all the apps
+func (o *ServerController) getEsAppId() string {
+	var param struct {
+		AppId string `json:"app_id"`
+	}
+	o.UnmarshalJson(&param)
+	if param.AppId == "" {
+		return "*"
+	}
+	_, err := models.GetAppById(param.AppId)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "failed to get app", err)
+	}
+	return param.AppId
+}
+
 func validHttpUrl(url string) bool {
 	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
 }
@@ -18,6 +18,8 @@ import (
 	"github.com/astaxie/beego"
 	"net/http"
 	"encoding/json"
+	"strings"
+	"time"
 )
 
 // base controller
@@ -72,3 +74,23 @@ func (o *BaseController) ValidPage(page int, perpage int) {
 		o.ServeError(http.StatusBadRequest, "perpage must be less than 100")
 	}
 }
+
+// GetExportLocation parses the time zone like +08:00 of the exported times, the default one is UTC
+func (o *BaseController) GetExportLocation(timeZone string) *time.Location {
+	if timeZone == "" {
+		return time.UTC
+	}
+	zone, err := time.Parse("-07:00", timeZone)
+	if err != nil {
+		o.ServeError(http.StatusBadRequest, "time_zone must be like +08:00", err)
+	}
+	return zone.Location()
+}
+
+// EscapeCsvCell prevents the spreadsheet from evaluating the cell reported by the agent or edited by the user
+func EscapeCsvCell(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,33 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"rasp-cloud/models"
+)
+
+type SystemController struct {
+	BaseController
+}
+
+// @router /health [get]
+func (o *SystemController) Health() {
+	health := models.GetSystemHealth()
+	if !health.Ready {
+		o.Ctx.Output.SetStatus(http.StatusServiceUnavailable)
+	}
+	o.Serve(health)
+}
@@ -0,0 +1,284 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"rasp-cloud/conf"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BulkProcessor buffers the documents in a bounded queue, the workers send them to es with BulkInsert
+// when the batch is full or the flush interval is reached, so that the agent requests never wait for es
+type BulkProcessor struct {
+	docType       string
+	queue         chan map[string]interface{}
+	batchSize     int
+	flushInterval time.Duration
+	stop          chan struct{}
+	closed        bool
+	lock          sync.RWMutex
+	wg            sync.WaitGroup
+	indexed       int64
+	failed        int64
+	rejected      int64
+	spool         *diskSpool
+}
+
+type BulkProcessorStats struct {
+	DocType  string `json:"doc_type"`
+	Pending  int    `json:"pending"`
+	Indexed  int64  `json:"indexed"`
+	Failed   int64  `json:"failed"`
+	Rejected int64  `json:"rejected"`
+	// the docs waiting in the disk spool until es recovers
+	Spooled      int64 `json:"spooled"`
+	SpoolSize    int64 `json:"spool_size"`
+	SpoolDropped int64 `json:"spool_dropped"`
+}
+
+var (
+	ErrBulkQueueFull       = errors.New("the es bulk queue is full, please retry later")
+	ErrBulkProcessorClosed = errors.New("the es bulk processor is closed")
+	bulkProcessors         = make(chan []*BulkProcessor, 1)
+	maxLoggedBulkFailures  = 10
+)
+
+func init() {
+	bulkProcessors <- make([]*BulkProcessor, 0)
+}
+
+func NewBulkProcessor(docType string, queueSize int) *BulkProcessor {
+	p := &BulkProcessor{
+		docType:       docType,
+		queue:         make(chan map[string]interface{}, queueSize),
+		batchSize:     conf.AppConfig.EsBulkSize,
+		flushInterval: time.Duration(conf.AppConfig.EsBulkFlushInterval) * time.Millisecond,
+		stop:          make(chan struct{}),
+	}
+	if isSpoolEnabled() {
+		spool, err := newDiskSpool(docType)
+		if err != nil {
+			beego.Error("failed to init es spool for " + docType + ", the docs will be dropped when es is " +
+				"unavailable: " + err.Error())
+		} else {
+			p.spool = spool
+			go p.drainSpool()
+		}
+	}
+	for i := 0; i < conf.AppConfig.EsBulkWorkers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	processors := <-bulkProcessors
+	bulkProcessors <- append(processors, p)
+	return p
+}
+
+// Add puts the document into the queue without blocking,
+// ErrBulkQueueFull is returned when the queue is full and the caller should retry later
+func (p *BulkProcessor) Add(doc map[string]interface{}) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.closed {
+		return ErrBulkProcessorClosed
+	}
+	select {
+	case p.queue <- doc:
+		return nil
+	default:
+		atomic.AddInt64(&p.rejected, 1)
+		return ErrBulkQueueFull
+	}
+}
+
+func (p *BulkProcessor) Stats() *BulkProcessorStats {
+	stats := &BulkProcessorStats{
+		DocType:  p.docType,
+		Pending:  len(p.queue),
+		Indexed:  atomic.LoadInt64(&p.indexed),
+		Failed:   atomic.LoadInt64(&p.failed),
+		Rejected: atomic.LoadInt64(&p.rejected),
+	}
+	if p.spool != nil {
+		stats.Spooled, stats.SpoolSize = p.spool.stats()
+		stats.SpoolDropped = atomic.LoadInt64(&p.spool.dropped)
+	}
+	return stats
+}
+
+// Close stops accepting documents and waits until the pending documents are flushed or timeout
+func (p *BulkProcessor) Close(timeout time.Duration) error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	p.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timeout to flush the es bulk processor of " + p.docType +
+			", pending: " + strconv.Itoa(len(p.queue)))
+	}
+}
+
+func (p *BulkProcessor) work() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+	docs := make([]map[string]interface{}, 0, p.batchSize)
+	for {
+		select {
+		case doc := <-p.queue:
+			docs = append(docs, doc)
+			if len(docs) >= p.batchSize {
+				docs = p.flush(docs)
+			}
+		case <-ticker.C:
+			docs = p.flush(docs)
+		case <-p.stop:
+			for {
+				select {
+				case doc := <-p.queue:
+					docs = append(docs, doc)
+					if len(docs) >= p.batchSize {
+						docs = p.flush(docs)
+					}
+				default:
+					p.flush(docs)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *BulkProcessor) flush(docs []map[string]interface{}) []map[string]interface{} {
+	if len(docs) == 0 {
+		return docs
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&p.failed, int64(len(docs)))
+			beego.Error("failed to flush es bulk processor of "+p.docType+": ", r)
+		}
+	}()
+	// the docs are appended to the spool until it is drained, so that they are sent in order
+	if p.spool != nil && !p.spool.isEmpty() {
+		p.pushSpool(docs, nil)
+		return make([]map[string]interface{}, 0, p.batchSize)
+	}
+	err := BulkInsert(p.docType, docs)
+	if p.spool != nil && err != nil && isUnavailableError(err) {
+		p.pushSpool(docs, err)
+		return make([]map[string]interface{}, 0, p.batchSize)
+	}
+	if bulkErr, ok := err.(*BulkError); ok {
+		atomic.AddInt64(&p.failed, int64(len(bulkErr.Failures)))
+		atomic.AddInt64(&p.indexed, int64(len(docs)-len(bulkErr.Failures)))
+		logBulkFailures(bulkErr)
+	} else if err != nil {
+		atomic.AddInt64(&p.failed, int64(len(docs)))
+		beego.Error("failed to execute es bulk insert for " + p.docType + ", dropped " +
+			strconv.Itoa(len(docs)) + " docs: " + err.Error())
+	} else {
+		atomic.AddInt64(&p.indexed, int64(len(docs)))
+	}
+	return make([]map[string]interface{}, 0, p.batchSize)
+}
+
+func (p *BulkProcessor) pushSpool(docs []map[string]interface{}, cause error) {
+	err := p.spool.push(docs)
+	if err != nil {
+		atomic.AddInt64(&p.failed, int64(len(docs)))
+		beego.Error("failed to spool " + p.docType + " docs to disk, dropped " +
+			strconv.Itoa(len(docs)) + " docs: " + err.Error())
+		return
+	}
+	if cause != nil {
+		beego.Warning("es is unavailable, spooled " + strconv.Itoa(len(docs)) + " " + p.docType +
+			" docs to disk: " + cause.Error())
+	}
+}
+
+func (p *BulkProcessor) drainSpool() {
+	ticker := time.NewTicker(spoolDrainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.spool.drain()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// logBulkFailures logs the rejected documents with the fields to find the agent which sent them
+func logBulkFailures(bulkErr *BulkError) {
+	beego.Error("failed to execute es bulk insert: " + bulkErr.Error())
+	for i, failure := range bulkErr.Failures {
+		if i >= maxLoggedBulkFailures {
+			beego.Error("the other " + strconv.Itoa(len(bulkErr.Failures)-i) + " failed " +
+				bulkErr.DocType + " docs are not logged")
+			break
+		}
+		beego.Error("dropped " + bulkErr.DocType + " doc at position " + strconv.Itoa(failure.Position) +
+			" of index " + failure.Index + ", app_id: " + fmt.Sprint(failure.Doc["app_id"]) +
+			", rasp_id: " + fmt.Sprint(failure.Doc["rasp_id"]) + ", [" + strconv.Itoa(failure.Status) + "] " +
+			failure.Type + ": " + failure.Reason)
+	}
+}
+
+func GetBulkProcessorStats() []*BulkProcessorStats {
+	processors := <-bulkProcessors
+	defer func() {
+		bulkProcessors <- processors
+	}()
+	result := make([]*BulkProcessorStats, 0, len(processors))
+	for _, p := range processors {
+		result = append(result, p.Stats())
+	}
+	return result
+}
+
+// CloseBulkProcessors flushes all the bulk processors before the process exits
+func CloseBulkProcessors(timeout time.Duration) {
+	processors := <-bulkProcessors
+	defer func() {
+		bulkProcessors <- processors
+	}()
+	for _, p := range processors {
+		err := p.Close(timeout)
+		if err != nil {
+			beego.Error(err)
+		}
+	}
+}
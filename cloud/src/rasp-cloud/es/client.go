@@ -0,0 +1,185 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"github.com/olivere/elastic"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"rasp-cloud/conf"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyTransport sets the api key of x-pack security for every request
+type apiKeyTransport struct {
+	apiKey    string
+	transport http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "ApiKey "+t.apiKey)
+	return t.transport.RoundTrip(req)
+}
+
+func newHttpClient(config *conf.RaspAppConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.EsTlsSkipVerify,
+	}
+	if config.EsCaFile != "" {
+		caContent, err := ioutil.ReadFile(config.EsCaFile)
+		if err != nil {
+			return nil, errors.New("failed to read es ca file: " + err.Error())
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caContent) {
+			return nil, errors.New("failed to parse es ca file: " + config.EsCaFile)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	if config.EsApiKey != "" {
+		transport = &apiKeyTransport{apiKey: config.EsApiKey, transport: transport}
+	}
+	return &http.Client{Transport: &compatTransport{&queryStatTransport{transport}}}, nil
+}
+
+// GetEsAddrs splits the EsAddr config, which is a comma separated list of the es nodes
+func GetEsAddrs(esAddr string) []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(esAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// ErrAuthRejected is returned when the es nodes reply 401 or 403 to the configured credentials
+var ErrAuthRejected = errors.New("es authentication is rejected")
+
+// NewEsClient creates the client with all the es nodes, the request failed to connect a node is retried
+// on the next node, the nodes which are up are returned as well
+func NewEsClient(config *conf.RaspAppConfig) (*elastic.Client, []string, error) {
+	addrs := GetEsAddrs(config.EsAddr)
+	httpClient, err := newHttpClient(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	upAddrs, err := probeEsNodes(config, addrs, httpClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	// every node is tried at most once for a request
+	retryTicks := make([]int, len(addrs))
+	for i := range retryTicks {
+		retryTicks[i] = 100
+	}
+	client, err := elastic.NewClient(elastic.SetURL(addrs...),
+		elastic.SetBasicAuth(config.EsUser, config.EsPwd),
+		elastic.SetHttpClient(httpClient),
+		elastic.SetSniff(config.EsSniff),
+		elastic.SetHealthcheck(config.EsHealthCheck),
+		elastic.SetRetrier(elastic.NewBackoffRetrier(elastic.NewSimpleBackoff(retryTicks...))))
+	if err != nil {
+		return nil, nil, scrubErrors(addrs, err)
+	}
+	return client, upAddrs, nil
+}
+
+// probeEsNodes pings every node with a client without sniffing and healthcheck before the real client
+// is created, otherwise the rejected credentials fail the healthcheck and are reported as the nodes down
+func probeEsNodes(config *conf.RaspAppConfig, addrs []string, httpClient *http.Client) ([]string, error) {
+	client, err := elastic.NewSimpleClient(elastic.SetURL(addrs...),
+		elastic.SetBasicAuth(config.EsUser, config.EsPwd),
+		elastic.SetHttpClient(httpClient))
+	if err != nil {
+		return nil, scrubErrors(addrs, err)
+	}
+	defer client.Stop()
+	upAddrs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
+		_, code, err := client.Ping(addr).Do(ctx)
+		cancel()
+		if code == http.StatusUnauthorized || code == http.StatusForbidden {
+			beego.Error("es node " + scrubUrl(addr) + " rejects the credentials with status " + strconv.Itoa(code))
+			return nil, ErrAuthRejected
+		}
+		if err != nil || code != http.StatusOK {
+			beego.Warning("es node " + scrubUrl(addr) + " is down: " + fmt.Sprint(scrubError(addr, err)))
+			continue
+		}
+		beego.Info("es node " + scrubUrl(addr) + " is up")
+		upAddrs = append(upAddrs, addr)
+	}
+	if len(upAddrs) == 0 {
+		scrubbedAddrs := make([]string, len(addrs))
+		for i, addr := range addrs {
+			scrubbedAddrs[i] = scrubUrl(addr)
+		}
+		return nil, errors.New("none of the es nodes is reachable: " + strings.Join(scrubbedAddrs, ","))
+	}
+	return upAddrs, nil
+}
+
+// scrubUrl hides the credentials in the es url before it is logged
+func scrubUrl(addr string) string {
+	esUrl, err := url.Parse(addr)
+	if err != nil || esUrl.User == nil {
+		return addr
+	}
+	esUrl.User = url.User("***")
+	return esUrl.String()
+}
+
+func scrubError(addr string, err error) error {
+	if err == nil {
+		return nil
+	}
+	esUrl, parseErr := url.Parse(addr)
+	if parseErr != nil || esUrl.User == nil {
+		return err
+	}
+	return errors.New(strings.Replace(err.Error(), esUrl.User.String()+"@", "***@", -1))
+}
+
+func scrubErrors(addrs []string, err error) error {
+	for _, addr := range addrs {
+		err = scrubError(addr, err)
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"context"
+	"rasp-cloud/conf"
+	"time"
+)
+
+type ContextKind int
+
+const (
+	ContextSearch ContextKind = iota
+	ContextAggregation
+	ContextExport
+	ContextIngest
+)
+
+// SearchContext returns the context with the deadline configured for the kind of es request
+func SearchContext(kind ContextKind) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(context.Background(), time.Now().Add(GetTimeout(kind)))
+}
+
+func GetTimeout(kind ContextKind) time.Duration {
+	var timeout int64
+	switch kind {
+	case ContextAggregation:
+		timeout = conf.AppConfig.EsAggrTimeout
+	case ContextExport:
+		timeout = conf.AppConfig.EsExportTimeout
+	case ContextIngest:
+		timeout = conf.AppConfig.EsBulkTimeout
+	default:
+		timeout = conf.AppConfig.EsSearchTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
@@ -23,8 +23,13 @@ import (
 	"github.com/astaxie/beego"
 	"rasp-cloud/tools"
 	"fmt"
-	"strings"
 	"rasp-cloud/conf"
+	"math/rand"
+	"net/url"
+	"net/http"
+	"io"
+	"errors"
+	"sort"
 )
 
 var (
@@ -32,25 +37,63 @@ var (
 	Version       string
 	ttlIndexes    = make(chan map[string]time.Duration, 1)
 	minEsVersion  = "5.6.0"
+
+	minEsMajorVersion = 5
+	minEsMinorVersion = 6
+
+	scrollKeepAlive = "1m"
+
+	// the status of a policy alarm is kept when it is detected again, except that
+	// a resolved one is reopened, the other fields are replaced by the new detection
+	policyAlarmUpsertScript = `if (ctx._source.status == 'resolved') {
+		ctx._source.status = 'open';
+		ctx._source.reopened_count = (ctx._source.reopened_count == null ? 0 : ctx._source.reopened_count) + 1;
+		ctx._source.status_user = '';
+		ctx._source.status_time = params.time;
+	}
+	ctx._source.putAll(params.doc);`
+
+	bulkRetryBaseWait = 200 * time.Millisecond
+	bulkRetryMaxWait  = 5 * time.Second
+	// status codes returned by es when the cluster is overloaded or restarting
+	bulkRetryStatus = []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
 )
 
 func init() {
 	ttlIndexes <- make(map[string]time.Duration)
+	rolloverIndexes <- make(map[string]int)
 	if *conf.AppConfig.Flag.StartType != conf.StartTypeReset {
-		esAddr := conf.AppConfig.EsAddr
-		client, err := elastic.NewSimpleClient(elastic.SetURL(esAddr),
-			elastic.SetBasicAuth(conf.AppConfig.EsUser, conf.AppConfig.EsPwd))
+		client, upAddrs, err := NewEsClient(conf.AppConfig)
+		if err == ErrAuthRejected {
+			tools.Panic(tools.ErrCodeESInitFailed, "es authentication is rejected, "+
+				"please check the EsUser, EsPwd and EsApiKey config", err)
+		}
 		if err != nil {
 			tools.Panic(tools.ErrCodeESInitFailed, "init ES failed", err)
 		}
+		esAddr := upAddrs[0]
 		go startTTL(24 * time.Hour)
+		go startRollover(time.Hour)
 
 		Version, err = client.ElasticsearchVersion(esAddr)
 		if err != nil {
-			tools.Panic(tools.ErrCodeESInitFailed, "failed to get es version", err)
+			if elastic.IsStatusCode(err, http.StatusUnauthorized) || elastic.IsForbidden(err) {
+				tools.Panic(tools.ErrCodeESInitFailed, "es authentication is rejected, "+
+					"please check the EsUser, EsPwd and EsApiKey config of "+scrubUrl(esAddr), err)
+			}
+			tools.Panic(tools.ErrCodeESInitFailed, "failed to get es version", scrubError(esAddr, err))
 		}
 		beego.Info("ES version: " + Version)
-		if strings.Compare(Version, minEsVersion) < 0 {
+		err = initVersion(Version)
+		if err != nil {
+			tools.Panic(tools.ErrCodeESInitFailed, "failed to parse es version", err)
+		}
+		if !IsVersionAtLeast(minEsMajorVersion, minEsMinorVersion) {
 			tools.Panic(tools.ErrCodeESInitFailed, "unable to support the ElasticSearch with a version lower than "+
 				minEsVersion+ ","+ " the current version is "+ Version, nil)
 		}
@@ -80,22 +123,15 @@ func DeleteExpiredData() {
 	}()
 	for index, duration := range ttls {
 		expiredTime := strconv.FormatInt((time.Now().UnixNano()-int64(duration))/1000000, 10)
-		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
-		r, err := ElasticClient.DeleteByQuery(index).QueryString("@timestamp:<" + expiredTime).Do(ctx)
+		deleteNum, taskId, err := DeleteByQuery(index, elastic.NewQueryStringQuery("@timestamp:<"+expiredTime))
 		if err != nil {
-			if r != nil && r.Failures != nil {
-				beego.Error(r.Failures)
-			}
 			beego.Error("failed to delete expired data for index " + index + ": " + err.Error())
+		} else if taskId != "" {
+			beego.Info("start to delete expired data in background for index " + index + ", task: " + taskId)
 		} else {
-			var deleteNum int64
-			if r != nil {
-				deleteNum = r.Deleted
-			}
 			beego.Info("delete expired data successfully for index " + index + ", total: " +
 				strconv.FormatInt(deleteNum, 10))
 		}
-		cancel()
 	}
 }
 
@@ -110,7 +146,11 @@ func RegisterTTL(duration time.Duration, index string) {
 func CreateTemplate(name string, body string) error {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
 	defer cancel()
-	_, err := elastic.NewIndicesPutTemplateService(ElasticClient).Name(name).BodyString(body).Do(ctx)
+	body, err := adaptTemplate(body)
+	if err != nil {
+		return err
+	}
+	_, err = elastic.NewIndicesPutTemplateService(ElasticClient).Name(name).BodyString(body).Do(ctx)
 	if err != nil {
 		return err
 	}
@@ -125,6 +165,13 @@ func CreateEsIndex(index string) error {
 	if err != nil {
 		return err
 	}
+	if !exists {
+		// the first generation of the index may be deleted after it rolled over
+		exists, err = ElasticClient.IndexExists("real-" + index).Do(ctx)
+		if err != nil {
+			return err
+		}
+	}
 	if !exists {
 		createResult, err := ElasticClient.CreateIndex(index).Do(ctx)
 		if err != nil {
@@ -140,42 +187,240 @@ func CreateEsIndex(index string) error {
 }
 
 func Insert(index string, docType string, doc interface{}) (err error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	ctx, cancel := SearchContext(ContextIngest)
 	defer cancel()
-	_, err = ElasticClient.Index().Index(index).Type(docType).BodyJson(doc).Do(ctx)
+	_, err = ElasticClient.Index().Index(index).Type(GetDocType(docType)).BodyJson(doc).Do(ctx)
 	return
 }
 
+// BulkItemFailure is the document rejected by es in the bulk response
+type BulkItemFailure struct {
+	// the position of the document in the docs passed to BulkInsert
+	Position int                    `json:"position"`
+	Index    string                 `json:"index"`
+	Status   int                    `json:"status"`
+	Type     string                 `json:"type"`
+	Reason   string                 `json:"reason"`
+	Doc      map[string]interface{} `json:"-"`
+	request  elastic.BulkableRequest
+}
+
+// BulkError lists the documents failed permanently in the bulk insert, the other documents are indexed
+type BulkError struct {
+	DocType  string
+	Total    int
+	Failures []*BulkItemFailure
+}
+
+func (e *BulkError) Error() string {
+	f := e.Failures[0]
+	return strconv.Itoa(len(e.Failures)) + " of " + strconv.Itoa(e.Total) + " " + e.DocType +
+		" docs failed in es bulk insert, the first failure: [" + strconv.Itoa(f.Status) + "] " +
+		f.Type + ": " + f.Reason
+}
+
+// BulkInsert retries the whole request when es is unavailable and retries the documents rejected
+// with the retryable status, the documents failed permanently are returned with *BulkError
 func BulkInsert(docType string, docs []map[string]interface{}) (err error) {
-	bulkService := ElasticClient.Bulk()
-	for _, doc := range docs {
+	pending := make([]*BulkItemFailure, 0, len(docs))
+	for position, doc := range docs {
 		if doc["app_id"] == nil {
 			beego.Error("failed to get app_id param from alarm: " + fmt.Sprintf("%+v", doc))
 		}
 		if appId, ok := doc["app_id"].(string); ok {
+			index, err := GetIndex("openrasp-"+docType, appId)
+			if err != nil {
+				beego.Error("failed to get es index for " + docType + ": " + err.Error())
+				continue
+			}
+			var request elastic.BulkableRequest
 			if docType == "policy-alarm" {
-
-				bulkService.Add(elastic.NewBulkUpdateRequest().
-					Index("real-openrasp-" + docType + "-" + appId).
-					Type(docType).
-					Id(fmt.Sprint(doc["upsert_id"])).
-					DocAsUpsert(true).
-					Doc(doc))
+				request = newPolicyAlarmRequest(index, docType, doc)
 			} else {
-				if appId, ok := doc["app_id"].(string); ok {
-					bulkService.Add(elastic.NewBulkIndexRequest().
-						Index("real-openrasp-" + docType + "-" + appId).
-						Type(docType).
-						OpType("index").
-						Doc(doc))
-				}
+				request = elastic.NewBulkIndexRequest().
+					Index(index).
+					Type(GetDocType(docType)).
+					OpType("index").
+					Doc(doc)
 			}
+			pending = append(pending, &BulkItemFailure{Position: position, Index: index, Doc: doc, request: request})
 		} else {
 			beego.Error("the type of alarm's app_id param is not string: " + fmt.Sprintf("%+v", doc))
 		}
 	}
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	if len(pending) == 0 {
+		return nil
+	}
+	total := len(pending)
+	failures := make([]*BulkItemFailure, 0)
+	ctx, cancel := SearchContext(ContextIngest)
+	defer cancel()
+retryLoop:
+	for retry := 1; ; retry++ {
+		bulkService := ElasticClient.Bulk()
+		for _, item := range pending {
+			bulkService.Add(item.request)
+		}
+		var r *elastic.BulkResponse
+		r, err = bulkService.Do(ctx)
+		if err == nil {
+			var rejected []*BulkItemFailure
+			pending, rejected = checkBulkItems(pending, r.Items)
+			failures = append(failures, rejected...)
+			if len(pending) == 0 {
+				break
+			}
+			err = errors.New(strconv.Itoa(len(pending)) + " docs are rejected, the first failure: " +
+				pending[0].Type + ": " + pending[0].Reason)
+		} else if !isRetryableError(err) {
+			break
+		}
+		if retry > conf.AppConfig.EsBulkMaxRetry {
+			break
+		}
+		wait := getBulkRetryWait(retry)
+		beego.Warning("failed to execute es bulk insert for " + docType + ", retry " + strconv.Itoa(retry) +
+			" after " + wait.String() + ": " + err.Error())
+		select {
+		case <-ctx.Done():
+			break retryLoop
+		case <-time.After(wait):
+		}
+	}
+	if len(pending) == total {
+		// none of the documents is indexed
+		return err
+	}
+	// the documents still rejected after the retries are failed as well
+	failures = append(failures, pending...)
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].Position < failures[j].Position
+		})
+		return &BulkError{DocType: docType, Total: total, Failures: failures}
+	}
+	return nil
+}
+
+func newPolicyAlarmRequest(index string, docType string, doc map[string]interface{}) *elastic.BulkUpdateRequest {
+	upsert := make(map[string]interface{}, len(doc)+2)
+	for key, value := range doc {
+		upsert[key] = value
+	}
+	upsert["status"] = "open"
+	upsert["reopened_count"] = 0
+	script := elastic.NewScript(policyAlarmUpsertScript).Lang("painless").Params(map[string]interface{}{
+		"doc":  doc,
+		"time": time.Now().UnixNano() / 1000000,
+	})
+	return elastic.NewBulkUpdateRequest().
+		Index(index).
+		Type(GetDocType(docType)).
+		Id(fmt.Sprint(doc["upsert_id"])).
+		Script(script).
+		Upsert(upsert)
+}
+
+// checkBulkItems splits the failed items of the bulk response into the retryable ones and the rejected ones,
+// the items of the response are in the same order as the requests
+func checkBulkItems(requests []*BulkItemFailure,
+	items []map[string]*elastic.BulkResponseItem) (retryable []*BulkItemFailure, rejected []*BulkItemFailure) {
+	for i, request := range requests {
+		if i >= len(items) {
+			break
+		}
+		for _, item := range items[i] {
+			if item == nil || (item.Status >= 200 && item.Status < 300 && item.Error == nil) {
+				continue
+			}
+			request.Status = item.Status
+			if item.Error != nil {
+				request.Type = item.Error.Type
+				request.Reason = item.Error.Reason
+			}
+			isRetryable := false
+			for _, code := range bulkRetryStatus {
+				if item.Status == code {
+					isRetryable = true
+					break
+				}
+			}
+			if isRetryable {
+				retryable = append(retryable, request)
+			} else {
+				rejected = append(rejected, request)
+			}
+		}
+	}
+	return retryable, rejected
+}
+
+func isRetryableError(err error) bool {
+	for _, code := range bulkRetryStatus {
+		if elastic.IsStatusCode(err, code) {
+			return true
+		}
+	}
+	if elastic.IsConnErr(err) {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		return !elastic.IsContextErr(urlErr.Err)
+	}
+	return false
+}
+
+// exponential backoff with jitter, the wait time is between [base*2^(retry-1)/2, base*2^(retry-1)]
+func getBulkRetryWait(retry int) time.Duration {
+	wait := bulkRetryBaseWait << uint(retry-1)
+	if wait <= 0 || wait > bulkRetryMaxWait {
+		wait = bulkRetryMaxWait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// ScrollSearch walks all the documents matched by the query and passes them to fn page by page,
+// the scroll context is always cleared when the walk is finished, failed or stopped by fn
+func ScrollSearch(index string, docType string, query elastic.Query, batchSize int,
+	fn func(hits []*elastic.SearchHit) error) error {
+	ctx, cancel := SearchContext(ContextExport)
+	defer cancel()
+	scrollService := ElasticClient.Scroll(index).
+		IgnoreUnavailable(true).
+		Query(query).
+		Size(batchSize).
+		Sort("_doc", true).
+		KeepAlive(scrollKeepAlive)
+	if docType != "" && MajorVersion < 7 {
+		scrollService.Type(docType)
+	}
+	defer func() {
+		clearCtx, clearCancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+		defer clearCancel()
+		if clearErr := scrollService.Clear(clearCtx); clearErr != nil {
+			beego.Warning("failed to clear es scroll for index " + index + ": " + clearErr.Error())
+		}
+	}()
+	for {
+		result, err := scrollService.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if result.Hits == nil || len(result.Hits.Hits) == 0 {
+			return nil
+		}
+		err = fn(result.Hits.Hits)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func GetClusterHealth(timeout time.Duration) (*elastic.ClusterHealthResponse, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(timeout))
 	defer cancel()
-	_, err = bulkService.Do(ctx)
-	return err
+	return ElasticClient.ClusterHealth().Do(ctx)
 }
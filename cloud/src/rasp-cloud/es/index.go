@@ -0,0 +1,338 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"context"
+	"errors"
+	"github.com/astaxie/beego"
+	"github.com/olivere/elastic"
+	"rasp-cloud/conf"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the index of every app is named as {index}-{appId} at first, the template adds the write alias
+// real-{index}-{appId} to it, when the index rolls over, the write alias is moved to a new generation
+// named as {index}-{appId}-{time}, so the searches must use the pattern covering all the generations
+type IndexInfo struct {
+	Index        string `json:"index"`
+	AppId        string `json:"app_id"`
+	Health       string `json:"health"`
+	Status       string `json:"status"`
+	DocsCount    int    `json:"docs_count"`
+	StoreSize    string `json:"store_size"`
+	CreationTime int64  `json:"creation_time"`
+	IsWriteIndex bool   `json:"is_write_index"`
+}
+
+type RolloverResult struct {
+	Alias      string          `json:"alias"`
+	OldIndex   string          `json:"old_index"`
+	NewIndex   string          `json:"new_index"`
+	RolledOver bool            `json:"rolled_over"`
+	Conditions map[string]bool `json:"conditions"`
+}
+
+var (
+	// index -> retention days of the rolled over generations
+	rolloverIndexes = make(chan map[string]int, 1)
+	appIdRegex      = regexp.MustCompile(`^[a-z0-9_]{1,128}$`)
+)
+
+// ValidAppId lowercases the app id and checks that it only contains the chars allowed in the index name,
+// so that the app id can never expand to the indices of other apps
+func ValidAppId(appId string) (string, error) {
+	lowerAppId := strings.ToLower(appId)
+	if !appIdRegex.MatchString(lowerAppId) {
+		return "", errors.New("invalid app id " + strconv.Quote(appId) +
+			", only letters, digits and '_' are allowed and the length must be between 1 and 128")
+	}
+	return lowerAppId, nil
+}
+
+// GetIndex returns the write alias of the app index, the documents must be written with it
+func GetIndex(index string, appId string) (string, error) {
+	appId, err := ValidAppId(appId)
+	if err != nil {
+		return "", err
+	}
+	return "real-" + index + "-" + appId, nil
+}
+
+// GetSearchIndex returns the indices covering all the generations of the app index,
+// the appId * means all the apps
+func GetSearchIndex(index string, appId string) (string, error) {
+	if appId == "*" {
+		return index + "-*", nil
+	}
+	appId, err := ValidAppId(appId)
+	if err != nil {
+		return "", err
+	}
+	return index + "-" + appId + "," + index + "-" + appId + "-*", nil
+}
+
+func RegisterRollover(index string, retentionDays int) {
+	indexes := <-rolloverIndexes
+	defer func() {
+		rolloverIndexes <- indexes
+	}()
+	indexes[index] = retentionDays
+}
+
+func GetRolloverIndexes() []string {
+	indexes := <-rolloverIndexes
+	defer func() {
+		rolloverIndexes <- indexes
+	}()
+	result := make([]string, 0, len(indexes))
+	for index := range indexes {
+		result = append(result, index)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func isRolloverEnabled() bool {
+	return conf.AppConfig.EsRolloverMaxAge != "" || conf.AppConfig.EsRolloverMaxDocs > 0
+}
+
+func startRollover(duration time.Duration) {
+	ticker := time.NewTicker(duration)
+	for {
+		select {
+		case <-ticker.C:
+			HandleRollover()
+		}
+	}
+}
+
+// HandleRollover rolls over the app indices which match the conditions in config,
+// then deletes the expired generations
+func HandleRollover() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error(r)
+		}
+	}()
+	for _, index := range GetRolloverIndexes() {
+		if isRolloverEnabled() {
+			_, err := RolloverAll(index, "*", false)
+			if err != nil {
+				beego.Error("failed to roll over index " + index + ": " + err.Error())
+			}
+		}
+		err := deleteExpiredIndex(index)
+		if err != nil {
+			beego.Error("failed to delete expired generations of index " + index + ": " + err.Error())
+		}
+	}
+}
+
+// RolloverAll rolls over the index of the app, the appId * means all the apps,
+// the index rolls over without conditions when force is true
+func RolloverAll(index string, appId string, force bool) ([]*RolloverResult, error) {
+	infos, err := GetIndexInfo(index, appId)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*RolloverResult, 0)
+	for _, info := range infos {
+		if !info.IsWriteIndex {
+			continue
+		}
+		result, err := RolloverIndex(index, info.AppId, force)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func RolloverIndex(index string, appId string, force bool) (*RolloverResult, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	alias, err := GetIndex(index, appId)
+	if err != nil {
+		return nil, err
+	}
+	newIndex := index + "-" + appId + "-" + time.Now().Format("20060102150405")
+	rolloverService := ElasticClient.RolloverIndex(alias).NewIndex(newIndex)
+	if !force {
+		if conf.AppConfig.EsRolloverMaxAge != "" {
+			rolloverService.AddMaxIndexAgeCondition(conf.AppConfig.EsRolloverMaxAge)
+		}
+		if conf.AppConfig.EsRolloverMaxDocs > 0 {
+			rolloverService.AddMaxIndexDocsCondition(conf.AppConfig.EsRolloverMaxDocs)
+		}
+	}
+	r, err := rolloverService.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.RolledOver {
+		beego.Info("roll over es index " + r.OldIndex + " to " + r.NewIndex)
+	}
+	return &RolloverResult{
+		Alias:      alias,
+		OldIndex:   r.OldIndex,
+		NewIndex:   r.NewIndex,
+		RolledOver: r.RolledOver,
+		Conditions: r.Conditions,
+	}, nil
+}
+
+// GetIndexInfo returns the size of all the generations of the app index, the appId * means all the apps
+func GetIndexInfo(index string, appId string) ([]*IndexInfo, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	defer cancel()
+	searchIndex, err := GetSearchIndex(index, appId)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ElasticClient.CatIndices().
+		Index(searchIndex).
+		Columns("health", "status", "index", "docs.count", "store.size", "creation.date").
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*IndexInfo, 0, len(rows))
+	for _, row := range rows {
+		// the published copy of the migration is listed by its alias, but cat returns the index name
+		name := strings.TrimPrefix(strings.TrimPrefix(row.Index, migrationCopyPrefix), index+"-")
+		result = append(result, &IndexInfo{
+			Index:        row.Index,
+			AppId:        strings.SplitN(name, "-", 2)[0],
+			Health:       row.Health,
+			Status:       row.Status,
+			DocsCount:    row.DocsCount,
+			StoreSize:    row.StoreSize,
+			CreationTime: row.CreationDate,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AppId != result[j].AppId {
+			return result[i].AppId < result[j].AppId
+		}
+		return result[i].CreationTime < result[j].CreationTime
+	})
+	// the newest generation of every app holds the write alias
+	for i, info := range result {
+		info.IsWriteIndex = i == len(result)-1 || result[i+1].AppId != info.AppId
+	}
+	return result, nil
+}
+
+// a generation stops receiving documents when the next one is created,
+// so it is expired when the next one is created before the retention time
+func deleteExpiredIndex(index string) error {
+	indexes := <-rolloverIndexes
+	retentionDays := indexes[index]
+	rolloverIndexes <- indexes
+	if retentionDays <= 0 {
+		return nil
+	}
+	infos, err := GetIndexInfo(index, "*")
+	if err != nil {
+		return err
+	}
+	expiredTime := (time.Now().UnixNano() - int64(time.Duration(retentionDays)*24*time.Hour)) / 1000000
+	for i, info := range infos {
+		if info.IsWriteIndex || infos[i+1].CreationTime >= expiredTime {
+			continue
+		}
+		err := deleteIndex(info.Index)
+		if err != nil {
+			return err
+		}
+		beego.Info("delete expired es index " + info.Index + ", docs count: " + strconv.Itoa(info.DocsCount))
+	}
+	return nil
+}
+
+// DeleteAppIndex deletes all the generations of the app index and returns the deleted ones,
+// the write alias is removed together with the last index behind it, the indices which are already
+// deleted are ignored so that it can be retried after a partial failure
+func DeleteAppIndex(index string, appId string) ([]string, error) {
+	lowerAppId, err := ValidAppId(appId)
+	if err != nil {
+		return nil, err
+	}
+	indices, err := getAppIndices(index, lowerAppId, "real-"+index+"-"+lowerAppId)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]string, 0, len(indices))
+	for _, name := range indices {
+		err := deleteIndex(name)
+		if err != nil && !elastic.IsNotFound(err) {
+			return deleted, err
+		}
+		deleted = append(deleted, name)
+		beego.Info("delete es index " + name + " of app " + appId)
+	}
+	return deleted, nil
+}
+
+// getAppIndices returns the indices behind the write alias and the generations named after the app,
+// the alias may point to an index which does not match the name when it was moved by hand
+func getAppIndices(index string, appId string, alias string) ([]string, error) {
+	ctx, cancel := SearchContext(ContextSearch)
+	defer cancel()
+	indices := make(map[string]bool)
+	aliases, err := ElasticClient.Aliases().Alias(alias).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, name := range aliases.IndicesByAlias(alias) {
+			indices[name] = true
+		}
+	}
+	// the wildcard matches nothing rather than fails when all the generations are deleted,
+	// the copies of the migrations are included whether they are published or not
+	prefix := index + "-" + appId
+	rows, err := ElasticClient.CatIndices().Index(prefix + "*," + migrationCopyPrefix + prefix + "*").
+		Columns("index").Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return nil, err
+	}
+	for _, row := range rows {
+		// the app id may be the prefix of another app id
+		name := strings.TrimPrefix(row.Index, migrationCopyPrefix)
+		if name == prefix || strings.HasPrefix(name, prefix+"-") {
+			indices[row.Index] = true
+		}
+	}
+	result := make([]string, 0, len(indices))
+	for name := range indices {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func deleteIndex(index string) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	_, err := ElasticClient.DeleteIndex(index).Do(ctx)
+	return err
+}
@@ -0,0 +1,381 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"context"
+	"errors"
+	"github.com/astaxie/beego"
+	"github.com/olivere/elastic"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the migration moves the write alias to a new generation created with the current template,
+// and copies the documents of the old generations with the _reindex api into a copy index named
+// migrated-{index}-{appId}-{time}, which is out of the search pattern of the app index,
+// so the documents are not searched twice while they are copied or when the migration fails.
+// After the copy is verified, the old generations are deleted or closed and the copy is published
+// with the alias {index}-{appId}-{time}-migrated, which the search pattern covers.
+// The target and the copy are marked with the alias migrating-{index}-{appId} until the migration
+// is completed, so that the migration interrupted by the restart or the error can be resumed
+type Migration struct {
+	Index        string   `json:"index"`
+	AppId        string   `json:"app_id"`
+	DryRun       bool     `json:"dry_run"`
+	DeleteOld    bool     `json:"delete_old"`
+	Resumed      bool     `json:"resumed"`
+	Sources      []string `json:"sources"`
+	SourceDocs   int64    `json:"source_docs"`
+	Target       string   `json:"target"`
+	Copy         string   `json:"copy"`
+	CopyDocs     int64    `json:"copy_docs"`
+	TaskId       string   `json:"task_id"`
+	Total        int64    `json:"total"`
+	Created      int64    `json:"created"`
+	Conflicts    int64    `json:"version_conflicts"`
+	Running      bool     `json:"running"`
+	Completed    bool     `json:"completed"`
+	Error        string   `json:"error,omitempty"`
+	StartTime    int64    `json:"start_time"`
+	CompleteTime int64    `json:"complete_time"`
+}
+
+const migrationCopyPrefix = "migrated-"
+
+var (
+	ErrMigrationRunning   = errors.New("the migration of the index is already running")
+	migrationPollInterval = 5 * time.Second
+	migrations            = make(chan map[string]*Migration, 1)
+)
+
+func init() {
+	migrations <- make(map[string]*Migration)
+}
+
+func getMigrationMark(index string, appId string) string {
+	return "migrating-" + index + "-" + appId
+}
+
+// the templates are named after the index without the openrasp- prefix
+func getTemplateName(index string) string {
+	return strings.TrimPrefix(index, "openrasp-") + "-template"
+}
+
+// MigrateIndex migrates all the generations of the app index to a new generation in background,
+// the dry run only reports the document counts of the generations to be migrated
+func MigrateIndex(index string, appId string, dryRun bool, deleteOld bool) (*Migration, error) {
+	appId, err := ValidAppId(appId)
+	if err != nil {
+		return nil, err
+	}
+	key := index + "-" + appId
+	all := <-migrations
+	if m, ok := all[key]; ok && m.Running {
+		migrations <- all
+		return nil, ErrMigrationRunning
+	}
+	m := &Migration{
+		Index:     index,
+		AppId:     appId,
+		DryRun:    dryRun,
+		DeleteOld: deleteOld,
+		Running:   !dryRun,
+		StartTime: time.Now().Unix(),
+	}
+	if !dryRun {
+		all[key] = m
+	}
+	migrations <- all
+
+	if dryRun {
+		err = prepareMigration(m)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	go runMigration(m)
+	return copyMigration(m), nil
+}
+
+// GetMigrations returns the migrations started after the process is started
+func GetMigrations() []*Migration {
+	all := <-migrations
+	defer func() {
+		migrations <- all
+	}()
+	result := make([]*Migration, 0, len(all))
+	for _, m := range all {
+		mCopy := *m
+		result = append(result, &mCopy)
+	}
+	return result
+}
+
+func copyMigration(m *Migration) *Migration {
+	all := <-migrations
+	defer func() {
+		migrations <- all
+	}()
+	mCopy := *m
+	return &mCopy
+}
+
+func updateMigration(m *Migration, update func(m *Migration)) {
+	all := <-migrations
+	defer func() {
+		migrations <- all
+	}()
+	update(m)
+}
+
+func runMigration(m *Migration) {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to migrate es index: ", r)
+		}
+	}()
+	err := prepareMigration(m)
+	if err == nil {
+		err = startMigration(m)
+	}
+	updateMigration(m, func(m *Migration) {
+		m.Running = false
+		if err != nil {
+			m.Error = err.Error()
+		} else {
+			m.Completed = true
+			m.CompleteTime = time.Now().Unix()
+		}
+	})
+	if err != nil {
+		beego.Error("failed to migrate es index " + m.Index + " of app " + m.AppId + ": " + err.Error())
+	} else {
+		beego.Info("migrate es index " + m.Index + " of app " + m.AppId + " to " + m.Target)
+	}
+}
+
+// prepareMigration finds the target and the copy left by the interrupted migration and the generations to be copied
+func prepareMigration(m *Migration) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	target := ""
+	copyIndex := ""
+	r, err := ElasticClient.Aliases().Alias(getMigrationMark(m.Index, m.AppId)).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		for name := range r.Indices {
+			if strings.HasPrefix(name, migrationCopyPrefix) {
+				copyIndex = name
+			} else {
+				target = name
+			}
+		}
+	}
+	infos, err := GetIndexInfo(m.Index, m.AppId)
+	if err != nil {
+		return err
+	}
+	sources := make([]string, 0, len(infos))
+	var sourceDocs int64
+	for _, info := range infos {
+		// the copy is listed when it was published before the migration was interrupted
+		if info.Index == target || info.Index == copyIndex || info.Status != "open" {
+			continue
+		}
+		count, err := ElasticClient.Count(info.Index).Do(ctx)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, info.Index)
+		sourceDocs += count
+	}
+	updateMigration(m, func(m *Migration) {
+		m.Target = target
+		m.Copy = copyIndex
+		m.Resumed = target != "" || copyIndex != ""
+		m.Sources = sources
+		m.SourceDocs = sourceDocs
+	})
+	return nil
+}
+
+func startMigration(m *Migration) error {
+	mark := getMigrationMark(m.Index, m.AppId)
+	if m.Copy == "" {
+		// the copy is created before the target, so that the target stays the newest generation
+		err := createMigrationCopy(m)
+		if err != nil {
+			return err
+		}
+	}
+	if m.Target == "" {
+		// the new generation is created with the current template, and receives the new documents from now on
+		r, err := RolloverIndex(m.Index, m.AppId, true)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+		_, err = ElasticClient.Alias().Add(r.NewIndex, mark).Do(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		updateMigration(m, func(m *Migration) {
+			m.Target = r.NewIndex
+		})
+	}
+	if len(m.Sources) > 0 {
+		err := reindex(m)
+		if err != nil {
+			return err
+		}
+		err = verifyMigration(m)
+		if err != nil {
+			return err
+		}
+	}
+	err := publishMigrationCopy(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	_, err = ElasticClient.Alias().Action(elastic.NewAliasRemoveAction(mark).Index(m.Copy, m.Target)).Do(ctx)
+	return err
+}
+
+// createMigrationCopy creates the copy with the settings and the mappings of the current template,
+// the copy is named out of the template pattern, so the template is applied explicitly
+func createMigrationCopy(m *Migration) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	templateName := getTemplateName(m.Index)
+	templates, err := ElasticClient.IndexGetTemplate(templateName).Do(ctx)
+	if err != nil {
+		return err
+	}
+	template, ok := templates[templateName]
+	if !ok {
+		return errors.New("the es template " + templateName + " does not exist")
+	}
+	copyIndex := migrationCopyPrefix + m.Index + "-" + m.AppId + "-" + time.Now().Format("20060102150405")
+	// the mark is added with the index, so that the copy is never left without it
+	_, err = ElasticClient.CreateIndex(copyIndex).BodyJson(map[string]interface{}{
+		"settings": template.Settings,
+		"mappings": template.Mappings,
+		"aliases":  map[string]interface{}{getMigrationMark(m.Index, m.AppId): map[string]interface{}{}},
+	}).Do(ctx)
+	if err != nil {
+		return err
+	}
+	updateMigration(m, func(m *Migration) {
+		m.Copy = copyIndex
+	})
+	return nil
+}
+
+// reindex copies the documents with op_type create, so that the documents copied by the interrupted
+// migration and the new documents written to the target are not overwritten
+func reindex(m *Migration) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	r, err := ElasticClient.Reindex().
+		Source(elastic.NewReindexSource().Index(m.Sources...)).
+		Destination(elastic.NewReindexDestination().Index(m.Copy).OpType("create")).
+		Conflicts("proceed").
+		DoAsync(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	updateMigration(m, func(m *Migration) {
+		m.TaskId = r.TaskId
+	})
+	beego.Info("start es reindex task " + r.TaskId + " from " + strconv.Itoa(len(m.Sources)) +
+		" generations to " + m.Copy)
+	for {
+		response, err := getTask(r.TaskId)
+		if err != nil {
+			return err
+		}
+		if status := response.getStatus(); status != nil {
+			updateMigration(m, func(m *Migration) {
+				m.Total = status.Total
+				m.Created = status.Created
+				m.Conflicts = status.VersionConflicts
+			})
+			if response.Completed && len(status.Failures) > 0 {
+				return errors.New("failed to reindex " + strconv.Itoa(len(status.Failures)) + " documents")
+			}
+		}
+		if response.Error != nil {
+			return errors.New(response.Error.Type + ": " + response.Error.Reason)
+		}
+		if response.Completed {
+			return nil
+		}
+		time.Sleep(migrationPollInterval)
+	}
+}
+
+// verifyMigration checks that the copy contains all the documents of the sources
+func verifyMigration(m *Migration) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	_, err := ElasticClient.Refresh(m.Copy).Do(ctx)
+	if err != nil {
+		return err
+	}
+	count, err := ElasticClient.Count(m.Copy).Do(ctx)
+	if err != nil {
+		return err
+	}
+	updateMigration(m, func(m *Migration) {
+		m.CopyDocs = count
+	})
+	if count < m.SourceDocs {
+		return errors.New("the copy " + m.Copy + " only contains " + strconv.FormatInt(count, 10) +
+			" documents, less than " + strconv.FormatInt(m.SourceDocs, 10) + " documents of the sources")
+	}
+	return nil
+}
+
+// publishMigrationCopy makes the copy searchable in place of the old generations. The old generations are
+// deleted in the same alias request, or closed before the copy is published to be kept for the rollback,
+// so the documents are never searched twice. The requests on the app index set ignore_unavailable,
+// so they skip the closed generations
+func publishMigrationCopy(m *Migration) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancel()
+	actions := []elastic.AliasAction{
+		elastic.NewAliasAddAction(strings.TrimPrefix(m.Copy, migrationCopyPrefix) + "-migrated").Index(m.Copy),
+	}
+	for _, source := range m.Sources {
+		if m.DeleteOld {
+			actions = append(actions, elastic.NewAliasRemoveIndexAction(source))
+		} else {
+			_, err := ElasticClient.CloseIndex(source).Do(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := ElasticClient.Alias().Action(actions...).Do(ctx)
+	return err
+}
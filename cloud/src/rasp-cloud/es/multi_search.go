@@ -0,0 +1,84 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"errors"
+	"github.com/olivere/elastic"
+	"strconv"
+)
+
+type SearchItem struct {
+	Index        string
+	Query        elastic.Query
+	Aggregations map[string]elastic.Aggregation
+	From         int
+	Size         int
+	SortField    string
+	Ascending    bool
+}
+
+type SearchItemResult struct {
+	Result *elastic.SearchResult
+	Err    error
+}
+
+// MultiSearch sends all the searches with one _msearch request, the results are in the order of the items,
+// a failed search only sets the Err of its own result, the returned error means the whole request failed
+func MultiSearch(kind ContextKind, items []*SearchItem) ([]*SearchItemResult, error) {
+	results := make([]*SearchItemResult, len(items))
+	if len(items) == 0 {
+		return results, nil
+	}
+	ctx, cancel := SearchContext(kind)
+	defer cancel()
+	multiSearchService := ElasticClient.MultiSearch()
+	for _, item := range items {
+		request := elastic.NewSearchRequest().Index(item.Index).IgnoreUnavailable(true).
+			From(item.From).Size(item.Size)
+		if item.Query != nil {
+			request.Query(item.Query)
+		}
+		for name, aggr := range item.Aggregations {
+			request.Aggregation(name, aggr)
+		}
+		if item.SortField != "" {
+			request.Sort(item.SortField, item.Ascending)
+		}
+		multiSearchService.Add(request)
+	}
+	r, err := multiSearchService.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		if i >= len(r.Responses) || r.Responses[i] == nil {
+			results[i] = &SearchItemResult{
+				Err: errors.New("missing the response of search " + strconv.Itoa(i) + " for index " + item.Index),
+			}
+			continue
+		}
+		response := r.Responses[i]
+		if response.Error != nil {
+			results[i] = &SearchItemResult{
+				Err: errors.New("failed to search index " + item.Index + ", " +
+					response.Error.Type + ": " + response.Error.Reason),
+			}
+			continue
+		}
+		results[i] = &SearchItemResult{Result: response}
+	}
+	return results, nil
+}
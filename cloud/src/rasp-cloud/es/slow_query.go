@@ -0,0 +1,168 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"bytes"
+	"github.com/astaxie/beego"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"rasp-cloud/conf"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type QueryStat struct {
+	Caller    string `json:"caller"`
+	Count     int64  `json:"count"`
+	SlowCount int64  `json:"slow_count"`
+	TotalTook int64  `json:"total_took"`
+	MaxTook   int64  `json:"max_took"`
+	LastIndex string `json:"last_index"`
+}
+
+var (
+	// the query in the slow log is truncated to this length
+	slowQueryLogLimit = 512
+	// only the search, aggregation and delete requests are measured
+	queryApis  = []string{"/_search", "/_msearch", "/_count", "/_delete_by_query"}
+	queryStats = make(chan map[string]*QueryStat, 1)
+)
+
+func init() {
+	queryStats <- make(map[string]*QueryStat)
+}
+
+// queryStatTransport records the duration of the queries by the caller outside the es package,
+// the http client calls RoundTrip in the goroutine of the caller, so that the call stack is available here
+type queryStatTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *queryStatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isQueryRequest(req.URL.Path) {
+		return t.transport.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	caller := getQueryCaller()
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	recordQuery(caller, getQueryIndex(req.URL.Path), body, time.Since(start))
+	return resp, err
+}
+
+func isQueryRequest(path string) bool {
+	for _, api := range queryApis {
+		if strings.Contains(path, api) {
+			return true
+		}
+	}
+	return false
+}
+
+func getQueryIndex(path string) string {
+	segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if strings.HasPrefix(segment, "_") {
+		return ""
+	}
+	if index, err := url.PathUnescape(segment); err == nil {
+		return index
+	}
+	return segment
+}
+
+// getQueryCaller returns the first function outside the es package and the libraries,
+// the function of the es package is returned if it is called by itself in background
+func getQueryCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	caller := "unknown"
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "rasp-cloud/") {
+			if !strings.HasPrefix(frame.Function, "rasp-cloud/es.") {
+				return frame.Function
+			}
+			if caller == "unknown" {
+				caller = frame.Function
+			}
+		}
+		if !more {
+			return caller
+		}
+	}
+}
+
+func recordQuery(caller string, index string, body []byte, took time.Duration) {
+	tookMs := int64(took / time.Millisecond)
+	isSlow := tookMs >= conf.AppConfig.EsSlowQueryThreshold
+	if isSlow {
+		query := string(body)
+		if len(query) > slowQueryLogLimit {
+			query = query[:slowQueryLogLimit] + "..."
+		}
+		beego.Warning("slow es query, index: " + index + ", caller: " + caller +
+			", took: " + strconv.FormatInt(tookMs, 10) + "ms, query: " + query)
+	}
+	stats := <-queryStats
+	defer func() {
+		queryStats <- stats
+	}()
+	stat, ok := stats[caller]
+	if !ok {
+		stat = &QueryStat{Caller: caller}
+		stats[caller] = stat
+	}
+	stat.Count++
+	stat.TotalTook += tookMs
+	stat.LastIndex = index
+	if tookMs > stat.MaxTook {
+		stat.MaxTook = tookMs
+	}
+	if isSlow {
+		stat.SlowCount++
+	}
+}
+
+// GetQueryStats returns the query stats of all the callers, the slowest ones come first
+func GetQueryStats() []*QueryStat {
+	stats := <-queryStats
+	result := make([]*QueryStat, 0, len(stats))
+	for _, stat := range stats {
+		statCopy := *stat
+		result = append(result, &statCopy)
+	}
+	queryStats <- stats
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].SlowCount != result[j].SlowCount {
+			return result[i].SlowCount > result[j].SlowCount
+		}
+		return result[i].MaxTook > result[j].MaxTook
+	})
+	return result
+}
@@ -0,0 +1,247 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/astaxie/beego"
+	"github.com/olivere/elastic"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"rasp-cloud/conf"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskSpool keeps the batches failed to be sent when es is unavailable in the files named as {seq}-{count}.json,
+// the drainer sends them to es in the order of seq when es recovers, the oldest batches are dropped
+// when the size of all the spools exceeds EsSpoolMaxSize
+type diskSpool struct {
+	docType string
+	dir     string
+	seq     int64
+	lock    sync.Mutex
+	dropped int64
+}
+
+type spoolFile struct {
+	name  string
+	seq   int64
+	count int
+	size  int64
+}
+
+var spoolDrainInterval = 10 * time.Second
+
+func isSpoolEnabled() bool {
+	return conf.AppConfig.EsSpoolDir != ""
+}
+
+func newDiskSpool(docType string) (*diskSpool, error) {
+	dir := filepath.Join(conf.AppConfig.EsSpoolDir, docType)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	s := &diskSpool{docType: docType, dir: dir, seq: time.Now().UnixNano()}
+	files, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if last := files[len(files)-1].seq; last >= s.seq {
+			s.seq = last + 1
+		}
+		beego.Info("found " + strconv.Itoa(len(files)) + " spooled " + docType + " batches in " + dir)
+	}
+	return s, nil
+}
+
+// isUnavailableError checks whether the error means that es can not be reached or is overloaded,
+// the batch failed with these errors can be sent again later
+func isUnavailableError(err error) bool {
+	if err == elastic.ErrNoClient || err == context.DeadlineExceeded || isRetryableError(err) {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err == context.DeadlineExceeded
+	}
+	return false
+}
+
+func (s *diskSpool) list() ([]*spoolFile, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*spoolFile, 0, len(infos))
+	for _, info := range infos {
+		parts := strings.SplitN(strings.TrimSuffix(info.Name(), ".json"), "-", 2)
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") || len(parts) != 2 {
+			continue
+		}
+		seq, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		files = append(files, &spoolFile{name: info.Name(), seq: seq, count: count, size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].seq < files[j].seq
+	})
+	return files, nil
+}
+
+func (s *diskSpool) isEmpty() bool {
+	files, err := s.list()
+	return err == nil && len(files) == 0
+}
+
+func (s *diskSpool) push(docs []map[string]interface{}) error {
+	content, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	name := strconv.FormatInt(s.seq, 10) + "-" + strconv.Itoa(len(docs)) + ".json"
+	// the file is renamed after it is written, so that the drainer never reads a partial batch
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	err = ioutil.WriteFile(tmpPath, content, 0644)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	return s.dropOldest()
+}
+
+// dropOldest deletes the oldest batches of this spool until the size of all the spools is under the limit
+func (s *diskSpool) dropOldest() error {
+	maxSize := conf.AppConfig.EsSpoolMaxSize * 1024 * 1024
+	totalSize, err := getSpoolSize()
+	if err != nil || totalSize <= maxSize {
+		return err
+	}
+	files, err := s.list()
+	if err != nil {
+		return err
+	}
+	// the newest batch is always kept
+	for _, file := range files[:len(files)-1] {
+		if totalSize <= maxSize {
+			break
+		}
+		err = os.Remove(filepath.Join(s.dir, file.name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		totalSize -= file.size
+		atomic.AddInt64(&s.dropped, int64(file.count))
+		beego.Error("the es spool exceeds " + strconv.FormatInt(conf.AppConfig.EsSpoolMaxSize, 10) +
+			"MB, dropped the oldest " + strconv.Itoa(file.count) + " " + s.docType + " docs")
+	}
+	return nil
+}
+
+func getSpoolSize() (int64, error) {
+	var size int64
+	err := filepath.Walk(conf.AppConfig.EsSpoolDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// drain sends the spooled batches in order, it stops at the first batch failed because es is still unavailable
+func (s *diskSpool) drain() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to drain es spool of "+s.docType+": ", r)
+		}
+	}()
+	files, err := s.list()
+	if err != nil {
+		beego.Error("failed to list es spool of " + s.docType + ": " + err.Error())
+		return
+	}
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.name)
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// dropped by the limit of spool size
+			continue
+		}
+		var docs []map[string]interface{}
+		if err == nil {
+			err = json.Unmarshal(content, &docs)
+		}
+		if err != nil {
+			beego.Error("dropped the broken es spool file " + path + ": " + err.Error())
+			os.Remove(path)
+			continue
+		}
+		err = BulkInsert(s.docType, docs)
+		if err != nil && isUnavailableError(err) {
+			return
+		}
+		if bulkErr, ok := err.(*BulkError); ok {
+			logBulkFailures(bulkErr)
+		} else if err != nil {
+			beego.Error("failed to send the spooled " + s.docType + " docs, dropped " +
+				strconv.Itoa(len(docs)) + " docs: " + err.Error())
+		}
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			beego.Error("failed to remove es spool file " + path + ": " + err.Error())
+			return
+		}
+		beego.Info(fmt.Sprintf("sent %d spooled %s docs to es", len(docs), s.docType))
+	}
+}
+
+// stats returns the count of the docs and the size of the batches waiting in the spool
+func (s *diskSpool) stats() (docs int64, size int64) {
+	files, err := s.list()
+	if err != nil {
+		return 0, 0
+	}
+	for _, file := range files {
+		docs += int64(file.count)
+		size += file.size
+	}
+	return docs, size
+}
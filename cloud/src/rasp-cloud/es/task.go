@@ -0,0 +1,211 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"encoding/json"
+	"github.com/astaxie/beego"
+	"github.com/olivere/elastic"
+	"net/url"
+	"rasp-cloud/conf"
+	"sort"
+	"time"
+)
+
+type DeleteTask struct {
+	TaskId    string `json:"task_id"`
+	Index     string `json:"index"`
+	StartTime int64  `json:"start_time"`
+}
+
+type DeleteTaskStatus struct {
+	DeleteTask
+	Completed        bool          `json:"completed"`
+	Total            int64         `json:"total"`
+	Deleted          int64         `json:"deleted"`
+	Updated          int64         `json:"updated"`
+	VersionConflicts int64         `json:"version_conflicts"`
+	Failures         []interface{} `json:"failures"`
+	Error            string        `json:"error,omitempty"`
+}
+
+// taskStatus is the status of the delete by query, update by query and reindex tasks
+type taskStatus struct {
+	Total            int64         `json:"total"`
+	Created          int64         `json:"created"`
+	Deleted          int64         `json:"deleted"`
+	Updated          int64         `json:"updated"`
+	VersionConflicts int64         `json:"version_conflicts"`
+	Failures         []interface{} `json:"failures"`
+}
+
+type taskResponse struct {
+	Completed bool `json:"completed"`
+	Task      struct {
+		Status *taskStatus `json:"status"`
+	} `json:"task"`
+	Response *taskStatus           `json:"response"`
+	Error    *elastic.ErrorDetails `json:"error"`
+}
+
+var (
+	// the tasks are tracked for one day, es keeps the results of them in the .tasks index
+	deleteTaskKeepTime = 24 * time.Hour
+	deleteTasks        = make(chan map[string]*DeleteTask, 1)
+)
+
+func init() {
+	deleteTasks <- make(map[string]*DeleteTask)
+}
+
+// DeleteByQuery deletes the documents synchronously when the count of them is not greater than
+// EsAsyncDeleteThreshold, otherwise the deletion runs in background and the es task id is returned
+func DeleteByQuery(index string, query elastic.Query) (deleted int64, taskId string, err error) {
+	ctx, cancel := SearchContext(ContextSearch)
+	count, err := ElasticClient.Count(index).Query(query).IgnoreUnavailable(true).Do(ctx)
+	cancel()
+	if err != nil {
+		return 0, "", err
+	}
+	if count > conf.AppConfig.EsAsyncDeleteThreshold {
+		taskId, err = DeleteByQueryAsync(index, query)
+		return 0, taskId, err
+	}
+	ctx, cancel = SearchContext(ContextSearch)
+	defer cancel()
+	r, err := ElasticClient.DeleteByQuery(index).Query(query).IgnoreUnavailable(true).Conflicts("proceed").Do(ctx)
+	if err != nil {
+		if r != nil && r.Failures != nil {
+			beego.Error(r.Failures)
+		}
+		return 0, "", err
+	}
+	return r.Deleted, "", nil
+}
+
+func DeleteByQueryAsync(index string, query elastic.Query) (string, error) {
+	ctx, cancel := SearchContext(ContextSearch)
+	defer cancel()
+	r, err := ElasticClient.DeleteByQuery(index).Query(query).IgnoreUnavailable(true).Conflicts("proceed").
+		DoAsync(ctx)
+	if err != nil {
+		return "", err
+	}
+	beego.Info("start es delete task " + r.TaskId + " for index " + index)
+	addTask(r.TaskId, index)
+	return r.TaskId, nil
+}
+
+// UpdateByQueryAsync runs the update in background, the task is tracked with the delete tasks,
+// so that the progress of it is returned by GetDeleteTaskStatus as well
+func UpdateByQueryAsync(index string, query elastic.Query, script *elastic.Script) (string, error) {
+	ctx, cancel := SearchContext(ContextSearch)
+	defer cancel()
+	r, err := ElasticClient.UpdateByQuery(index).Query(query).Script(script).IgnoreUnavailable(true).
+		Conflicts("proceed").DoAsync(ctx)
+	if err != nil {
+		return "", err
+	}
+	beego.Info("start es update task " + r.TaskId + " for index " + index)
+	addTask(r.TaskId, index)
+	return r.TaskId, nil
+}
+
+func addTask(taskId string, index string) {
+	tasks := <-deleteTasks
+	defer func() {
+		deleteTasks <- tasks
+	}()
+	for id, task := range tasks {
+		if time.Since(time.Unix(task.StartTime, 0)) > deleteTaskKeepTime {
+			delete(tasks, id)
+		}
+	}
+	tasks[taskId] = &DeleteTask{TaskId: taskId, Index: index, StartTime: time.Now().Unix()}
+}
+
+func GetDeleteTasks() []*DeleteTask {
+	tasks := <-deleteTasks
+	defer func() {
+		deleteTasks <- tasks
+	}()
+	result := make([]*DeleteTask, 0, len(tasks))
+	for _, task := range tasks {
+		result = append(result, task)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartTime > result[j].StartTime
+	})
+	return result
+}
+
+// GetDeleteTaskStatus returns the progress of the delete task, the result is taken from the response
+// of the task after it is completed
+func GetDeleteTaskStatus(taskId string) (*DeleteTaskStatus, error) {
+	response, err := getTask(taskId)
+	if err != nil {
+		return nil, err
+	}
+	result := &DeleteTaskStatus{
+		DeleteTask: DeleteTask{TaskId: taskId},
+		Completed:  response.Completed,
+		Failures:   make([]interface{}, 0),
+	}
+	tasks := <-deleteTasks
+	if task, ok := tasks[taskId]; ok {
+		result.DeleteTask = *task
+	}
+	deleteTasks <- tasks
+
+	if status := response.getStatus(); status != nil {
+		result.Total = status.Total
+		result.Deleted = status.Deleted
+		result.Updated = status.Updated
+		result.VersionConflicts = status.VersionConflicts
+		if status.Failures != nil {
+			result.Failures = status.Failures
+		}
+	}
+	if response.Error != nil {
+		result.Error = response.Error.Type + ": " + response.Error.Reason
+	}
+	return result, nil
+}
+
+func getTask(taskId string) (*taskResponse, error) {
+	ctx, cancel := SearchContext(ContextSearch)
+	defer cancel()
+	r, err := ElasticClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/_tasks/" + url.PathEscape(taskId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var response taskResponse
+	err = json.Unmarshal(r.Body, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// getStatus returns the final result of the completed task, or the progress of the running task
+func (r *taskResponse) getStatus() *taskStatus {
+	if r.Response != nil {
+		return r.Response
+	}
+	return r.Task.Status
+}
@@ -91,6 +91,16 @@ var attackAlarmTemplate = `
 							"type": "keyword",
 							"ignore_above": 64
 						},
+						"false_positive": {
+							"type": "boolean"
+						},
+						"false_positive_user": {
+							"type": "keyword",
+							"ignore_above": 256
+						},
+						"false_positive_time": {
+							"type": "date"
+						},
 						"server_type": {
 							"type": "keyword",
 							"ignore_above": 256
@@ -261,6 +271,20 @@ var policyAlarmTemplate = `
 						"policy_params": {
 							"type": "object",
 							"enabled":"false"
+						},
+						"status": {
+							"type": "keyword",
+							"ignore_above": 32
+						},
+						"status_user": {
+							"type": "keyword",
+							"ignore_above": 256
+						},
+						"status_time": {
+							"type": "date"
+						},
+						"reopened_count": {
+							"type": "long"
 						}
 					}
 				}
@@ -362,6 +386,10 @@ var reportDataTemplate = `
 						"request_sum": {
 							"type": "long"
 						},
+						"app_id": {
+							"type": "keyword",
+							"ignore_above" : 256
+						},
 						"rasp_id": {
 							"type": "keyword",
 							"ignore_above" : 256
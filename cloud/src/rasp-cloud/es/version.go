@@ -0,0 +1,121 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package es
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	typelessDocType = "_doc"
+)
+
+var (
+	MajorVersion int
+	MinorVersion int
+)
+
+// es 7.x removed mapping types and returns hits.total as an object,
+// the version is parsed at startup so that the requests can be adapted for it
+func initVersion(version string) error {
+	major, minor, err := ParseVersion(version)
+	if err != nil {
+		return err
+	}
+	MajorVersion = major
+	MinorVersion = minor
+	return nil
+}
+
+func ParseVersion(version string) (major int, minor int, err error) {
+	// drop the suffix of the version like 6.8.0-SNAPSHOT
+	version = strings.SplitN(version, "-", 2)[0]
+	items := strings.Split(version, ".")
+	if len(items) < 2 {
+		return 0, 0, errors.New("invalid es version: " + version)
+	}
+	major, err = strconv.Atoi(items[0])
+	if err != nil {
+		return 0, 0, errors.New("invalid es major version: " + version)
+	}
+	minor, err = strconv.Atoi(items[1])
+	if err != nil {
+		return 0, 0, errors.New("invalid es minor version: " + version)
+	}
+	return
+}
+
+func IsVersionAtLeast(major int, minor int) bool {
+	return MajorVersion > major || (MajorVersion == major && MinorVersion >= minor)
+}
+
+// GetDocType returns the type for index and bulk requests, es 7.x only accepts _doc
+func GetDocType(docType string) string {
+	if MajorVersion >= 7 {
+		return typelessDocType
+	}
+	return docType
+}
+
+// adaptTemplate removes the mapping type and the deprecated fields from the template for es 7.x
+func adaptTemplate(body string) (string, error) {
+	if MajorVersion < 7 {
+		return body, nil
+	}
+	var template map[string]interface{}
+	err := json.Unmarshal([]byte(body), &template)
+	if err != nil {
+		return "", err
+	}
+	if pattern, ok := template["template"]; ok {
+		template["index_patterns"] = []interface{}{pattern}
+		delete(template, "template")
+	}
+	if mappings, ok := template["mappings"].(map[string]interface{}); ok && len(mappings) == 1 {
+		for _, mapping := range mappings {
+			if typeMapping, ok := mapping.(map[string]interface{}); ok {
+				delete(typeMapping, "_all")
+				template["mappings"] = typeMapping
+			}
+		}
+	}
+	content, err := json.Marshal(template)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// compatTransport asks es 7.x to return hits.total as a number for the search requests,
+// the other request options are set on the services so that the callers see them
+type compatTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *compatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if MajorVersion >= 7 && (strings.Contains(req.URL.Path, "/_search") ||
+		strings.Contains(req.URL.Path, "/_msearch")) {
+		// the RoundTripper must not modify the request of the caller
+		req = req.Clone(req.Context())
+		query := req.URL.Query()
+		query.Set("rest_total_hits_as_int", "true")
+		req.URL.RawQuery = query.Encode()
+	}
+	return t.transport.RoundTrip(req)
+}
@@ -39,7 +39,7 @@ func authAgent(ctx *context.Context) {
 	appId := ctx.Input.Header("X-OpenRASP-AppID")
 	appSecret := ctx.Input.Header("X-OpenRASP-AppSecret")
 	app, err := models.GetAppById(appId)
-	if appId == "" || err != nil || app == nil || appSecret != app.Secret {
+	if appId == "" || err != nil || app == nil || !models.IsValidSecret(app, appSecret) {
 		ctx.Output.JSON(map[string]interface{}{
 			"status": http.StatusUnauthorized, "description": http.StatusText(http.StatusUnauthorized)},
 			false, false)
@@ -22,6 +22,8 @@ import (
 	"github.com/astaxie/beego"
 	"rasp-cloud/controllers"
 	"rasp-cloud/routers"
+	"rasp-cloud/es"
+	"time"
 )
 
 func main() {
@@ -29,4 +31,6 @@ func main() {
 	routers.InitRouter()
 	beego.ErrorController(&controllers.ErrorController{})
 	beego.Run()
+	// the pending alarms and reports are flushed after the server is shut down gracefully
+	es.CloseBulkProcessors(30 * time.Second)
 }
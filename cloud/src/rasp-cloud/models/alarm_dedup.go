@@ -0,0 +1,171 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AlarmDedupConf suppresses the alarm pushes with the same fingerprint in the window of seconds,
+// the fingerprint is made of the fields of the alarm, the alarms in es are never affected
+type AlarmDedupConf struct {
+	Window int      `json:"window" bson:"window"`
+	Fields []string `json:"fields" bson:"fields"`
+}
+
+type alarmDedupEntry struct {
+	key      string
+	sentTime time.Time
+}
+
+// alarmDedupCache is the lru of the fingerprints sent by every channel of every app,
+// and the count of the suppressed alarms which are not reported yet
+type alarmDedupCache struct {
+	entries    map[string]*list.Element
+	order      *list.List
+	suppressed map[string]int64
+}
+
+const (
+	AlarmChannelEmail = "email"
+	AlarmChannelDing  = "ding"
+	AlarmChannelHttp  = "http"
+	AlarmChannelSlack = "slack"
+
+	MaxAlarmDedupWindow = 24 * 3600
+)
+
+var (
+	DefaultAlarmDedupFields = []string{"attack_type", "url", "attack_source"}
+
+	maxAlarmDedupEntries = 100000
+	alarmDedupCaches     = make(chan *alarmDedupCache, 1)
+)
+
+func init() {
+	alarmDedupCaches <- &alarmDedupCache{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		suppressed: make(map[string]int64),
+	}
+}
+
+// getAlarmFingerprints must be called before the alarms are translated by the channels
+func getAlarmFingerprints(conf *AlarmDedupConf, alarms []map[string]interface{}) []string {
+	fields := conf.Fields
+	if len(fields) == 0 {
+		fields = DefaultAlarmDedupFields
+	}
+	fingerprints := make([]string, len(alarms))
+	for i, alarm := range alarms {
+		values := make([]string, len(fields))
+		for j, field := range fields {
+			if value, ok := alarm[field]; ok && value != nil {
+				values[j] = fmt.Sprint(value)
+			}
+		}
+		fingerprints[i] = fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(values, "\x00"))))
+	}
+	return fingerprints
+}
+
+// dedupAlarms returns the alarms which are not sent by the channel in the window and the keys of them,
+// the cache is not changed here, the keys are recorded only after the alarms are pushed successfully
+func dedupAlarms(app *App, prefix string, alarms []map[string]interface{},
+	fingerprints []string) (result []map[string]interface{}, keys []string) {
+	window := time.Duration(app.AlarmDedupConf.Window) * time.Second
+	cache := <-alarmDedupCaches
+	defer func() {
+		alarmDedupCaches <- cache
+	}()
+	now := time.Now()
+	result = make([]map[string]interface{}, 0, len(alarms))
+	keys = make([]string, 0, len(alarms))
+	batchKeys := make(map[string]bool, len(alarms))
+	for i, alarm := range alarms {
+		key := prefix + fingerprints[i]
+		if batchKeys[key] {
+			continue
+		}
+		if element, ok := cache.entries[key]; ok && now.Sub(element.Value.(*alarmDedupEntry).sentTime) < window {
+			continue
+		}
+		batchKeys[key] = true
+		result = append(result, alarm)
+		keys = append(keys, key)
+	}
+	return result, keys
+}
+
+func recordSentAlarms(keys []string) {
+	cache := <-alarmDedupCaches
+	defer func() {
+		alarmDedupCaches <- cache
+	}()
+	now := time.Now()
+	for _, key := range keys {
+		if element, ok := cache.entries[key]; ok {
+			element.Value.(*alarmDedupEntry).sentTime = now
+			cache.order.MoveToFront(element)
+			continue
+		}
+		cache.entries[key] = cache.order.PushFront(&alarmDedupEntry{key: key, sentTime: now})
+		if cache.order.Len() > maxAlarmDedupEntries {
+			oldest := cache.order.Back()
+			cache.order.Remove(oldest)
+			delete(cache.entries, oldest.Value.(*alarmDedupEntry).key)
+		}
+	}
+}
+
+// addSuppressedAlarms keeps the count of the suppressed alarms to be reported with the next push
+func addSuppressedAlarms(prefix string, count int64) {
+	cache := <-alarmDedupCaches
+	cache.suppressed[prefix] += count
+	alarmDedupCaches <- cache
+}
+
+func takeSuppressedAlarms(prefix string) int64 {
+	cache := <-alarmDedupCaches
+	defer func() {
+		alarmDedupCaches <- cache
+	}()
+	count := cache.suppressed[prefix]
+	delete(cache.suppressed, prefix)
+	return count
+}
+
+// pushAttackAlarmWithDedup pushes the alarms to the channel after the duplicated ones are removed,
+// the total contains the alarms suppressed since the last push, the failed push is not recorded,
+// so that the alarms are sent again by the next push rather than suppressed in the window
+func pushAttackAlarmWithDedup(app *App, channel string, total int64, alarms []map[string]interface{},
+	fingerprints []string, push func(*App, int64, []map[string]interface{}, bool) error) {
+	prefix := app.Id + "/" + channel + "/"
+	alarms, keys := dedupAlarms(app, prefix, alarms, fingerprints)
+	if len(alarms) == 0 {
+		addSuppressedAlarms(prefix, total)
+		return
+	}
+	suppressed := takeSuppressedAlarms(prefix)
+	if err := push(app, total+suppressed, alarms, false); err != nil {
+		addSuppressedAlarms(prefix, suppressed)
+		return
+	}
+	recordSentAlarms(keys)
+}
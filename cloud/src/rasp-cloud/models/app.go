@@ -25,6 +25,7 @@ import (
 	"crypto/sha1"
 	"gopkg.in/mgo.v2/bson"
 	"rasp-cloud/models/logs"
+	"rasp-cloud/es"
 	"github.com/astaxie/beego"
 	"net/smtp"
 	"os"
@@ -35,6 +36,10 @@ import (
 	"github.com/astaxie/beego/httplib"
 	"errors"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/base64"
 	"io/ioutil"
 	"crypto/tls"
@@ -58,7 +63,17 @@ type App struct {
 	EmailAlarmConf   EmailAlarmConf         `json:"email_alarm_conf" bson:"email_alarm_conf"`
 	DingAlarmConf    DingAlarmConf          `json:"ding_alarm_conf" bson:"ding_alarm_conf"`
 	HttpAlarmConf    HttpAlarmConf          `json:"http_alarm_conf" bson:"http_alarm_conf"`
+	SyslogConf       logs.SyslogConf        `json:"syslog_conf" bson:"syslog_conf"`
+	RaspCleanupDays  *int                   `json:"rasp_cleanup_days" bson:"rasp_cleanup_days,omitempty"`
+	RaspIdentity     string                 `json:"rasp_identity" bson:"rasp_identity"`
 	AlgorithmConfig  map[string]interface{} `json:"algorithm_config"`
+	Retention        *AppRetention          `json:"retention,omitempty" bson:"retention,omitempty"`
+	SlackAlarmConf   SlackAlarmConf         `json:"slack_alarm_conf" bson:"slack_alarm_conf"`
+	AlarmDedupConf   *AlarmDedupConf        `json:"alarm_dedup_conf,omitempty" bson:"alarm_dedup_conf,omitempty"`
+
+	// the old secret is still accepted from the agents until the expire time after the secret is rotated
+	OldSecret           string `json:"-" bson:"old_secret,omitempty"`
+	OldSecretExpireTime int64  `json:"old_secret_expire_time,omitempty" bson:"old_secret_expire_time,omitempty"`
 }
 
 type WhitelistConfigItem struct {
@@ -85,9 +100,12 @@ type DingAlarmConf struct {
 	RecvParty  []string `json:"recv_party" bson:"recv_party"`
 }
 
+// HttpAlarmConf is the http alarm config, the body is signed with the sign secret when it is not empty,
+// see SignHttpAlarm for the signature
 type HttpAlarmConf struct {
-	Enable   bool     `json:"enable" bson:"enable"`
-	RecvAddr []string `json:"recv_addr" bson:"recv_addr"`
+	Enable     bool     `json:"enable" bson:"enable"`
+	RecvAddr   []string `json:"recv_addr" bson:"recv_addr"`
+	SignSecret string   `json:"sign_secret" bson:"sign_secret"`
 }
 
 type emailTemplateParam struct {
@@ -108,6 +126,9 @@ const (
 	appCollectionName = "app"
 	defaultAppName    = "PHP 示例应用"
 	SecreteMask       = "************"
+
+	HttpAlarmTimestampHeader = "X-OpenRASP-Timestamp"
+	HttpAlarmSignatureHeader = "X-OpenRASP-Signature"
 )
 
 var (
@@ -134,6 +155,9 @@ var (
 		"syslog.facility":           1,
 		"syslog.enable":             false,
 		"decompile.enable":          false,
+		HeartbeatIntervalConfigKey:  180,
+		"dependency.enable":         true,
+		"dependency.interval":       3600,
 	}
 )
 
@@ -160,10 +184,21 @@ func init() {
 			createDefaultApp()
 		}
 		go startAlarmTicker(time.Second * time.Duration(conf.AppConfig.AlarmCheckInterval))
+		go startRaspCleanup(time.Hour)
+		go startDataRetention(24 * time.Hour)
 	}
 	if *conf.AppConfig.Flag.StartType != conf.StartTypeReset {
 		initApp()
 	}
+	logs.SyslogConfGetter = getSyslogConf
+}
+
+func getSyslogConf(appId string) (*logs.SyslogConf, error) {
+	app, err := GetAppByIdWithoutMask(appId)
+	if err != nil {
+		return nil, err
+	}
+	return &app.SyslogConf, nil
 }
 
 func initApp() error {
@@ -208,7 +243,11 @@ func initPlugin(app *App) {
 }
 
 func createEsIndexWithAppId(appId string) error {
-	err := logs.CreateAlarmEsIndex(appId)
+	appId, err := es.ValidAppId(appId)
+	if err != nil {
+		return err
+	}
+	err = logs.CreateAlarmEsIndex(appId)
 	if err != nil {
 		return errors.New("failed to create alarm es index, " + err.Error())
 	}
@@ -253,15 +292,17 @@ func HandleAttackAlarm() {
 		return
 	}
 	now := time.Now().UnixNano() / 1000000
+	appIds := make([]string, len(apps))
+	for i, app := range apps {
+		appIds[i] = app.Id
+	}
+	alarms, err := logs.SearchAttackAlarmWithApps(lastAlarmTime, now, 10, appIds)
+	if err != nil {
+		beego.Error("failed to get alarm from es: " + err.Error())
+	}
 	for _, app := range apps {
-		total, result, err := logs.SearchLogs(lastAlarmTime, now, false, nil, "event_time",
-			1, 10, false, logs.AttackAlarmInfo.EsAliasIndex+"-"+app.Id)
-		if err != nil {
-			beego.Error("failed to get alarm from es: " + err.Error())
-			continue
-		}
-		if total > 0 {
-			PushAttackAlarm(&app, total, result, false)
+		if alarm, ok := alarms[app.Id]; ok && alarm.Total > 0 {
+			PushAttackAlarm(&app, alarm.Total, alarm.Data, false)
 		}
 	}
 	lastAlarmTime = now + 1
@@ -290,6 +331,72 @@ func AddApp(app *App) (result *App, err error) {
 	return
 }
 
+// CloneApp creates an app with the configs of the source app and a new id and secret,
+// the selected plugin of the source app is copied and selected, the alarms and rasps are not copied
+func CloneApp(sourceId string, name string) (*App, error) {
+	source, err := GetAppByIdWithoutMask(sourceId)
+	if err != nil {
+		return nil, errors.New("failed to get the source app: " + err.Error())
+	}
+	app, err := AddApp(&App{
+		Name:            name,
+		Language:        source.Language,
+		Description:     source.Description,
+		ConfigTime:      time.Now().UnixNano(),
+		GeneralConfig:   source.GeneralConfig,
+		WhitelistConfig: source.WhitelistConfig,
+		EmailAlarmConf:  source.EmailAlarmConf,
+		DingAlarmConf:   source.DingAlarmConf,
+		HttpAlarmConf:   source.HttpAlarmConf,
+		SlackAlarmConf:  source.SlackAlarmConf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if source.SelectedPluginId != "" {
+		err = cloneSelectedPlugin(source.SelectedPluginId, app.Id)
+		if err != nil {
+			removeClonedApp(app)
+			return nil, err
+		}
+	}
+	return GetAppById(app.Id)
+}
+
+func cloneSelectedPlugin(pluginId string, appId string) error {
+	plugin, err := GetPluginById(pluginId, true)
+	if err != nil {
+		return errors.New("failed to get the selected plugin of the source app: " + err.Error())
+	}
+	plugin, err = copyPlugin(plugin, appId)
+	if err != nil {
+		return errors.New("failed to copy the selected plugin of the source app: " + err.Error())
+	}
+	_, err = SetSelectedPlugin(appId, plugin.Id)
+	if err != nil {
+		return errors.New("failed to select the copied plugin: " + err.Error())
+	}
+	return nil
+}
+
+// removeClonedApp removes the app left by the failed clone in the same way as the deletion of the app,
+// the errors are only logged so that the error of the clone is returned
+func removeClonedApp(app *App) {
+	if err := logs.RemoveAlarmEsIndex(app.Id); err != nil {
+		beego.Error("failed to remove alarm es index of the cloned app " + app.Id + ": " + err.Error())
+	}
+	if err := RemoveReportDataEsIndex(app.Id); err != nil {
+		beego.Error("failed to remove report es index of the cloned app " + app.Id + ": " + err.Error())
+	}
+	if _, err := RemoveAppById(app.Id); err != nil {
+		beego.Error("failed to remove the cloned app " + app.Id + ": " + err.Error())
+	}
+	if err := RemovePluginByAppId(app.Id); err != nil {
+		beego.Error("failed to remove the plugins of the cloned app " + app.Id + ": " + err.Error())
+	}
+	beego.Info("removed the app " + app.Name + " left by the failed clone")
+}
+
 func getDefaultPluginContent() ([]byte, error) {
 	// if setting default plugin fails, continue to initialize
 	currentPath, err := tools.GetCurrentPath()
@@ -378,16 +485,41 @@ func GetSecretByAppId(appId string) (secret string, err error) {
 }
 
 func RegenerateSecret(appId string) (secret string, err error) {
+	secret, _, err = RotateSecret(appId, 0)
+	return
+}
+
+// RotateSecret generates the new secret of the app, the current secret is still valid for the grace period,
+// the old secret of the last rotation is dropped
+func RotateSecret(appId string, gracePeriod time.Duration) (secret string, oldSecretExpireTime int64, err error) {
 	var app *App
 	err = mongo.FindId(appCollectionName, appId, &app)
 	if err != nil {
 		return
 	}
-	newSecret := generateSecret(app)
-	err = mongo.UpdateId(appCollectionName, appId, bson.M{"secret": newSecret})
+	secret = generateSecret(app)
+	update := bson.M{"secret": secret, "old_secret": "", "old_secret_expire_time": int64(0)}
+	if gracePeriod > 0 {
+		oldSecretExpireTime = time.Now().Add(gracePeriod).Unix()
+		update["old_secret"] = app.Secret
+		update["old_secret_expire_time"] = oldSecretExpireTime
+	}
+	err = mongo.UpdateId(appCollectionName, appId, update)
 	return
 }
 
+// IsValidSecret checks the secret sent by the agent
+func IsValidSecret(app *App, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(app.Secret)) == 1 {
+		return true
+	}
+	return app.OldSecret != "" && time.Now().Unix() < app.OldSecretExpireTime &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(app.OldSecret)) == 1
+}
+
 func HandleApp(app *App, isCreate bool) error {
 	if app.EmailAlarmConf.RecvAddr == nil {
 		app.EmailAlarmConf.RecvAddr = make([]string, 0)
@@ -401,6 +533,12 @@ func HandleApp(app *App, isCreate bool) error {
 	if app.HttpAlarmConf.RecvAddr == nil {
 		app.HttpAlarmConf.RecvAddr = make([]string, 0)
 	}
+	if app.SyslogConf.LogTypes == nil {
+		app.SyslogConf.LogTypes = make([]string, 0)
+	}
+	if app.SlackAlarmConf.Mentions == nil {
+		app.SlackAlarmConf.Mentions = make([]string, 0)
+	}
 	if !isCreate {
 		if app.EmailAlarmConf.Password != "" {
 			app.EmailAlarmConf.Password = SecreteMask
@@ -408,6 +546,12 @@ func HandleApp(app *App, isCreate bool) error {
 		if app.DingAlarmConf.CorpSecret != "" {
 			app.DingAlarmConf.CorpSecret = SecreteMask
 		}
+		if app.HttpAlarmConf.SignSecret != "" {
+			app.HttpAlarmConf.SignSecret = SecreteMask
+		}
+		if app.SlackAlarmConf.WebhookUrl != "" {
+			app.SlackAlarmConf.WebhookUrl = SecreteMask
+		}
 	} else {
 		if app.GeneralConfig == nil {
 			app.GeneralConfig = DefaultGeneralConfig
@@ -439,10 +583,15 @@ func UpdateAppById(id string, doc interface{}) (app *App, err error) {
 	if err != nil {
 		return
 	}
-	return GetAppById(id)
+	app, err = GetAppById(id)
+	if err == nil {
+		logs.UpdateSyslogConf(id, &app.SyslogConf)
+	}
+	return
 }
 
 func UpdateGeneralConfig(appId string, config map[string]interface{}) (*App, error) {
+	defer clearOnlineThreshold(appId)
 	return UpdateAppById(appId, bson.M{"general_config": config, "config_time": time.Now().UnixNano()})
 }
 
@@ -455,7 +604,11 @@ func RemoveAppById(id string) (app *App, err error) {
 	if err != nil {
 		return
 	}
-	return app, mongo.RemoveId(appCollectionName, id)
+	err = mongo.RemoveId(appCollectionName, id)
+	if err == nil {
+		logs.UpdateSyslogConf(id, nil)
+	}
+	return
 }
 
 func GetAppCount() (count int, err error) {
@@ -464,14 +617,34 @@ func GetAppCount() (count int, err error) {
 
 func PushAttackAlarm(app *App, total int64, alarms []map[string]interface{}, isTest bool) {
 	if app != nil {
+		if isTest || app.AlarmDedupConf == nil || app.AlarmDedupConf.Window <= 0 {
+			if app.DingAlarmConf.Enable {
+				PushDingAttackAlarm(app, total, alarms, isTest)
+			}
+			if app.SlackAlarmConf.Enable {
+				PushSlackAttackAlarm(app, total, alarms, isTest)
+			}
+			if app.EmailAlarmConf.Enable {
+				PushEmailAttackAlarm(app, total, alarms, isTest)
+			}
+			if app.HttpAlarmConf.Enable {
+				PushHttpAttackAlarm(app, total, alarms, isTest)
+			}
+			return
+		}
+		// every channel has its own window, so that the failure of a channel never suppresses the others
+		fingerprints := getAlarmFingerprints(app.AlarmDedupConf, alarms)
 		if app.DingAlarmConf.Enable {
-			PushDingAttackAlarm(app, total, alarms, isTest)
+			pushAttackAlarmWithDedup(app, AlarmChannelDing, total, alarms, fingerprints, PushDingAttackAlarm)
+		}
+		if app.SlackAlarmConf.Enable {
+			pushAttackAlarmWithDedup(app, AlarmChannelSlack, total, alarms, fingerprints, PushSlackAttackAlarm)
 		}
 		if app.EmailAlarmConf.Enable {
-			PushEmailAttackAlarm(app, total, alarms, isTest)
+			pushAttackAlarmWithDedup(app, AlarmChannelEmail, total, alarms, fingerprints, PushEmailAttackAlarm)
 		}
 		if app.HttpAlarmConf.Enable {
-			PushHttpAttackAlarm(app, total, alarms, isTest)
+			pushAttackAlarmWithDedup(app, AlarmChannelHttp, total, alarms, fingerprints, PushHttpAttackAlarm)
 		}
 	}
 }
@@ -687,6 +860,15 @@ func smtpTlsDial(addr string) (*smtp.Client, error) {
 	return smtp.NewClient(conn, host)
 }
 
+// SignHttpAlarm returns the hex encoded HMAC-SHA256 of the timestamp and the body joined by '.',
+// the receiver should recompute it and reject the alarms with the timestamp out of its window
+func SignHttpAlarm(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
 func PushHttpAttackAlarm(app *App, total int64, alarms []map[string]interface{}, isTest bool) error {
 	var httpConf = app.HttpAlarmConf
 	if len(httpConf.RecvAddr) != 0 {
@@ -697,9 +879,19 @@ func PushHttpAttackAlarm(app *App, total int64, alarms []map[string]interface{},
 		} else {
 			body["data"] = alarms
 		}
+		content, err := json.Marshal(body)
+		if err != nil {
+			return handleError("failed to encode http alarms: " + err.Error())
+		}
 		for _, addr := range httpConf.RecvAddr {
 			request := httplib.Post(addr)
-			request.JSONBody(body)
+			request.Header("Content-Type", "application/json")
+			request.Body(content)
+			if httpConf.SignSecret != "" {
+				timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+				request.Header(HttpAlarmTimestampHeader, timestamp)
+				request.Header(HttpAlarmSignatureHeader, SignHttpAlarm(httpConf.SignSecret, timestamp, content))
+			}
 			request.SetTimeout(10*time.Second, 10*time.Second)
 			response, err := request.Response()
 			if err != nil {
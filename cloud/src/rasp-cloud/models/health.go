@@ -0,0 +1,141 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"rasp-cloud/conf"
+	"rasp-cloud/es"
+	"rasp-cloud/mongo"
+	"strconv"
+	"time"
+)
+
+const (
+	HealthStatusOk       = "ok"
+	HealthStatusDegraded = "degraded"
+	HealthStatusDown     = "down"
+)
+
+type ComponentHealth struct {
+	Status    string `json:"status"`
+	Essential bool   `json:"essential"`
+	Latency   int64  `json:"latency"`
+	Version   string `json:"version,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+type SystemHealth struct {
+	Status     string                      `json:"status"`
+	Ready      bool                        `json:"ready"`
+	CheckTime  int64                       `json:"check_time"`
+	Components map[string]*ComponentHealth `json:"components"`
+}
+
+var (
+	healthCheckTimeout = 3 * time.Second
+	healthCacheTime    = 5 * time.Second
+	healthCache        = make(chan *SystemHealth, 1)
+)
+
+func init() {
+	healthCache <- nil
+}
+
+// GetSystemHealth returns the cached result within healthCacheTime, so that the probes don't hammer the backends
+func GetSystemHealth() *SystemHealth {
+	health := <-healthCache
+	defer func() {
+		healthCache <- health
+	}()
+	if health != nil && time.Since(time.Unix(0, health.CheckTime*int64(time.Millisecond))) < healthCacheTime {
+		return health
+	}
+	health = &SystemHealth{
+		Status: HealthStatusOk,
+		Ready:  true,
+		Components: map[string]*ComponentHealth{
+			"elasticsearch": checkEsHealth(),
+			"mongodb":       checkMongoHealth(),
+		},
+	}
+	if conf.AppConfig.EsSpoolDir != "" {
+		health.Components["es_spool"] = checkEsSpoolHealth()
+	}
+	for _, component := range health.Components {
+		if component.Status == HealthStatusOk {
+			continue
+		}
+		if component.Status == HealthStatusDown && component.Essential {
+			health.Ready = false
+			health.Status = HealthStatusDown
+		} else if health.Status == HealthStatusOk {
+			health.Status = HealthStatusDegraded
+		}
+	}
+	health.CheckTime = time.Now().UnixNano() / 1000000
+	return health
+}
+
+func checkEsHealth() *ComponentHealth {
+	component := &ComponentHealth{Essential: true, Version: es.Version}
+	start := time.Now()
+	r, err := es.GetClusterHealth(healthCheckTimeout)
+	component.Latency = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		component.Status = HealthStatusDown
+		component.Detail = err.Error()
+		return component
+	}
+	// the red cluster can still serve the indices whose primary shards are available
+	switch r.Status {
+	case "green":
+		component.Status = HealthStatusOk
+	default:
+		component.Status = HealthStatusDegraded
+	}
+	component.Detail = "cluster status: " + r.Status
+	return component
+}
+
+// checkEsSpoolHealth reports the docs waiting in the disk spool, the spool is not empty when es is unavailable
+func checkEsSpoolHealth() *ComponentHealth {
+	component := &ComponentHealth{Status: HealthStatusOk}
+	var spooled, dropped int64
+	for _, stats := range es.GetBulkProcessorStats() {
+		spooled += stats.Spooled
+		dropped += stats.SpoolDropped
+	}
+	if spooled > 0 {
+		component.Status = HealthStatusDegraded
+	}
+	component.Detail = "spooled docs: " + strconv.FormatInt(spooled, 10) +
+		", dropped docs: " + strconv.FormatInt(dropped, 10)
+	return component
+}
+
+func checkMongoHealth() *ComponentHealth {
+	component := &ComponentHealth{Essential: true}
+	start := time.Now()
+	version, err := mongo.Ping(healthCheckTimeout)
+	component.Latency = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		component.Status = HealthStatusDown
+		component.Detail = err.Error()
+		return component
+	}
+	component.Status = HealthStatusOk
+	component.Version = version
+	return component
+}
@@ -20,13 +20,22 @@ import (
 	"rasp-cloud/es"
 	"github.com/olivere/elastic"
 	"time"
-	"context"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/astaxie/beego"
 	"net"
 	"rasp-cloud/tools"
 	"encoding/json"
+	"errors"
 	"rasp-cloud/conf"
+	"sort"
+	"strconv"
+)
+
+const (
+	MaxFalsePositiveIds = 1000
+	MaxAttackSourceSize = 100
+
+	attackExportBatchSize = 500
 )
 
 var (
@@ -35,7 +44,7 @@ var (
 		EsIndex:      "openrasp-attack-alarm",
 		EsAliasIndex: "real-openrasp-attack-alarm",
 		TtlTime:      24 * 365 * time.Hour,
-		AlarmBuffer:  make(chan map[string]interface{}, conf.AppConfig.AlarmBufferSize),
+		Rollover:     true,
 		FileLogger:   initAlarmFileLogger("/openrasp-logs/attack-alarm", "attack.log"),
 	}
 	geoIpDbPath string
@@ -77,11 +86,23 @@ func init() {
 	if err != nil {
 		tools.Panic(tools.ErrCodeLogInitFailed, "failed to get current directory path", err)
 	}
-	geoIpDbPath = currentPath + "/geoip/GeoLite2-City.mmdb"
-	geoIpDb, err = geoip2.Open(geoIpDbPath)
+	geoIpDbPath = conf.AppConfig.GeoIpDbPath
+	if geoIpDbPath == "" {
+		geoIpDbPath = currentPath + "/geoip/GeoLite2-City.mmdb"
+	}
+	// the alarms are still received without the geoip database, only the locations are not resolved
+	if isExists, _ := tools.PathExists(geoIpDbPath); !isExists {
+		beego.Warning("the geoip database " + geoIpDbPath + " does not exist, " +
+			"the locations of attack sources will not be resolved")
+		return
+	}
+	db, err := geoip2.Open(geoIpDbPath)
 	if err != nil {
-		tools.Panic(tools.ErrCodeGeoipInit, "failed to open geoip database", err)
+		beego.Warning("failed to open the geoip database " + geoIpDbPath + ", " +
+			"the locations of attack sources will not be resolved: " + err.Error())
+		return
 	}
+	geoIpDb = db
 }
 
 func AddAttackAlarm(alarm map[string]interface{}) error {
@@ -104,8 +125,7 @@ func setAlarmLocation(alarm map[string]interface{}) {
 	if attackSource, ok := alarm["attack_source"]; ok && attackSource != nil {
 		_, ok = attackSource.(string)
 		if ok {
-			attackIp := net.ParseIP(attackSource.(string))
-			record, err := geoIpDb.City(attackIp)
+			record, err := getIpLocation(attackSource.(string))
 			if err != nil {
 				beego.Error("failed to parse attack ip to location: " + err.Error())
 			}
@@ -121,9 +141,171 @@ func setAlarmLocation(alarm map[string]interface{}) {
 	}
 }
 
+// getIpLocation returns nil when the geoip database is absent or the ip is invalid
+func getIpLocation(ip string) (*geoip2.City, error) {
+	attackIp := net.ParseIP(ip)
+	if geoIpDb == nil || attackIp == nil {
+		return nil, nil
+	}
+	return geoIpDb.City(attackIp)
+}
+
+type AppAlarmResult struct {
+	Total int64
+	Data  []map[string]interface{}
+}
+
+// SearchAttackAlarmWithApps searches the latest attack alarms of all the apps with one request,
+// the apps with the invalid ids or failed to be searched are absent from the result and do not fail
+// the others, the false positives are not pushed
+func SearchAttackAlarmWithApps(startTime int64, endTime int64, size int,
+	appIds []string) (map[string]*AppAlarmResult, error) {
+	searchedIds := make([]string, 0, len(appIds))
+	items := make([]*es.SearchItem, 0, len(appIds))
+	for _, appId := range appIds {
+		index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+		if err != nil {
+			beego.Error("failed to search attack alarm for app " + appId + ": " + err.Error())
+			continue
+		}
+		searchedIds = append(searchedIds, appId)
+		items = append(items, &es.SearchItem{
+			Index: index,
+			Query: elastic.NewBoolQuery().
+				Filter(elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime),
+					getFalsePositiveQuery(false)),
+			Size:      size,
+			SortField: "event_time",
+		})
+	}
+	alarms := make(map[string]*AppAlarmResult)
+	if len(items) == 0 {
+		return alarms, nil
+	}
+	results, err := es.MultiSearch(es.ContextSearch, items)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			beego.Error("failed to search attack alarm for app " + searchedIds[i] + ": " + r.Err.Error())
+			continue
+		}
+		alarm := &AppAlarmResult{Data: make([]map[string]interface{}, 0)}
+		if r.Result.Hits != nil {
+			alarm.Total = r.Result.Hits.TotalHits
+			alarm.Data, err = parseAlarmHits(r.Result.Hits.Hits)
+			if err != nil {
+				beego.Error("failed to parse attack alarm for app " + searchedIds[i] + ": " + err.Error())
+				continue
+			}
+		}
+		alarms[searchedIds[i]] = alarm
+	}
+	return alarms, nil
+}
+
+// MarkFalsePositiveByIds flags or unflags the attack alarms with the ids as false positives
+// and returns the count of the changed ones
+func MarkFalsePositiveByIds(appId string, ids []string, falsePositive bool, user string) (int64, error) {
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := es.SearchContext(es.ContextSearch)
+	defer cancel()
+	r, err := es.ElasticClient.UpdateByQuery(index).
+		IgnoreUnavailable(true).
+		Query(elastic.NewBoolQuery().Filter(elastic.NewIdsQuery().Ids(ids...),
+			getFalsePositiveQuery(!falsePositive))).
+		Script(getFalsePositiveScript(falsePositive, user)).
+		Conflicts("proceed").
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		if r != nil && r.Failures != nil {
+			beego.Error(r.Failures)
+		}
+		return 0, err
+	}
+	return r.Updated, nil
+}
+
+// MarkFalsePositiveByQuery flags or unflags the attack alarms matching the search params as false positives
+// in background, because the count of them is unbounded, the es task id is returned
+func MarkFalsePositiveByQuery(appId string, startTime int64, endTime int64, query map[string]interface{},
+	falsePositive bool, user string) (string, error) {
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return "", err
+	}
+	query["false_positive"] = !falsePositive
+	return es.UpdateByQueryAsync(index, getSearchQuery(startTime, endTime, query),
+		getFalsePositiveScript(falsePositive, user))
+}
+
+func getFalsePositiveScript(falsePositive bool, user string) *elastic.Script {
+	return elastic.NewScript(`ctx._source.false_positive = params.false_positive;
+		ctx._source.false_positive_user = params.user;
+		ctx._source.false_positive_time = params.time;`).
+		Lang("painless").
+		Params(map[string]interface{}{
+			"false_positive": falsePositive,
+			"user":           user,
+			"time":           time.Now().UnixNano() / 1000000,
+		})
+}
+
+// the alarms without the flag are not false positives
+func getFalsePositiveQuery(falsePositive bool) elastic.Query {
+	if falsePositive {
+		return elastic.NewTermQuery("false_positive", true)
+	}
+	return elastic.NewBoolQuery().MustNot(elastic.NewTermQuery("false_positive", true))
+}
+
+func CountAttackAlarm(appId string, startTime int64, endTime int64, query map[string]interface{}) (int64, error) {
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := es.SearchContext(es.ContextSearch)
+	defer cancel()
+	return es.ElasticClient.Count(index).Query(getSearchQuery(startTime, endTime, query)).
+		IgnoreUnavailable(true).Do(ctx)
+}
+
+// ExportAttackAlarm walks the attack alarms matching the search params with scroll and stops after maxRows,
+// the alarms indexed during the export may be included, so the limit is checked again
+func ExportAttackAlarm(appId string, startTime int64, endTime int64, query map[string]interface{},
+	maxRows int64, fn func(alarm map[string]interface{}) error) error {
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return err
+	}
+	var count int64
+	return es.ScrollSearch(index, AttackAlarmInfo.EsType, getSearchQuery(startTime, endTime, query),
+		attackExportBatchSize, func(hits []*elastic.SearchHit) error {
+			alarms, err := parseAlarmHits(hits)
+			if err != nil {
+				return err
+			}
+			for _, alarm := range alarms {
+				if count++; count > maxRows {
+					return errors.New("the count of exported alarms is greater than " +
+						strconv.FormatInt(maxRows, 10))
+				}
+				if err := fn(alarm); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
 func AggregationAttackWithTime(startTime int64, endTime int64, interval string, timeZone string,
 	appId string) (map[string]interface{}, error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	ctx, cancel := es.SearchContext(es.ContextAggregation)
 	defer cancel()
 	timeAggrName := "aggr_time"
 	interceptAggrName := "request_sum"
@@ -132,7 +314,12 @@ func AggregationAttackWithTime(startTime int64, endTime int64, interval string,
 	interceptAggr := elastic.NewTermsAggregation().Field("intercept_state")
 	timeAggr.SubAggregation(interceptAggrName, interceptAggr)
 	timeQuery := elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime)
-	aggrResult, err := es.ElasticClient.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return nil, err
+	}
+	aggrResult, err := es.ElasticClient.Search(index).
+		IgnoreUnavailable(true).
 		Query(elastic.NewBoolQuery().Must(timeQuery)).
 		Aggregation(timeAggrName, timeAggr).
 		Size(0).
@@ -177,14 +364,201 @@ func AggregationAttackWithTime(startTime int64, endTime int64, interval string,
 	return result, nil
 }
 
+// AggregationAttackHistogram counts the alarms in every interval, the counts are split
+// by attack_type and intercept_state so that the charts can be drawn without the raw alarms
+func AggregationAttackHistogram(startTime int64, endTime int64, interval string, timeZone string, size int,
+	query map[string]interface{}, appId string) (map[string]interface{}, error) {
+	ctx, cancel := es.SearchContext(es.ContextAggregation)
+	defer cancel()
+	timeAggrName := "aggr_time"
+	typeAggrName := "aggr_type"
+	interceptAggrName := "aggr_intercept"
+	timeAggr := elastic.NewDateHistogramAggregation().Field("event_time").TimeZone(timeZone).
+		Interval(interval).MinDocCount(0).ExtendedBounds(startTime, endTime)
+	timeAggr.SubAggregation(typeAggrName,
+		elastic.NewTermsAggregation().Field("attack_type").Size(size).OrderByCount(false))
+	timeAggr.SubAggregation(interceptAggrName, elastic.NewTermsAggregation().Field("intercept_state"))
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return nil, err
+	}
+	aggrResult, err := es.ElasticClient.Search(index).
+		IgnoreUnavailable(true).
+		Query(getSearchQuery(startTime, endTime, query)).
+		Aggregation(timeAggrName, timeAggr).
+		Size(0).
+		Do(ctx)
+	if err != nil {
+		if aggrResult != nil && aggrResult.Error != nil {
+			errMsg, err := json.Marshal(aggrResult.Error)
+			if err == nil {
+				beego.Error(string(errMsg))
+			}
+		}
+		return nil, err
+	}
+
+	labels := make([]interface{}, 0)
+	total := make([]int64, 0)
+	typeSeries := make(map[string][]int64)
+	interceptSeries := make(map[string][]int64)
+	if aggrResult != nil && aggrResult.Aggregations != nil {
+		if histogram, ok := aggrResult.Aggregations.DateHistogram(timeAggrName); ok && histogram.Buckets != nil {
+			labelCount := len(histogram.Buckets)
+			labels = make([]interface{}, labelCount)
+			total = make([]int64, labelCount)
+			for index, timeBucket := range histogram.Buckets {
+				labels[index] = timeBucket.Key
+				total[index] = timeBucket.DocCount
+				addHistogramSeries(typeSeries, timeBucket, typeAggrName, index, labelCount)
+				addHistogramSeries(interceptSeries, timeBucket, interceptAggrName, index, labelCount)
+			}
+		}
+	}
+	return map[string]interface{}{
+		"labels":          labels,
+		"total":           total,
+		"attack_type":     getHistogramSeries(typeSeries),
+		"intercept_state": getHistogramSeries(interceptSeries),
+	}, nil
+}
+
+func addHistogramSeries(series map[string][]int64, timeBucket *elastic.AggregationBucketHistogramItem,
+	aggrName string, index int, labelCount int) {
+	terms, ok := timeBucket.Terms(aggrName)
+	if !ok {
+		return
+	}
+	for _, item := range terms.Buckets {
+		name := fmt.Sprint(item.Key)
+		if _, ok := series[name]; !ok {
+			series[name] = make([]int64, labelCount)
+		}
+		series[name][index] = item.DocCount
+	}
+}
+
+// the series are sorted by name, so that the same series has the same color in every chart
+func getHistogramSeries(series map[string][]int64) []map[string]interface{} {
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		result = append(result, map[string]interface{}{
+			"name": name,
+			"data": series[name],
+		})
+	}
+	return result
+}
+
+// AggregationAttackWithSource returns the top attack sources with the attack types they used and the count
+// of the intercepted and logged alarms, the location is attached when the geoip database is available
+func AggregationAttackWithSource(startTime int64, endTime int64, size int, query map[string]interface{},
+	appId string) ([]map[string]interface{}, error) {
+	ctx, cancel := es.SearchContext(es.ContextAggregation)
+	defer cancel()
+	sourceAggrName := "aggr_source"
+	typeAggrName := "aggr_type"
+	interceptAggrName := "aggr_intercept"
+	sourceAggr := elastic.NewTermsAggregation().Field("attack_source").Size(size).OrderByCount(false)
+	sourceAggr.SubAggregation(typeAggrName, elastic.NewTermsAggregation().Field("attack_type").OrderByCount(false))
+	sourceAggr.SubAggregation(interceptAggrName, elastic.NewTermsAggregation().Field("intercept_state"))
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return nil, err
+	}
+	aggrResult, err := es.ElasticClient.Search(index).
+		IgnoreUnavailable(true).
+		Query(getSearchQuery(startTime, endTime, query)).
+		Aggregation(sourceAggrName, sourceAggr).
+		Size(0).
+		Do(ctx)
+	if err != nil {
+		if aggrResult != nil && aggrResult.Error != nil {
+			errMsg, err := json.Marshal(aggrResult.Error)
+			if err == nil {
+				beego.Error(string(errMsg))
+			}
+		}
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0)
+	if aggrResult == nil || aggrResult.Aggregations == nil {
+		return result, nil
+	}
+	terms, ok := aggrResult.Aggregations.Terms(sourceAggrName)
+	if !ok || terms.Buckets == nil {
+		return result, nil
+	}
+	for _, sourceBucket := range terms.Buckets {
+		attackSource := fmt.Sprint(sourceBucket.Key)
+		attackTypes := make([]map[string]interface{}, 0)
+		if typeTerms, ok := sourceBucket.Terms(typeAggrName); ok {
+			for _, item := range typeTerms.Buckets {
+				attackTypes = append(attackTypes, map[string]interface{}{
+					"name":  item.Key,
+					"count": item.DocCount,
+				})
+			}
+		}
+		var blockCount, logCount int64
+		if interceptTerms, ok := sourceBucket.Terms(interceptAggrName); ok {
+			for _, item := range interceptTerms.Buckets {
+				if item.Key == "block" {
+					blockCount = item.DocCount
+				} else if item.Key == "log" {
+					logCount = item.DocCount
+				}
+			}
+		}
+		var blockRatio float64
+		if sourceBucket.DocCount > 0 {
+			blockRatio = float64(blockCount) / float64(sourceBucket.DocCount)
+		}
+		item := map[string]interface{}{
+			"attack_source": attackSource,
+			"count":         sourceBucket.DocCount,
+			"attack_type":   attackTypes,
+			"block":         blockCount,
+			"log":           logCount,
+			"block_ratio":   blockRatio,
+		}
+		record, err := getIpLocation(attackSource)
+		if err != nil {
+			beego.Error("failed to parse attack ip to location: " + err.Error())
+		}
+		if record != nil {
+			item["location"] = map[string]interface{}{
+				"country":        record.Country.Names["en"],
+				"city":           record.City.Names["en"],
+				"country_zh_cn":  record.Country.Names["zh-CN"],
+				"city_zh_cn":     record.City.Names["zh-CN"],
+				"location_zh_cn": record.Country.Names["zh-CN"] + "-" + record.City.Names["zh-CN"],
+				"location_en":    record.Country.Names["en"] + "-" + record.City.Names["en"],
+			}
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
 func AggregationAttackWithUserAgent(startTime int64, endTime int64, size int,
 	appId string) ([][]interface{}, error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	ctx, cancel := es.SearchContext(es.ContextAggregation)
 	defer cancel()
 	uaAggr := elastic.NewTermsAggregation().Field("user_agent").Size(size).OrderByCount(false)
 	timeQuery := elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime)
 	aggrName := "aggr_ua"
-	aggrResult, err := es.ElasticClient.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return nil, err
+	}
+	aggrResult, err := es.ElasticClient.Search(index).
+		IgnoreUnavailable(true).
 		Query(timeQuery).
 		Aggregation(aggrName, uaAggr).
 		Size(0).
@@ -214,12 +588,17 @@ func AggregationAttackWithUserAgent(startTime int64, endTime int64, size int,
 
 func AggregationAttackWithType(startTime int64, endTime int64, size int,
 	appId string) ([][]interface{}, error) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	ctx, cancel := es.SearchContext(es.ContextAggregation)
 	defer cancel()
 	typeAggr := elastic.NewTermsAggregation().Field("attack_type").Size(size).OrderByCount(false)
 	timeQuery := elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime)
 	aggrName := "aggr_type"
-	aggrResult, err := es.ElasticClient.Search(AttackAlarmInfo.EsAliasIndex + "-" + appId).
+	index, err := es.GetSearchIndex(AttackAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return nil, err
+	}
+	aggrResult, err := es.ElasticClient.Search(index).
+		IgnoreUnavailable(true).
 		Query(timeQuery).
 		Aggregation(aggrName, typeAggr).
 		Size(0).
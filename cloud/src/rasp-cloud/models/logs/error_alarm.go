@@ -3,7 +3,6 @@ package logs
 import (
 	"github.com/astaxie/beego"
 	"time"
-	"rasp-cloud/conf"
 )
 
 var (
@@ -12,7 +11,7 @@ var (
 		EsIndex:      "openrasp-error-alarm",
 		EsAliasIndex: "real-openrasp-error-alarm",
 		TtlTime:      24 * 365 * time.Hour,
-		AlarmBuffer:  make(chan map[string]interface{}, conf.AppConfig.AlarmBufferSize),
+		Rollover:     true,
 		FileLogger:   initAlarmFileLogger("/openrasp-logs/error-alarm", "error.log"),
 	}
 )
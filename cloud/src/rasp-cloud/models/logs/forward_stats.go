@@ -0,0 +1,149 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package logs
+
+import (
+	"sort"
+	"time"
+)
+
+// ForwardStat counts the messages of an app and a log type forwarded by a channel such as syslog
+type ForwardStat struct {
+	Channel   string `json:"channel"`
+	AppId     string `json:"app_id"`
+	LogType   string `json:"log_type"`
+	Published int64  `json:"published"`
+	Retried   int64  `json:"retried"`
+	Dropped   int64  `json:"dropped"`
+}
+
+type ForwardFailure struct {
+	Time    int64  `json:"time"`
+	Channel string `json:"channel"`
+	AppId   string `json:"app_id"`
+	LogType string `json:"log_type"`
+	Dropped bool   `json:"dropped"`
+	Reason  string `json:"reason"`
+}
+
+type forwardRecord struct {
+	stats    map[string]*ForwardStat
+	failures []*ForwardFailure
+	// the time of the last reset
+	resetTime int64
+}
+
+const (
+	ForwardChannelSyslog = "syslog"
+)
+
+var (
+	maxForwardFailures = 100
+	forwardRecords     = make(chan *forwardRecord, 1)
+)
+
+func init() {
+	forwardRecords <- &forwardRecord{
+		stats:     make(map[string]*ForwardStat),
+		failures:  make([]*ForwardFailure, 0, maxForwardFailures),
+		resetTime: time.Now().Unix(),
+	}
+}
+
+func getForwardStat(record *forwardRecord, channel string, appId string, logType string) *ForwardStat {
+	key := channel + "/" + appId + "/" + logType
+	stat, ok := record.stats[key]
+	if !ok {
+		stat = &ForwardStat{Channel: channel, AppId: appId, LogType: logType}
+		record.stats[key] = stat
+	}
+	return stat
+}
+
+func recordForwardPublished(channel string, appId string, logType string) {
+	record := <-forwardRecords
+	defer func() {
+		forwardRecords <- record
+	}()
+	getForwardStat(record, channel, appId, logType).Published++
+}
+
+// recordForwardFailure counts the retried or dropped messages and keeps the latest failure reasons
+func recordForwardFailure(channel string, appId string, logType string, count int64, dropped bool, reason string) {
+	record := <-forwardRecords
+	defer func() {
+		forwardRecords <- record
+	}()
+	stat := getForwardStat(record, channel, appId, logType)
+	if dropped {
+		stat.Dropped += count
+	} else {
+		stat.Retried += count
+	}
+	if len(record.failures) >= maxForwardFailures {
+		record.failures = append(record.failures[:0], record.failures[1:]...)
+	}
+	record.failures = append(record.failures, &ForwardFailure{
+		Time:    time.Now().Unix(),
+		Channel: channel,
+		AppId:   appId,
+		LogType: logType,
+		Dropped: dropped,
+		Reason:  reason,
+	})
+}
+
+// GetForwardStats returns the counters since the last reset, and the latest failures with the newest first,
+// the empty appId means all the apps
+func GetForwardStats(appId string) (stats []*ForwardStat, failures []*ForwardFailure, resetTime int64) {
+	record := <-forwardRecords
+	defer func() {
+		forwardRecords <- record
+	}()
+	stats = make([]*ForwardStat, 0, len(record.stats))
+	for _, stat := range record.stats {
+		if appId == "" || stat.AppId == appId {
+			statCopy := *stat
+			stats = append(stats, &statCopy)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].AppId != stats[j].AppId {
+			return stats[i].AppId < stats[j].AppId
+		}
+		if stats[i].Channel != stats[j].Channel {
+			return stats[i].Channel < stats[j].Channel
+		}
+		return stats[i].LogType < stats[j].LogType
+	})
+	failures = make([]*ForwardFailure, 0, len(record.failures))
+	for i := len(record.failures) - 1; i >= 0; i-- {
+		if appId == "" || record.failures[i].AppId == appId {
+			failureCopy := *record.failures[i]
+			failures = append(failures, &failureCopy)
+		}
+	}
+	return stats, failures, record.resetTime
+}
+
+func ResetForwardStats() {
+	record := <-forwardRecords
+	defer func() {
+		forwardRecords <- record
+	}()
+	record.stats = make(map[string]*ForwardStat)
+	record.failures = make([]*ForwardFailure, 0, maxForwardFailures)
+	record.resetTime = time.Now().Unix()
+}
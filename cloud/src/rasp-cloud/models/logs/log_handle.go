@@ -15,14 +15,16 @@
 package logs
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
 	"github.com/olivere/elastic"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"rasp-cloud/es"
 	"rasp-cloud/tools"
 	"time"
@@ -45,22 +47,54 @@ type AggrFieldParam struct {
 }
 
 type SearchAttackParam struct {
-	Page    int `json:"page"`
-	Perpage int `json:"perpage"`
-	Data *struct {
-		Id             string    `json:"_id,omitempty"`
-		AppId          string    `json:"app_id,omitempty"`
-		StartTime      int64     `json:"start_time"`
-		EndTime        int64     `json:"end_time"`
-		RaspId         string    `json:"rasp_id,omitempty"`
-		HostName       string    `json:"server_hostname,omitempty"`
-		AttackSource   string    `json:"attack_source,omitempty"`
-		AttackUrl      string    `json:"url,omitempty"`
-		LocalIp        string    `json:"local_ip,omitempty"`
-		StackMd5       string    `json:"stack_md5,omitempty"`
-		AttackType     *[]string `json:"attack_type,omitempty"`
-		InterceptState *[]string `json:"intercept_state,omitempty"`
-	} `json:"data"`
+	Page    int               `json:"page"`
+	Perpage int               `json:"perpage"`
+	Data    *AttackSearchData `json:"data"`
+}
+
+type AttackSearchData struct {
+	Id             string    `json:"_id,omitempty"`
+	AppId          string    `json:"app_id,omitempty"`
+	StartTime      int64     `json:"start_time"`
+	EndTime        int64     `json:"end_time"`
+	RaspId         string    `json:"rasp_id,omitempty"`
+	RaspTag        string    `json:"rasp_tag,omitempty"`
+	HostName       string    `json:"server_hostname,omitempty"`
+	AttackSource   string    `json:"attack_source,omitempty"`
+	AttackUrl      string    `json:"url,omitempty"`
+	LocalIp        string    `json:"local_ip,omitempty"`
+	StackMd5       string    `json:"stack_md5,omitempty"`
+	AttackType     *[]string `json:"attack_type,omitempty"`
+	InterceptState *[]string `json:"intercept_state,omitempty"`
+	// the false positives are excluded unless it is true
+	IncludeFalsePositive bool `json:"include_false_positive,omitempty"`
+}
+
+type AggrSourceParam struct {
+	Size int               `json:"size"`
+	Data *AttackSearchData `json:"data"`
+}
+
+// the alarms are selected by ids or by the search params in data
+type FalsePositiveParam struct {
+	AppId         string            `json:"app_id"`
+	Ids           []string          `json:"ids"`
+	Data          *AttackSearchData `json:"data"`
+	FalsePositive bool              `json:"false_positive"`
+}
+
+// the filters in data are the same as the ones of the attack alarm search
+type AggrHistogramParam struct {
+	Interval string            `json:"interval"`
+	TimeZone string            `json:"time_zone"`
+	Size     int               `json:"size"`
+	Data     *AttackSearchData `json:"data"`
+}
+
+type PolicyStatusParam struct {
+	AppId  string   `json:"app_id"`
+	Ids    []string `json:"ids"`
+	Status string   `json:"status"`
 }
 
 type SearchPolicyParam struct {
@@ -72,9 +106,11 @@ type SearchPolicyParam struct {
 		StartTime int64     `json:"start_time"`
 		EndTime   int64     `json:"end_time"`
 		RaspId    string    `json:"rasp_id,omitempty"`
+		RaspTag   string    `json:"rasp_tag,omitempty"`
 		HostName  string    `json:"server_hostname,omitempty"`
 		LocalIp   string    `json:"local_ip,omitempty"`
 		PolicyId  *[]string `json:"policy_id,omitempty"`
+		Status    *[]string `json:"status,omitempty"`
 	} `json:"data"`
 }
 
@@ -87,6 +123,7 @@ type SearchErrorParam struct {
 		StartTime int64  `json:"start_time"`
 		EndTime   int64  `json:"end_time"`
 		RaspId    string `json:"rasp_id,omitempty"`
+		RaspTag   string `json:"rasp_tag,omitempty"`
 		HostName  string `json:"server_hostname,omitempty"`
 		LocalIp   string `json:"local_ip,omitempty"`
 	} `json:"data"`
@@ -97,20 +134,36 @@ type AlarmLogInfo struct {
 	EsIndex      string
 	EsAliasIndex string
 	TtlTime      time.Duration
+	Rollover     bool
 	FileLogger   *logs.BeeLogger
-	AlarmBuffer  chan map[string]interface{}
+	EsBulk       *es.BulkProcessor
 }
 
+const (
+	MaxHistogramBuckets = 1000
+	MaxHistogramSize    = 100
+)
+
 var (
 	AddAlarmFunc func(string, map[string]interface{}) error
 	alarmInfos   = make(map[string]*AlarmLogInfo)
+	// the calendar intervals are counted with their shortest length, so the bucket count is never underestimated
+	calendarIntervals = map[string]time.Duration{
+		"minute":  time.Minute,
+		"hour":    time.Hour,
+		"day":     24 * time.Hour,
+		"week":    7 * 24 * time.Hour,
+		"month":   28 * 24 * time.Hour,
+		"quarter": 89 * 24 * time.Hour,
+		"year":    365 * 24 * time.Hour,
+	}
+	fixedIntervalRegex = regexp.MustCompile(`^([1-9][0-9]{0,5})([smhd])$`)
 )
 
 func init() {
 	if conf.AppConfig.AlarmLogMode == "file" {
 		AddAlarmFunc = AddLogWithFile
 	} else if conf.AppConfig.AlarmLogMode == "es" {
-		startEsAlarmLogPush()
 		AddAlarmFunc = AddLogWithES
 	} else {
 		tools.Panic(tools.ErrCodeConfigInitFailed, "Unrecognized the value of RaspLogMode config", nil)
@@ -119,7 +172,13 @@ func init() {
 
 func registerAlarmInfo(info *AlarmLogInfo) {
 	alarmInfos[info.EsType] = info
-	es.RegisterTTL(info.TtlTime, info.EsAliasIndex+"-*")
+	es.RegisterTTL(info.TtlTime, info.EsIndex+"-*")
+	if info.Rollover {
+		es.RegisterRollover(info.EsIndex, conf.AppConfig.EsAlarmRetention)
+	}
+	if conf.AppConfig.AlarmLogMode == "es" {
+		info.EsBulk = es.NewBulkProcessor(info.EsType, conf.AppConfig.AlarmBufferSize)
+	}
 }
 
 func initAlarmFileLogger(dirName string, fileName string) *logs.BeeLogger {
@@ -145,58 +204,8 @@ func initAlarmFileLogger(dirName string, fileName string) *logs.BeeLogger {
 	return logger
 }
 
-func startEsAlarmLogPush() {
-	go func() {
-		for {
-			handleEsLogPush()
-		}
-	}()
-}
-
-func handleEsLogPush() {
-	defer func() {
-		if r := recover(); r != nil {
-			beego.Error("failed to push es alarm log: ", r)
-		}
-	}()
-	select {
-	case alarm := <-AttackAlarmInfo.AlarmBuffer:
-		alarms := make([]map[string]interface{}, 0, 200)
-		alarms = append(alarms, alarm)
-		for len(AttackAlarmInfo.AlarmBuffer) > 0 && len(alarms) < 200 {
-			alarm := <-AttackAlarmInfo.AlarmBuffer
-			alarms = append(alarms, alarm)
-		}
-		err := es.BulkInsert(AttackAlarmInfo.EsType, alarms)
-		if err != nil {
-			beego.Error("failed to execute es bulk insert for attack alarm: " + err.Error())
-		}
-	case alarm := <-PolicyAlarmInfo.AlarmBuffer:
-		alarms := make([]map[string]interface{}, 0, 200)
-		alarms = append(alarms, alarm)
-		for len(PolicyAlarmInfo.AlarmBuffer) > 0 && len(alarms) < 200 {
-			alarm := <-PolicyAlarmInfo.AlarmBuffer
-			alarms = append(alarms, alarm)
-		}
-		err := es.BulkInsert(PolicyAlarmInfo.EsType, alarms)
-		if err != nil {
-			beego.Error("failed to execute es bulk insert for policy alarm: " + err.Error())
-		}
-	case alarm := <-ErrorAlarmInfo.AlarmBuffer:
-		alarms := make([]map[string]interface{}, 0, 200)
-		alarms = append(alarms, alarm)
-		for len(ErrorAlarmInfo.AlarmBuffer) > 0 && len(alarms) < 200 {
-			alarm := <-ErrorAlarmInfo.AlarmBuffer
-			alarms = append(alarms, alarm)
-		}
-		err := es.BulkInsert(ErrorAlarmInfo.EsType, alarms)
-		if err != nil {
-			beego.Error("failed to execute es bulk insert for error alarm: " + err.Error())
-		}
-	}
-}
-
 func AddLogWithFile(alarmType string, alarm map[string]interface{}) error {
+	forwardToSyslog(alarmType, alarm)
 	if info, ok := alarmInfos[alarmType]; ok && info.FileLogger != nil {
 		content, err := json.Marshal(alarm)
 		if err != nil {
@@ -214,13 +223,17 @@ func AddLogWithFile(alarmType string, alarm map[string]interface{}) error {
 }
 
 func AddLogWithES(alarmType string, alarm map[string]interface{}) error {
-	select {
-	case alarmInfos[alarmType].AlarmBuffer <- alarm:
-	default:
-		logs.Error("Failed to write attack alarm to ES, " +
-			"the buffer is full. Consider increase AlarmBufferSize value: " + fmt.Sprintf("%+v", alarm))
+	forwardToSyslog(alarmType, alarm)
+	info, ok := alarmInfos[alarmType]
+	if !ok || info.EsBulk == nil {
+		return errors.New("failed to write rasp log to ES, unrecognized log type: " + alarmType)
 	}
-	return nil
+	err := info.EsBulk.Add(alarm)
+	if err != nil {
+		logs.Error("Failed to write " + alarmType + " to ES, " + err.Error() +
+			". Consider increase AlarmBufferSize value: " + fmt.Sprintf("%+v", alarm))
+	}
+	return err
 }
 
 func getVulnAggr(attackTimeTopHitName string) (*elastic.TermsAggregation) {
@@ -244,56 +257,11 @@ func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[str
 	var total int64
 	var attackAggrName = "attack_aggr"
 	var attackTimeTopHitName = "attack_time_top_hit"
-	filterQueries := make([]elastic.Query, 0, len(query)+1)
-	shouldQueries := make([]elastic.Query, 0, len(query)+1)
-	if query != nil {
-		for key, value := range query {
-			if key == "attack_type" {
-				if v, ok := value.([]interface{}); ok {
-					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
-				} else {
-					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
-				}
-			} else if key == "intercept_state" {
-				if v, ok := value.([]interface{}); ok {
-					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
-				} else {
-					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
-				}
-			} else if key == "policy_id" {
-				if v, ok := value.([]interface{}); ok {
-					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
-				} else {
-					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
-				}
-			} else if key == "local_ip" {
-				filterQueries = append(filterQueries,
-					elastic.NewNestedQuery("server_nic", elastic.NewTermQuery("server_nic.ip", value)))
-			} else if key == "attack_source" {
-				filterQueries = append(filterQueries, elastic.NewWildcardQuery(key, "*"+fmt.Sprint(value)+"*"))
-			} else if key == "server_hostname" {
-				shouldQueries = append(shouldQueries,
-					elastic.NewWildcardQuery("server_hostname", "*"+fmt.Sprint(value)+"*"))
-				shouldQueries = append(shouldQueries,
-					elastic.NewNestedQuery("server_nic",
-						elastic.NewWildcardQuery("server_nic.ip", "*"+fmt.Sprint(value)+"*")))
-			} else if key == "url" {
-				filterQueries = append(filterQueries,
-					elastic.NewWildcardQuery("url", "*"+fmt.Sprint(value)+"*"))
-			} else {
-				filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
-			}
-		}
-	}
-	filterQueries = append(filterQueries, elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime))
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(15*time.Second))
+	ctx, cancel := es.SearchContext(es.ContextSearch)
 	defer cancel()
-	boolQuery := elastic.NewBoolQuery().Filter(filterQueries...)
-	if len(shouldQueries) > 0 {
-		boolQuery.Should(shouldQueries...).MinimumNumberShouldMatch(1)
-	}
+	boolQuery := getSearchQuery(startTime, endTime, query)
 
-	queryService := es.ElasticClient.Search(index...).Query(boolQuery)
+	queryService := es.ElasticClient.Search(index...).IgnoreUnavailable(true).Query(boolQuery)
 
 	if isAttachAggr {
 		attackAggr := getVulnAggr(attackTimeTopHitName)
@@ -314,21 +282,10 @@ func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[str
 	result := make([]map[string]interface{}, 0)
 	if !isAttachAggr {
 		if queryResult != nil && queryResult.Hits != nil && queryResult.Hits.Hits != nil {
-			hits := queryResult.Hits.Hits
 			total = queryResult.Hits.TotalHits
-			result = make([]map[string]interface{}, len(hits))
-			for index, item := range hits {
-				result[index] = make(map[string]interface{})
-				err := json.Unmarshal(*item.Source, &result[index])
-				if err != nil {
-					return 0, nil, err
-				}
-				result[index]["id"] = item.Id
-				delete(result[index], "_@timestamp")
-				delete(result[index], "@timestamp")
-				delete(result[index], "@version")
-				delete(result[index], "tags")
-				delete(result[index], "host")
+			result, err = parseAlarmHits(queryResult.Hits.Hits)
+			if err != nil {
+				return 0, nil, err
 			}
 		}
 	} else {
@@ -365,6 +322,24 @@ func SearchLogs(startTime int64, endTime int64, isAttachAggr bool, query map[str
 	return total, result, nil
 }
 
+func parseAlarmHits(hits []*elastic.SearchHit) ([]map[string]interface{}, error) {
+	result := make([]map[string]interface{}, len(hits))
+	for index, item := range hits {
+		result[index] = make(map[string]interface{})
+		err := json.Unmarshal(*item.Source, &result[index])
+		if err != nil {
+			return nil, err
+		}
+		result[index]["id"] = item.Id
+		delete(result[index], "_@timestamp")
+		delete(result[index], "@timestamp")
+		delete(result[index], "@version")
+		delete(result[index], "tags")
+		delete(result[index], "host")
+	}
+	return result, nil
+}
+
 func CreateAlarmEsIndex(appId string) (err error) {
 	for _, alarmInfo := range alarmInfos {
 		err = es.CreateEsIndex(alarmInfo.EsIndex + "-" + appId)
@@ -374,3 +349,118 @@ func CreateAlarmEsIndex(appId string) (err error) {
 	}
 	return
 }
+
+// RemoveExpiredAlarms deletes the alarms of the app inserted more than the days ago
+func RemoveExpiredAlarms(esType string, appId string, days int) (deleted int64, taskId string, err error) {
+	alarmInfo, ok := alarmInfos[esType]
+	if !ok {
+		return 0, "", errors.New("unrecognized alarm type: " + esType)
+	}
+	index, err := es.GetSearchIndex(alarmInfo.EsIndex, appId)
+	if err != nil {
+		return 0, "", err
+	}
+	expiredTime := (time.Now().UnixNano() - int64(time.Duration(days)*24*time.Hour)) / 1000000
+	return es.DeleteByQuery(index, elastic.NewRangeQuery("@timestamp").Lt(expiredTime))
+}
+
+// RemoveAlarmEsIndex deletes all the generations of the alarm indices of the app
+func RemoveAlarmEsIndex(appId string) (err error) {
+	for _, alarmInfo := range alarmInfos {
+		_, err = es.DeleteAppIndex(alarmInfo.EsIndex, appId)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// getSearchQuery converts the search params of the alarm apis to the es query,
+// so that the searches and the aggregations on the same params match the same alarms
+func getSearchQuery(startTime int64, endTime int64, query map[string]interface{}) *elastic.BoolQuery {
+	filterQueries := make([]elastic.Query, 0, len(query)+1)
+	shouldQueries := make([]elastic.Query, 0, len(query)+1)
+	if query != nil {
+		for key, value := range query {
+			if key == "attack_type" {
+				if v, ok := value.([]interface{}); ok {
+					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
+				} else {
+					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
+				}
+			} else if key == "intercept_state" {
+				if v, ok := value.([]interface{}); ok {
+					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
+				} else {
+					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
+				}
+			} else if key == "rasp_id" {
+				if v, ok := value.([]interface{}); ok {
+					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
+				} else {
+					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
+				}
+			} else if key == "policy_id" {
+				if v, ok := value.([]interface{}); ok {
+					filterQueries = append(filterQueries, elastic.NewTermsQuery(key, v...))
+				} else {
+					filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
+				}
+			} else if key == "false_positive" {
+				falsePositive, _ := value.(bool)
+				filterQueries = append(filterQueries, getFalsePositiveQuery(falsePositive))
+			} else if key == "status" {
+				filterQueries = append(filterQueries, getPolicyStatusQuery(value))
+			} else if key == "local_ip" {
+				filterQueries = append(filterQueries,
+					elastic.NewNestedQuery("server_nic", elastic.NewTermQuery("server_nic.ip", value)))
+			} else if key == "attack_source" {
+				filterQueries = append(filterQueries, elastic.NewWildcardQuery(key, "*"+fmt.Sprint(value)+"*"))
+			} else if key == "server_hostname" {
+				shouldQueries = append(shouldQueries,
+					elastic.NewWildcardQuery("server_hostname", "*"+fmt.Sprint(value)+"*"))
+				shouldQueries = append(shouldQueries,
+					elastic.NewNestedQuery("server_nic",
+						elastic.NewWildcardQuery("server_nic.ip", "*"+fmt.Sprint(value)+"*")))
+			} else if key == "url" {
+				filterQueries = append(filterQueries,
+					elastic.NewWildcardQuery("url", "*"+fmt.Sprint(value)+"*"))
+			} else {
+				filterQueries = append(filterQueries, elastic.NewTermQuery(key, value))
+			}
+		}
+	}
+	filterQueries = append(filterQueries, elastic.NewRangeQuery("event_time").Gte(startTime).Lte(endTime))
+	boolQuery := elastic.NewBoolQuery().Filter(filterQueries...)
+	if len(shouldQueries) > 0 {
+		boolQuery.Should(shouldQueries...).MinimumNumberShouldMatch(1)
+	}
+	return boolQuery
+}
+
+// GetHistogramBucketCount returns the max count of the buckets which the date histogram may return,
+// the interval is either a calendar interval such as day or a fixed one such as 30m
+func GetHistogramBucketCount(startTime int64, endTime int64, interval string) (int64, error) {
+	length, ok := calendarIntervals[interval]
+	if !ok {
+		match := fixedIntervalRegex.FindStringSubmatch(interval)
+		if match == nil {
+			return 0, errors.New("invalid interval " + strconv.Quote(interval) +
+				", it must be one of minute, hour, day, week, month, quarter, year or a number with unit s, m, h, d")
+		}
+		count, _ := strconv.ParseInt(match[1], 10, 64)
+		switch match[2] {
+		case "s":
+			length = time.Second
+		case "m":
+			length = time.Minute
+		case "h":
+			length = time.Hour
+		case "d":
+			length = 24 * time.Hour
+		}
+		length *= time.Duration(count)
+	}
+	// the first and the last buckets may be partial
+	return (endTime-startTime)/int64(length/time.Millisecond) + 2, nil
+}
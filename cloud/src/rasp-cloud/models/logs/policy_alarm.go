@@ -18,17 +18,29 @@ import (
 	"fmt"
 	"crypto/md5"
 	"github.com/astaxie/beego"
+	"github.com/olivere/elastic"
+	"rasp-cloud/es"
 	"time"
-	"rasp-cloud/conf"
+)
+
+const (
+	PolicyAlarmStatusOpen     = "open"
+	PolicyAlarmStatusResolved = "resolved"
+	PolicyAlarmStatusIgnored  = "ignored"
+
+	MaxPolicyAlarmStatusIds = 1000
 )
 
 var (
+	PolicyAlarmStatuses = []string{PolicyAlarmStatusOpen, PolicyAlarmStatusResolved, PolicyAlarmStatusIgnored}
+	// the fields are only changed by users, the ones reported by agents are dropped
+	policyAlarmStatusFields = []string{"status", "status_user", "status_time", "reopened_count"}
+	// policy alarms are upserted with upsert_id, so they are kept in one index without rollover
 	PolicyAlarmInfo = AlarmLogInfo{
 		EsType:       "policy-alarm",
 		EsIndex:      "openrasp-policy-alarm",
 		EsAliasIndex: "real-openrasp-policy-alarm",
 		TtlTime:      24 * 365 * time.Hour,
-		AlarmBuffer:  make(chan map[string]interface{}, conf.AppConfig.AlarmBufferSize),
 		FileLogger:   initAlarmFileLogger("/openrasp-logs/policy-alarm", "policy.log"),
 	}
 )
@@ -68,5 +80,67 @@ func AddPolicyAlarm(alarm map[string]interface{}) error {
 		}
 	}
 	alarm["upsert_id"] = fmt.Sprintf("%x", md5.Sum([]byte(idContent)))
+	for _, field := range policyAlarmStatusFields {
+		delete(alarm, field)
+	}
 	return AddAlarmFunc(PolicyAlarmInfo.EsType, alarm)
 }
+
+func IsValidPolicyAlarmStatus(status string) bool {
+	for _, item := range PolicyAlarmStatuses {
+		if item == status {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatePolicyAlarmStatus sets the status of the policy alarms with the ids and returns the count of the
+// updated ones, the alarms are reopened by the next detection when they are resolved
+func UpdatePolicyAlarmStatus(appId string, ids []string, status string, user string) (int64, error) {
+	index, err := es.GetSearchIndex(PolicyAlarmInfo.EsIndex, appId)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := es.SearchContext(es.ContextSearch)
+	defer cancel()
+	script := elastic.NewScript(`ctx._source.status = params.status;
+		ctx._source.status_user = params.user;
+		ctx._source.status_time = params.time;`).
+		Lang("painless").
+		Params(map[string]interface{}{
+			"status": status,
+			"user":   user,
+			"time":   time.Now().UnixNano() / 1000000,
+		})
+	r, err := es.ElasticClient.UpdateByQuery(index).
+		IgnoreUnavailable(true).
+		Query(elastic.NewIdsQuery().Ids(ids...)).
+		Script(script).
+		Conflicts("proceed").
+		Refresh("true").
+		Do(ctx)
+	if err != nil {
+		if r != nil && r.Failures != nil {
+			beego.Error(r.Failures)
+		}
+		return 0, err
+	}
+	return r.Updated, nil
+}
+
+// the alarms without status are detected before the status is introduced, they are open
+func getPolicyStatusQuery(value interface{}) elastic.Query {
+	statuses, ok := value.([]interface{})
+	if !ok {
+		statuses = []interface{}{value}
+	}
+	statusQuery := elastic.NewTermsQuery("status", statuses...)
+	for _, status := range statuses {
+		if status == PolicyAlarmStatusOpen {
+			return elastic.NewBoolQuery().Should(statusQuery,
+				elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("status"))).MinimumNumberShouldMatch(1)
+		}
+	}
+	return statusQuery
+}
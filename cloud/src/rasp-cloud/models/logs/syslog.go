@@ -0,0 +1,336 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package logs
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/astaxie/beego"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyslogConf is the syslog forwarding config of the app, the alarms are sent as json in the RFC5424 messages
+type SyslogConf struct {
+	Enable        bool     `json:"enable" bson:"enable"`
+	Protocol      string   `json:"protocol" bson:"protocol"`
+	Addr          string   `json:"addr" bson:"addr"`
+	Facility      int      `json:"facility" bson:"facility"`
+	TlsSkipVerify bool     `json:"tls_skip_verify" bson:"tls_skip_verify"`
+	LogTypes      []string `json:"log_types" bson:"log_types"`
+}
+
+type syslogForwarder struct {
+	appId    string
+	conf     SyslogConf
+	queue    chan *syslogMessage
+	stop     chan struct{}
+	conn     net.Conn
+	confTime time.Time
+}
+
+type syslogMessage struct {
+	logType string
+	content []byte
+}
+
+const (
+	SyslogProtocolUdp = "udp"
+	SyslogProtocolTcp = "tcp"
+	SyslogProtocolTls = "tls"
+
+	// the private enterprise number reserved for the documentation by RFC 5612
+	syslogSdId = "openrasp@32473"
+	// RFC5424 allows at most 6 digits of the fractional second
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var (
+	// SyslogConfGetter returns the syslog config of the app, it is set by the models package
+	SyslogConfGetter func(appId string) (*SyslogConf, error)
+
+	syslogQueueSize     = 1000
+	syslogConfCacheTime = 30 * time.Second
+	syslogDialTimeout   = 5 * time.Second
+	syslogWriteTimeout  = 5 * time.Second
+	syslogRetryBaseWait = time.Second
+	syslogRetryMaxWait  = time.Minute
+	syslogForwarders    = make(chan map[string]*syslogForwarder, 1)
+	syslogHostname, _   = os.Hostname()
+	syslogAlarmSeverity = map[string]int{
+		"attack-alarm": 4,
+		"policy-alarm": 5,
+		"error-alarm":  3,
+	}
+)
+
+func init() {
+	syslogForwarders <- make(map[string]*syslogForwarder)
+	if syslogHostname == "" {
+		syslogHostname = "-"
+	}
+}
+
+func (c *SyslogConf) Valid() error {
+	if c.Protocol != SyslogProtocolUdp && c.Protocol != SyslogProtocolTcp && c.Protocol != SyslogProtocolTls {
+		return errors.New("the syslog protocol must be one of udp, tcp and tls")
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return errors.New("the syslog addr must be host:port: " + err.Error())
+	}
+	if c.Facility < 0 || c.Facility > 23 {
+		return errors.New("the syslog facility must be between 0 and 23")
+	}
+	for _, logType := range c.LogTypes {
+		if _, ok := syslogAlarmSeverity[logType]; !ok {
+			return errors.New("unrecognized syslog log type: " + logType)
+		}
+	}
+	return nil
+}
+
+func (c *SyslogConf) isLogTypeEnabled(logType string) bool {
+	if len(c.LogTypes) == 0 {
+		return true
+	}
+	for _, t := range c.LogTypes {
+		if t == logType {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SyslogConf) equals(other *SyslogConf) bool {
+	return c.Enable == other.Enable && c.Protocol == other.Protocol && c.Addr == other.Addr &&
+		c.Facility == other.Facility && c.TlsSkipVerify == other.TlsSkipVerify &&
+		strings.Join(c.LogTypes, ",") == strings.Join(other.LogTypes, ",")
+}
+
+// forwardToSyslog never blocks or fails the ingest, the alarm is dropped when the queue of the app is full
+func forwardToSyslog(logType string, alarm map[string]interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to forward alarm to syslog: ", r)
+		}
+	}()
+	if SyslogConfGetter == nil {
+		return
+	}
+	appId, ok := alarm["app_id"].(string)
+	if !ok {
+		return
+	}
+	forwarder := getSyslogForwarder(appId)
+	if forwarder == nil || !forwarder.conf.isLogTypeEnabled(logType) {
+		return
+	}
+	content, err := json.Marshal(alarm)
+	if err != nil {
+		beego.Error("failed to encode alarm for syslog: " + err.Error())
+		return
+	}
+	message := &syslogMessage{
+		logType: logType,
+		content: formatSyslogMessage(&forwarder.conf, logType, appId, content, time.Now()),
+	}
+	select {
+	case forwarder.queue <- message:
+	default:
+		recordForwardFailure(ForwardChannelSyslog, appId, logType, 1, true, "the syslog queue is full")
+	}
+}
+
+// getSyslogForwarder rereads the config of the app every syslogConfCacheTime without holding the lock,
+// the forwarder is recreated when the config is changed, and kept when the config fails to be read
+func getSyslogForwarder(appId string) *syslogForwarder {
+	forwarders := <-syslogForwarders
+	forwarder, ok := forwarders[appId]
+	fresh := ok && time.Since(forwarder.confTime) < syslogConfCacheTime
+	syslogForwarders <- forwarders
+	if !fresh {
+		conf, err := SyslogConfGetter(appId)
+		forwarders = <-syslogForwarders
+		if err != nil || conf == nil {
+			if err != nil {
+				beego.Warning("failed to get syslog config of app " + appId + ": " + err.Error())
+			}
+			// the current forwarder is kept until the config is read successfully
+			if forwarder, ok = forwarders[appId]; ok {
+				forwarder.confTime = time.Now()
+			} else {
+				forwarder = applySyslogConf(forwarders, appId, &SyslogConf{})
+			}
+		} else {
+			forwarder = applySyslogConf(forwarders, appId, conf)
+		}
+		syslogForwarders <- forwarders
+	}
+	if !forwarder.conf.Enable {
+		return nil
+	}
+	return forwarder
+}
+
+// UpdateSyslogConf applies the config of the app as soon as it is updated,
+// the forwarder of the app is stopped when the config is nil
+func UpdateSyslogConf(appId string, conf *SyslogConf) {
+	forwarders := <-syslogForwarders
+	defer func() {
+		syslogForwarders <- forwarders
+	}()
+	if conf == nil {
+		if forwarder, ok := forwarders[appId]; ok {
+			close(forwarder.stop)
+			delete(forwarders, appId)
+		}
+		return
+	}
+	applySyslogConf(forwarders, appId, conf)
+}
+
+// applySyslogConf must be called with the lock of the forwarders held
+func applySyslogConf(forwarders map[string]*syslogForwarder, appId string, conf *SyslogConf) *syslogForwarder {
+	forwarder, ok := forwarders[appId]
+	if ok && forwarder.conf.equals(conf) {
+		forwarder.confTime = time.Now()
+		return forwarder
+	}
+	if ok {
+		close(forwarder.stop)
+	}
+	forwarder = &syslogForwarder{
+		appId:    appId,
+		conf:     *conf,
+		queue:    make(chan *syslogMessage, syslogQueueSize),
+		stop:     make(chan struct{}),
+		confTime: time.Now(),
+	}
+	if forwarder.conf.Enable {
+		if err := forwarder.conf.Valid(); err != nil {
+			beego.Error("invalid syslog config of app " + appId + ": " + err.Error())
+			forwarder.conf.Enable = false
+		} else {
+			go forwarder.run()
+		}
+	}
+	forwarders[appId] = forwarder
+	return forwarder
+}
+
+// formatSyslogMessage formats the RFC5424 message, the structured data carries the app_id and the log type
+func formatSyslogMessage(conf *SyslogConf, logType string, appId string, content []byte, t time.Time) []byte {
+	severity, ok := syslogAlarmSeverity[logType]
+	if !ok {
+		severity = 6
+	}
+	header := "<" + strconv.Itoa(conf.Facility*8+severity) + ">1 " + t.Format(syslogTimeFormat) + " " +
+		syslogHostname + " openrasp " + strconv.Itoa(os.Getpid()) + " " + logType + " [" + syslogSdId +
+		" app_id=\"" + escapeSdParam(appId) + "\" log_type=\"" + escapeSdParam(logType) + "\"] "
+	return append([]byte(header), content...)
+}
+
+func escapeSdParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// run sends the messages in order, the connection is rebuilt with backoff when it is broken,
+// the messages left in the queue are dropped when the forwarder is stopped by the config change
+func (f *syslogForwarder) run() {
+	defer func() {
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}()
+	wait := syslogRetryBaseWait
+	for {
+		select {
+		case <-f.stop:
+			f.dropQueue()
+			return
+		case message := <-f.queue:
+			for {
+				err := f.write(message.content)
+				if err == nil {
+					recordForwardPublished(ForwardChannelSyslog, f.appId, message.logType)
+					wait = syslogRetryBaseWait
+					break
+				}
+				recordForwardFailure(ForwardChannelSyslog, f.appId, message.logType, 1, false,
+					"failed to send to "+f.conf.Addr+": "+err.Error())
+				beego.Warning("failed to forward alarm to syslog " + f.conf.Addr + ", retry after " +
+					wait.String() + ": " + err.Error())
+				select {
+				case <-f.stop:
+					recordForwardFailure(ForwardChannelSyslog, f.appId, message.logType, 1, true,
+						"the syslog config is changed")
+					f.dropQueue()
+					return
+				case <-time.After(wait):
+				}
+				if wait *= 2; wait > syslogRetryMaxWait {
+					wait = syslogRetryMaxWait
+				}
+			}
+		}
+	}
+}
+
+func (f *syslogForwarder) dropQueue() {
+	for {
+		select {
+		case message := <-f.queue:
+			recordForwardFailure(ForwardChannelSyslog, f.appId, message.logType, 1, true,
+				"the syslog config is changed")
+		default:
+			return
+		}
+	}
+}
+
+func (f *syslogForwarder) write(message []byte) error {
+	if f.conn == nil {
+		conn, err := f.dial()
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+	// the message is framed with octet counting over the stream, see RFC 6587
+	if f.conf.Protocol != SyslogProtocolUdp {
+		message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := f.conn.Write(message)
+	if err != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+	return err
+}
+
+func (f *syslogForwarder) dial() (net.Conn, error) {
+	switch f.conf.Protocol {
+	case SyslogProtocolTls:
+		return tls.DialWithDialer(&net.Dialer{Timeout: syslogDialTimeout}, "tcp", f.conf.Addr,
+			&tls.Config{InsecureSkipVerify: f.conf.TlsSkipVerify})
+	default:
+		return net.DialTimeout(f.conf.Protocol, f.conf.Addr, syslogDialTimeout)
+	}
+}
@@ -55,6 +55,11 @@ const (
 	OperationTypeDeleteApp
 	OperationTypeEditApp
 	OperationTypeRestorePlugin
+	OperationTypeEditRasp
+	OperationTypeMergeRasp
+	OperationTypeCloneApp
+	OperationTypeUpdatePolicyAlarmStatus
+	OperationTypeMarkFalsePositive
 )
 
 func init() {
@@ -176,6 +176,20 @@ func addPluginToDb(version string, name string, content []byte, appId string,
 	return
 }
 
+// copyPlugin adds the plugin with its algorithm config to the app
+func copyPlugin(plugin *Plugin, appId string) (*Plugin, error) {
+	newPlugin, err := addPluginToDb(plugin.Version, plugin.Name, []byte(plugin.Content), appId,
+		plugin.DefaultAlgorithmConfig)
+	if err != nil {
+		return nil, err
+	}
+	if plugin.AlgorithmConfig != nil {
+		newPlugin.AlgorithmConfig = plugin.AlgorithmConfig
+		err = mongo.UpdateId(pluginCollectionName, newPlugin.Id, bson.M{"algorithm_config": plugin.AlgorithmConfig})
+	}
+	return newPlugin, err
+}
+
 func generatePluginId(appId string) string {
 	random := string(bson.NewObjectId()) + appId +
 		strconv.FormatInt(time.Now().UnixNano(), 10) + strconv.Itoa(rand.Intn(10000))
@@ -19,9 +19,11 @@ import (
 	"rasp-cloud/tools"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"time"
 	"strconv"
 	"errors"
+	"strings"
+	"regexp"
+	"github.com/astaxie/beego"
 )
 
 type Rasp struct {
@@ -41,10 +43,36 @@ type Rasp struct {
 	LastHeartbeatTime int64             `json:"last_heartbeat_time" bson:"last_heartbeat_time,omitempty"`
 	RegisterTime      int64             `json:"register_time" bson:"register_time,omitempty"`
 	Environ           map[string]string `json:"environ" bson:"environ,omitempty"`
+	Tags              []string          `json:"tags" bson:"tags,omitempty"`
+	Description       string            `json:"description" bson:"description,omitempty"`
+	Owner             string            `json:"owner" bson:"owner,omitempty"`
+	VersionKey        string            `json:"-" bson:"version_key,omitempty"`
+}
+
+// RaspFilter holds the search conditions beyond the fields of the rasp,
+// the version_min is inclusive and the version_max is exclusive
+type RaspFilter struct {
+	VersionMin      string `json:"version_min"`
+	VersionMax      string `json:"version_max"`
+	HostnamePattern string `json:"hostname_pattern"`
+	SortBy          string `json:"sort_by"`
+	Ascending       bool   `json:"ascending"`
 }
 
 const (
 	raspCollectionName = "rasp"
+
+	// the rasps are identified by the rasp id by default, with the host identity the rasp registered
+	// from the same hostname and register_ip replaces the old ones
+	RaspIdentityId   = ""
+	RaspIdentityHost = "host"
+
+	RaspSortByRegisterTime      = "register_time"
+	RaspSortByLastHeartbeatTime = "last_heartbeat_time"
+
+	// the components of the version are compared as the numbers of at most 8 digits
+	versionKeyComponents = 4
+	versionKeyDigits     = 8
 )
 
 func init() {
@@ -70,10 +98,143 @@ func init() {
 		tools.Panic(tools.ErrCodeMongoInitFailed,
 			"failed to create register_time index for rasp collection", err)
 	}
+	index = &mgo.Index{
+		Key:        []string{"tags"},
+		Unique:     false,
+		Background: true,
+		Name:       "tags",
+	}
+	err = mongo.CreateIndex(raspCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create tags index for rasp collection", err)
+	}
+	index = &mgo.Index{
+		Key:        []string{"app_id", "version_key"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_id_version_key",
+	}
+	err = mongo.CreateIndex(raspCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create version_key index for rasp collection", err)
+	}
+	index = &mgo.Index{
+		Key:        []string{"last_heartbeat_time"},
+		Unique:     false,
+		Background: true,
+		Name:       "last_heartbeat_time",
+	}
+	err = mongo.CreateIndex(raspCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create last_heartbeat_time index for rasp collection", err)
+	}
+	index = &mgo.Index{
+		Key:        []string{"app_id", "owner"},
+		Unique:     false,
+		Background: true,
+		Name:       "app_id_owner",
+	}
+	err = mongo.CreateIndex(raspCollectionName, index)
+	if err != nil {
+		tools.Panic(tools.ErrCodeMongoInitFailed,
+			"failed to create owner index for rasp collection", err)
+	}
+	go initVersionKey()
 }
 
+// UpsertRaspById sets the fields reported by the agent, the tags, the description and the owner are managed
+// by the panel rather than the agent, so they are only set when the rasp is inserted
 func UpsertRaspById(id string, rasp *Rasp) (error) {
-	return mongo.UpsertId(raspCollectionName, id, rasp)
+	rasp.VersionKey, _ = GetVersionKey(rasp.Version)
+	agentFields := *rasp
+	agentFields.Id = ""
+	agentFields.Tags = nil
+	agentFields.Description = ""
+	agentFields.Owner = ""
+	update := bson.M{"$set": &agentFields}
+	panelFields := bson.M{}
+	if len(rasp.Tags) > 0 {
+		panelFields["tags"] = rasp.Tags
+	}
+	if rasp.Description != "" {
+		panelFields["description"] = rasp.Description
+	}
+	if rasp.Owner != "" {
+		panelFields["owner"] = rasp.Owner
+	}
+	if len(panelFields) > 0 {
+		update["$setOnInsert"] = panelFields
+	}
+	return mongo.UpsertId(raspCollectionName, id, update)
+}
+
+// GetVersionKey converts the version to a string that sorts in the version order, such as 1.3.10 > 1.3.9,
+// the missing components are treated as 0, and only the leading digits of each component are used
+func GetVersionKey(version string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".")
+	if len(parts) > versionKeyComponents {
+		return "", errors.New("the version can not have more than " + strconv.Itoa(versionKeyComponents) +
+			" components: " + version)
+	}
+	keys := make([]string, versionKeyComponents)
+	for i := range keys {
+		digits := ""
+		if i < len(parts) {
+			for _, c := range parts[i] {
+				if c < '0' || c > '9' {
+					break
+				}
+				digits += string(c)
+			}
+			if digits == "" {
+				return "", errors.New("invalid version: " + version)
+			}
+			digits = strings.TrimLeft(digits, "0")
+			if len(digits) > versionKeyDigits {
+				return "", errors.New("the version component is too large: " + version)
+			}
+		}
+		keys[i] = strings.Repeat("0", versionKeyDigits-len(digits)) + digits
+	}
+	return strings.Join(keys, "."), nil
+}
+
+// initVersionKey fills the version_key of the rasps registered before it is introduced
+func initVersionKey() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to init the version_key of rasps: ", r)
+		}
+	}()
+	var rasps []*Rasp
+	_, err := mongo.FindAllWithSelect(raspCollectionName, bson.M{"version_key": bson.M{"$exists": false}},
+		&rasps, bson.M{"_id": 1, "version": 1}, 0, 0)
+	if err != nil {
+		beego.Error("failed to get the rasps without version_key: " + err.Error())
+		return
+	}
+	for _, rasp := range rasps {
+		key, err := GetVersionKey(rasp.Version)
+		if err != nil {
+			continue
+		}
+		err = mongo.UpdateId(raspCollectionName, rasp.Id, bson.M{"version_key": key})
+		if err != nil && err != mgo.ErrNotFound {
+			beego.Error("failed to init the version_key of rasp " + rasp.Id + ": " + err.Error())
+			return
+		}
+	}
+}
+
+// getHostnameRegex converts the wildcard pattern to the regex, * matches any characters and ? matches one
+func getHostnameRegex(pattern string) string {
+	regex := regexp.QuoteMeta(pattern)
+	regex = strings.Replace(regex, `\*`, ".*", -1)
+	regex = strings.Replace(regex, `\?`, ".", -1)
+	return "^" + regex + "$"
 }
 
 func GetRaspByAppId(id string, page int, perpage int) (count int, result []*Rasp, err error) {
@@ -91,13 +252,51 @@ func RemoveRaspByAppId(appId string) (err error) {
 	return
 }
 
-func FindRasp(selector *Rasp, page int, perpage int) (count int, result []*Rasp, err error) {
+func FindRasp(selector *Rasp, filter *RaspFilter, page int, perpage int) (count int, result []*Rasp, err error) {
+	bsonModel, sortField, err := getRaspQuery(selector, filter)
+	if err != nil {
+		return
+	}
+	count, err = mongo.FindAllBySort(raspCollectionName, bsonModel, perpage*(page-1), perpage,
+		&result, sortField)
+	if err == nil {
+		for _, rasp := range result {
+			if selector.Online != nil {
+				rasp.Online = selector.Online
+			} else {
+				HandleRasp(rasp)
+			}
+		}
+	}
+	return
+}
+
+// ExportRasp walks the rasps matched by the search in batches, so that the large app is never loaded at once
+func ExportRasp(selector *Rasp, filter *RaspFilter, fn func(rasp *Rasp) error) error {
+	bsonModel, sortField, err := getRaspQuery(selector, filter)
+	if err != nil {
+		return err
+	}
+	return mongo.Iterate(raspCollectionName, bsonModel, raspExportBatchSize, func(iter *mgo.Iter) error {
+		rasp := &Rasp{}
+		for iter.Next(rasp) {
+			HandleRasp(rasp)
+			if err := fn(rasp); err != nil {
+				return err
+			}
+			rasp = &Rasp{}
+		}
+		return nil
+	}, sortField)
+}
+
+func getRaspQuery(selector *Rasp, filter *RaspFilter) (bsonModel bson.M, sortField string, err error) {
 	var bsonContent []byte
 	bsonContent, err = bson.Marshal(selector)
 	if err != nil {
 		return
 	}
-	bsonModel := bson.M{}
+	bsonModel = bson.M{}
 	err = bson.Unmarshal(bsonContent, &bsonModel)
 	if err != nil {
 		return
@@ -119,27 +318,40 @@ func FindRasp(selector *Rasp, page int, perpage int) (count int, result []*Rasp,
 		}
 		delete(bsonModel, "hostname")
 	}
-	if selector.Online != nil {
-		delete(bsonModel, "online")
-		if *selector.Online {
-			bsonModel["$where"] = "this.last_heartbeat_time+this.heartbeat_interval+180 >= " +
-				strconv.FormatInt(time.Now().Unix(), 10)
-		} else {
-			bsonModel["$where"] = "this.last_heartbeat_time+this.heartbeat_interval+180 < " +
-				strconv.FormatInt(time.Now().Unix(), 10)
-		}
+	if len(selector.Tags) > 0 {
+		bsonModel["tags"] = bson.M{"$all": selector.Tags}
 	}
-	count, err = mongo.FindAllBySort(raspCollectionName, bsonModel, perpage*(page-1), perpage,
-		&result, "-register_time")
-	if err == nil {
-		for _, rasp := range result {
-			if selector.Online != nil {
-				rasp.Online = selector.Online
-			} else {
-				HandleRasp(rasp)
+	delete(bsonModel, "version_key")
+	sortField = "-" + RaspSortByRegisterTime
+	if filter != nil {
+		versionKey := bson.M{}
+		if filter.VersionMin != "" {
+			if versionKey["$gte"], err = GetVersionKey(filter.VersionMin); err != nil {
+				return
+			}
+		}
+		if filter.VersionMax != "" {
+			if versionKey["$lt"], err = GetVersionKey(filter.VersionMax); err != nil {
+				return
+			}
+		}
+		if len(versionKey) > 0 {
+			bsonModel["version_key"] = versionKey
+		}
+		if filter.HostnamePattern != "" {
+			bsonModel["hostname"] = bson.M{"$regex": getHostnameRegex(filter.HostnamePattern), "$options": "i"}
+		}
+		if filter.SortBy != "" {
+			sortField = filter.SortBy
+			if !filter.Ascending {
+				sortField = "-" + sortField
 			}
 		}
 	}
+	if selector.Online != nil {
+		delete(bsonModel, "online")
+		bsonModel["$where"] = getOnlineWhere(selector.AppId, *selector.Online, 0)
+	}
 	return
 }
 
@@ -152,17 +364,14 @@ func GetRaspById(id string) (rasp *Rasp, err error) {
 }
 
 func HandleRasp(rasp *Rasp) {
-	var online bool
-	heartbeatInterval := rasp.HeartbeatInterval + 180
-	if time.Now().Unix()-rasp.LastHeartbeatTime > heartbeatInterval {
-		online = false
-	} else {
-		online = true
-	}
+	online := isRaspOnline(rasp)
 	rasp.Online = &online
 	if rasp.Environ == nil {
 		rasp.Environ = map[string]string{}
 	}
+	if rasp.Tags == nil {
+		rasp.Tags = []string{}
+	}
 }
 
 func RemoveRaspById(id string) (err error) {
@@ -177,15 +386,11 @@ func RemoveRaspById(id string) (err error) {
 }
 
 func RemoveRaspBySelector(selector map[string]interface{}, appId string) (int, error) {
-	offlineWhere := ""
+	var expireTime int64
 	if _, ok := selector["expire_time"]; ok {
-		expireTime := strconv.FormatInt(selector["expire_time"].(int64), 10)
-		offlineWhere = "this.last_heartbeat_time+this.heartbeat_interval+180+" + expireTime + "<" +
-			strconv.FormatInt(time.Now().Unix(), 10)
-	} else {
-		offlineWhere = "this.last_heartbeat_time+this.heartbeat_interval+180 < " +
-			strconv.FormatInt(time.Now().Unix(), 10)
+		expireTime = selector["expire_time"].(int64)
 	}
+	offlineWhere := getOnlineWhere(appId, false, expireTime)
 	param := bson.M{"app_id": appId, "$where": offlineWhere}
 	if selector["register_ip"] != nil && selector["register_ip"] != "" {
 		param["register_ip"] = selector["register_ip"]
@@ -196,3 +401,212 @@ func RemoveRaspBySelector(selector map[string]interface{}, appId string) (int, e
 	}
 	return info.Removed, nil
 }
+
+// RaspRemoveResult is the result of each rasp in the batch deletion
+type RaspRemoveResult struct {
+	Id      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// MaxRaspBatchSize limits the count of rasps deleted by one request
+var MaxRaspBatchSize = 500
+
+// FindOfflineRaspIds returns at most limit ids of the rasps offline for more than expireTime seconds
+func FindOfflineRaspIds(appId string, expireTime int64, limit int) (ids []string, err error) {
+	var rasps []*Rasp
+	_, err = mongo.FindAllWithSelect(raspCollectionName, bson.M{"app_id": appId, "$where": getOnlineWhere(appId, false, expireTime)},
+		&rasps, bson.M{"_id": 1}, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]string, 0, len(rasps))
+	for _, rasp := range rasps {
+		ids = append(ids, rasp.Id)
+	}
+	return ids, nil
+}
+
+// RemoveRaspByIds removes the offline rasps of the app in one operation, the online and missing rasps are
+// reported as the failures, the offline condition is checked again on removal in case the rasp comes back
+func RemoveRaspByIds(appId string, ids []string) (results []*RaspRemoveResult, removed int, err error) {
+	if len(ids) > MaxRaspBatchSize {
+		return nil, 0, errors.New("the count of rasps can not be greater than " + strconv.Itoa(MaxRaspBatchSize))
+	}
+	var rasps []*Rasp
+	_, err = mongo.FindAllWithoutLimit(raspCollectionName, bson.M{"app_id": appId, "_id": bson.M{"$in": ids}}, &rasps)
+	if err != nil {
+		return nil, 0, err
+	}
+	found := make(map[string]*Rasp, len(rasps))
+	for _, rasp := range rasps {
+		HandleRasp(rasp)
+		found[rasp.Id] = rasp
+	}
+	results = make([]*RaspRemoveResult, 0, len(ids))
+	offlineIds := make([]string, 0, len(rasps))
+	for _, id := range ids {
+		result := &RaspRemoveResult{Id: id}
+		if rasp, ok := found[id]; !ok {
+			result.Error = "rasp not found"
+		} else if *rasp.Online {
+			result.Error = "unable to delete online rasp"
+		} else {
+			offlineIds = append(offlineIds, id)
+		}
+		results = append(results, result)
+	}
+	if len(offlineIds) == 0 {
+		return results, 0, nil
+	}
+	info, err := mongo.RemoveAll(raspCollectionName,
+		bson.M{"app_id": appId, "_id": bson.M{"$in": offlineIds}, "$where": getOnlineWhere(appId, false, 0)})
+	if err != nil {
+		return nil, 0, err
+	}
+	remaining := make(map[string]bool)
+	if info.Removed < len(offlineIds) {
+		var left []*Rasp
+		_, err = mongo.FindAllWithSelect(raspCollectionName, bson.M{"_id": bson.M{"$in": offlineIds}},
+			&left, bson.M{"_id": 1}, 0, len(offlineIds))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rasp := range left {
+			remaining[rasp.Id] = true
+		}
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			continue
+		}
+		if remaining[result.Id] {
+			result.Error = "unable to delete online rasp"
+		} else {
+			result.Success = true
+		}
+	}
+	return results, info.Removed, nil
+}
+
+var (
+	raspExportBatchSize = 500
+	// MaxRaspTags limits the count of tags added by one request
+	MaxRaspTags = 20
+	// MaxRaspTagGroupSize limits the count of rasps with the tag used to filter the alarms,
+	// because the rasp ids are sent to es in a terms query
+	MaxRaspTagGroupSize = 1000
+)
+
+// AddRaspTags adds the tags to the rasps of the app, the existing tags are not duplicated
+func AddRaspTags(appId string, ids []string, tags []string) (int, error) {
+	info, err := mongo.UpdateAll(raspCollectionName, bson.M{"app_id": appId, "_id": bson.M{"$in": ids}},
+		bson.M{"$addToSet": bson.M{"tags": bson.M{"$each": tags}}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+func RemoveRaspTags(appId string, ids []string, tags []string) (int, error) {
+	info, err := mongo.UpdateAll(raspCollectionName, bson.M{"app_id": appId, "_id": bson.M{"$in": ids}},
+		bson.M{"$pullAll": bson.M{"tags": tags}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+// GetRaspIdsByTag returns the ids of the rasps with the tag, the empty appId means all the apps
+func GetRaspIdsByTag(appId string, tag string) ([]string, error) {
+	query := bson.M{"tags": tag}
+	if appId != "" {
+		query["app_id"] = appId
+	}
+	var rasps []*Rasp
+	count, err := mongo.FindAllWithSelect(raspCollectionName, query, &rasps, bson.M{"_id": 1},
+		0, MaxRaspTagGroupSize)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxRaspTagGroupSize {
+		return nil, errors.New("the count of rasps with the tag " + tag + " can not be greater than " +
+			strconv.Itoa(MaxRaspTagGroupSize))
+	}
+	ids := make([]string, 0, len(rasps))
+	for _, rasp := range rasps {
+		ids = append(ids, rasp.Id)
+	}
+	return ids, nil
+}
+
+// MergeRaspsOfHost deletes the other rasps of the app registered from the same hostname and register_ip,
+// whether they are online or not, so that the containerized agent getting a new id on every restart appears
+// only once, even when it re-registers within the online threshold of the replaced one.
+// The tags of the replaced rasps are moved to the rasp, the description and the owner are kept when the rasp
+// has them, otherwise the most recent non-empty value by the last heartbeat time of the replaced rasps is used
+func MergeRaspsOfHost(rasp *Rasp) (merged []*Rasp, err error) {
+	if rasp.HostName == "" || rasp.RegisterIp == "" {
+		return nil, nil
+	}
+	_, err = mongo.FindAllWithoutLimit(raspCollectionName, bson.M{
+		"app_id":      rasp.AppId,
+		"hostname":    rasp.HostName,
+		"register_ip": rasp.RegisterIp,
+		"_id":         bson.M{"$ne": rasp.Id},
+	}, &merged, "-last_heartbeat_time", "-register_time", "_id")
+	if err != nil || len(merged) == 0 {
+		return nil, err
+	}
+	current, err := GetRaspById(rasp.Id)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(merged))
+	tags := make([]string, 0)
+	annotation := bson.M{}
+	for _, old := range merged {
+		ids = append(ids, old.Id)
+		tags = append(tags, old.Tags...)
+		if _, ok := annotation["description"]; !ok && current.Description == "" && old.Description != "" {
+			annotation["description"] = old.Description
+		}
+		if _, ok := annotation["owner"]; !ok && current.Owner == "" && old.Owner != "" {
+			annotation["owner"] = old.Owner
+		}
+	}
+	if len(tags) > 0 {
+		_, err = AddRaspTags(rasp.AppId, []string{rasp.Id}, tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(annotation) > 0 {
+		err = mongo.UpdateId(raspCollectionName, rasp.Id, annotation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = mongo.RemoveAll(raspCollectionName, bson.M{"app_id": rasp.AppId, "_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	beego.Info("merged the rasps [" + strings.Join(ids, ",") + "] of host " + rasp.HostName + "/" +
+		rasp.RegisterIp + " into the new rasp " + rasp.Id)
+	return merged, nil
+}
+
+// UpdateRaspAnnotation updates the description and the owner of the rasp, the nil value is not changed
+func UpdateRaspAnnotation(id string, description *string, owner *string) error {
+	doc := bson.M{}
+	if description != nil {
+		doc["description"] = *description
+	}
+	if owner != nil {
+		doc["owner"] = *owner
+	}
+	if len(doc) == 0 {
+		return nil
+	}
+	return mongo.UpdateId(raspCollectionName, id, doc)
+}
@@ -0,0 +1,92 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"github.com/astaxie/beego"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/conf"
+	"rasp-cloud/mongo"
+	"strconv"
+	"time"
+)
+
+const raspCleanupOperator = "system"
+
+func startRaspCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			CleanupOfflineRasps()
+		}
+	}
+}
+
+// GetRaspCleanupDays returns the days after which the offline rasps of the app are deleted,
+// the app inherits the RaspCleanupDays config when it is not set, 0 means never
+func GetRaspCleanupDays(app *App) int {
+	if app.RaspCleanupDays != nil {
+		return *app.RaspCleanupDays
+	}
+	return conf.AppConfig.RaspCleanupDays
+}
+
+// CleanupOfflineRasps deletes the rasps offline for more than the cleanup days of each app,
+// the deleted rasp is registered again as a new one when it comes back
+func CleanupOfflineRasps() {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to clean up offline rasps: ", r)
+		}
+	}()
+	var apps []*App
+	_, err := mongo.FindAllWithSelect(appCollectionName, nil, &apps,
+		bson.M{"_id": 1, "name": 1, "rasp_cleanup_days": 1}, 0, 0)
+	if err != nil {
+		beego.Error("failed to get apps for the rasp cleanup: " + err.Error())
+		return
+	}
+	for _, app := range apps {
+		days := GetRaspCleanupDays(app)
+		if days <= 0 {
+			continue
+		}
+		removed, err := cleanupOfflineRaspsOfApp(app.Id, days)
+		if err != nil {
+			beego.Error("failed to clean up offline rasps of app " + app.Name + ": " + err.Error())
+		}
+		if removed > 0 {
+			content := "Deleted " + strconv.Itoa(removed) + " RASP agents offline for more than " +
+				strconv.Itoa(days) + " days"
+			beego.Info(content + " of app " + app.Name)
+			AddOperation(app.Id, OperationTypeDeleteRasp, "", content, raspCleanupOperator)
+		}
+	}
+}
+
+func cleanupOfflineRaspsOfApp(appId string, days int) (removed int, err error) {
+	for {
+		ids, err := FindOfflineRaspIds(appId, int64(days)*24*3600, MaxRaspBatchSize)
+		if err != nil || len(ids) == 0 {
+			return removed, err
+		}
+		_, count, err := RemoveRaspByIds(appId, ids)
+		removed += count
+		if err != nil || count == 0 || len(ids) < MaxRaspBatchSize {
+			return removed, err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"rasp-cloud/conf"
+	"strconv"
+	"time"
+)
+
+// the rasp is online when its last heartbeat is within the threshold of its app,
+// the threshold is RaspOnlineFactor times the cloud.heartbeat_interval of the app general config,
+// the app without the interval falls back to the heartbeat_interval reported by each rasp plus 180 seconds
+type onlineThreshold struct {
+	threshold int64
+	loadTime  time.Time
+}
+
+const (
+	HeartbeatIntervalConfigKey = "cloud.heartbeat_interval"
+
+	defaultOnlineThresholdExpr = "this.heartbeat_interval+180"
+)
+
+var (
+	onlineThresholdCacheTime = 30 * time.Second
+	onlineThresholds         = make(chan map[string]*onlineThreshold, 1)
+)
+
+func init() {
+	onlineThresholds <- make(map[string]*onlineThreshold)
+}
+
+// GetHeartbeatInterval returns the cloud.heartbeat_interval of the general config in seconds, 0 if it is not set
+func GetHeartbeatInterval(config map[string]interface{}) int64 {
+	switch value := config[HeartbeatIntervalConfigKey].(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	}
+	return 0
+}
+
+// GetOnlineThreshold returns the online threshold of the app in seconds, 0 means the threshold of each rasp
+// is used, the threshold is cached for onlineThresholdCacheTime
+func GetOnlineThreshold(appId string) int64 {
+	if appId == "" {
+		return 0
+	}
+	thresholds := <-onlineThresholds
+	defer func() {
+		onlineThresholds <- thresholds
+	}()
+	if cached, ok := thresholds[appId]; ok && time.Since(cached.loadTime) < onlineThresholdCacheTime {
+		return cached.threshold
+	}
+	var threshold int64
+	app, err := GetAppByIdWithoutMask(appId)
+	if err == nil && app != nil {
+		threshold = GetHeartbeatInterval(app.GeneralConfig) * int64(conf.AppConfig.RaspOnlineFactor)
+	}
+	thresholds[appId] = &onlineThreshold{threshold: threshold, loadTime: time.Now()}
+	return threshold
+}
+
+func clearOnlineThreshold(appId string) {
+	thresholds := <-onlineThresholds
+	defer func() {
+		onlineThresholds <- thresholds
+	}()
+	delete(thresholds, appId)
+}
+
+func isRaspOnline(rasp *Rasp) bool {
+	threshold := GetOnlineThreshold(rasp.AppId)
+	if threshold <= 0 {
+		threshold = rasp.HeartbeatInterval + 180
+	}
+	return time.Now().Unix()-rasp.LastHeartbeatTime <= threshold
+}
+
+func getOnlineThresholdExpr(appId string) string {
+	if threshold := GetOnlineThreshold(appId); threshold > 0 {
+		return strconv.FormatInt(threshold, 10)
+	}
+	return defaultOnlineThresholdExpr
+}
+
+// getOnlineWhere returns the $where of the online rasps, or the rasps offline for more than expireTime seconds
+func getOnlineWhere(appId string, online bool, expireTime int64) string {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if online {
+		return "this.last_heartbeat_time+" + getOnlineThresholdExpr(appId) + " >= " + now
+	}
+	return "this.last_heartbeat_time+" + getOnlineThresholdExpr(appId) + "+" +
+		strconv.FormatInt(expireTime, 10) + " < " + now
+}
+
+// getOnlineAggrExpr returns the aggregation expression of the time until which the rasp is online
+func getOnlineAggrExpr(appId string) interface{} {
+	if threshold := GetOnlineThreshold(appId); threshold > 0 {
+		return map[string]interface{}{"$add": []interface{}{"$last_heartbeat_time", threshold}}
+	}
+	return map[string]interface{}{"$add": []interface{}{"$last_heartbeat_time", "$heartbeat_interval", 180}}
+}
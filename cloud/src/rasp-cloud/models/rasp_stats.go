@@ -0,0 +1,130 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/mongo"
+	"time"
+)
+
+type RaspStats struct {
+	Total         int             `json:"total"`
+	Online        int             `json:"online"`
+	Offline       int             `json:"offline"`
+	Versions      []*RaspCount    `json:"versions"`
+	Languages     []*RaspCount    `json:"languages"`
+	Registrations []*RaspDayCount `json:"registrations"`
+}
+
+type RaspCount struct {
+	Name  string `json:"name" bson:"_id"`
+	Count int    `json:"count" bson:"count"`
+}
+
+// RaspDayCount is the count of the rasps registered in the day started at Time
+type RaspDayCount struct {
+	Time  int64 `json:"time" bson:"_id"`
+	Count int   `json:"count" bson:"count"`
+}
+
+var (
+	raspStatsDays      = 30
+	raspStatsMaxGroups = 100
+)
+
+// GetRaspStats computes the stats of the rasps of the app in the mongodb with a few aggregations,
+// the online rasps are counted with the online threshold of the app,
+// the registrations of the last 30 days are grouped by the day in the time zone with the offset in seconds
+func GetRaspStats(appId string, zoneOffset int) (*RaspStats, error) {
+	now := time.Now().Unix()
+	stats := &RaspStats{}
+
+	var status []struct {
+		Total  int `bson:"total"`
+		Online int `bson:"online"`
+	}
+	err := mongo.Aggregate(raspCollectionName, []bson.M{
+		{"$match": bson.M{"app_id": appId}},
+		{"$group": bson.M{
+			"_id":   nil,
+			"total": bson.M{"$sum": 1},
+			"online": bson.M{"$sum": bson.M{"$cond": []interface{}{
+				bson.M{"$gte": []interface{}{getOnlineAggrExpr(appId), now}},
+				1, 0,
+			}}},
+		}},
+	}, &status)
+	if err != nil {
+		return nil, err
+	}
+	if len(status) > 0 {
+		stats.Total = status[0].Total
+		stats.Online = status[0].Online
+		stats.Offline = stats.Total - stats.Online
+	}
+
+	stats.Versions, err = countRaspsByField(appId, "version")
+	if err != nil {
+		return nil, err
+	}
+	stats.Languages, err = countRaspsByField(appId, "language")
+	if err != nil {
+		return nil, err
+	}
+	stats.Registrations, err = countRaspRegistrations(appId, now, int64(zoneOffset))
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func countRaspsByField(appId string, field string) ([]*RaspCount, error) {
+	result := make([]*RaspCount, 0)
+	err := mongo.Aggregate(raspCollectionName, []bson.M{
+		{"$match": bson.M{"app_id": appId}},
+		{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+		{"$limit": raspStatsMaxGroups},
+	}, &result)
+	return result, err
+}
+
+func countRaspRegistrations(appId string, now int64, zoneOffset int64) ([]*RaspDayCount, error) {
+	const day = 24 * 3600
+	today := now - (now+zoneOffset)%day
+	startTime := today - int64(raspStatsDays-1)*day
+	var counts []*RaspDayCount
+	err := mongo.Aggregate(raspCollectionName, []bson.M{
+		{"$match": bson.M{"app_id": appId, "register_time": bson.M{"$gte": startTime}}},
+		{"$group": bson.M{
+			"_id": bson.M{"$subtract": []interface{}{"$register_time",
+				bson.M{"$mod": []interface{}{bson.M{"$add": []interface{}{"$register_time", zoneOffset}}, day}}}},
+			"count": bson.M{"$sum": 1},
+		}},
+	}, &counts)
+	if err != nil {
+		return nil, err
+	}
+	countOfDay := make(map[int64]int, len(counts))
+	for _, count := range counts {
+		countOfDay[count.Time] = count.Count
+	}
+	result := make([]*RaspDayCount, 0, raspStatsDays)
+	for t := startTime; t <= today; t += day {
+		result = append(result, &RaspDayCount{Time: t, Count: countOfDay[t]})
+	}
+	return result, nil
+}
@@ -16,9 +16,9 @@ package models
 
 import (
 	"rasp-cloud/es"
+	"rasp-cloud/conf"
 	"time"
 	"github.com/olivere/elastic"
-	"context"
 )
 
 type ReportData struct {
@@ -29,27 +29,40 @@ type ReportData struct {
 }
 
 var (
-	ReportIndexName      = "openrasp-report-data"
-	AliasReportIndexName = "real-openrasp-report-data"
-	reportType           = "report-data"
+	ReportIndexName = "openrasp-report-data"
+	reportType      = "report-data"
+	reportProcessor *es.BulkProcessor
 )
 
 func init() {
-	es.RegisterTTL(24*100*time.Hour, AliasReportIndexName+"-*")
+	es.RegisterTTL(24*100*time.Hour, ReportIndexName+"-*")
+	es.RegisterRollover(ReportIndexName, conf.AppConfig.EsReportRetention)
+	reportProcessor = es.NewBulkProcessor(reportType, conf.AppConfig.AlarmBufferSize)
 }
 
 func CreateReportDataEsIndex(appId string) error {
 	return es.CreateEsIndex(ReportIndexName + "-" + appId)
 }
 
+func RemoveReportDataEsIndex(appId string) error {
+	_, err := es.DeleteAppIndex(ReportIndexName, appId)
+	return err
+}
+
 func AddReportData(reportData *ReportData, appId string) error {
 	reportData.InsertTime = time.Now().Unix() * 1000
-	return es.Insert(AliasReportIndexName+"-"+appId, reportType, reportData)
+	return reportProcessor.Add(map[string]interface{}{
+		"app_id":      appId,
+		"rasp_id":     reportData.RaspId,
+		"time":        reportData.Time,
+		"request_sum": reportData.RequestSum,
+		"@timestamp":  reportData.InsertTime,
+	})
 }
 
 func GetHistoryRequestSum(startTime int64, endTime int64, interval string, timeZone string,
 	appId string) (error, []map[string]interface{}) {
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	ctx, cancel := es.SearchContext(es.ContextAggregation)
 	defer cancel()
 	timeAggrName := "aggr_time"
 	sumAggrName := "request_sum"
@@ -58,7 +71,12 @@ func GetHistoryRequestSum(startTime int64, endTime int64, interval string, timeZ
 	requestSumAggr := elastic.NewSumAggregation().Field("request_sum")
 	timeAggr.SubAggregation(sumAggrName, requestSumAggr)
 	timeQuery := elastic.NewRangeQuery("time").Gte(startTime).Lte(endTime)
-	aggrResult, err := es.ElasticClient.Search(AliasReportIndexName + "-" + appId).
+	index, err := es.GetSearchIndex(ReportIndexName, appId)
+	if err != nil {
+		return err, nil
+	}
+	aggrResult, err := es.ElasticClient.Search(index).
+		IgnoreUnavailable(true).
 		Query(timeQuery).
 		Aggregation(timeAggrName, timeAggr).
 		Size(0).
@@ -0,0 +1,125 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"github.com/astaxie/beego"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/mongo"
+	"strconv"
+	"time"
+)
+
+// AppRetention is the days for which the data of the app is kept, 0 means the data is kept until the ttl
+// of the index, which is 365 days for the alarms
+type AppRetention struct {
+	AttackAlarmDays int `json:"attack_alarm_days" bson:"attack_alarm_days"`
+	PolicyAlarmDays int `json:"policy_alarm_days" bson:"policy_alarm_days"`
+	ErrorAlarmDays  int `json:"error_alarm_days" bson:"error_alarm_days"`
+}
+
+const MaxRetentionDays = 365
+
+var (
+	// the apps are handled one by one with the interval, so that the deletions do not hit es at the same time
+	retentionAppInterval = time.Minute
+	retentionRunning     = make(chan struct{}, 1)
+)
+
+// startDataRetention applies the retention once at startup and then every interval, the runs are started
+// in background so that the ticker is never blocked by the interval between the apps
+func startDataRetention(interval time.Duration) {
+	go runDataRetention()
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			go runDataRetention()
+		}
+	}
+}
+
+// runDataRetention is skipped when the last run is not finished yet
+func runDataRetention() {
+	select {
+	case retentionRunning <- struct{}{}:
+	default:
+		beego.Warning("the last data retention is still running, skip this run")
+		return
+	}
+	defer func() {
+		<-retentionRunning
+	}()
+	applyDataRetention(retentionAppInterval)
+}
+
+func (r *AppRetention) alarmDays() map[string]int {
+	return map[string]int{
+		logs.AttackAlarmInfo.EsType: r.AttackAlarmDays,
+		logs.PolicyAlarmInfo.EsType: r.PolicyAlarmDays,
+		logs.ErrorAlarmInfo.EsType:  r.ErrorAlarmDays,
+	}
+}
+
+// ApplyDataRetention deletes the data out of the retention of every app
+func ApplyDataRetention() {
+	applyDataRetention(0)
+}
+
+func applyDataRetention(appInterval time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			beego.Error("failed to apply data retention: ", r)
+		}
+	}()
+	var apps []*App
+	_, err := mongo.FindAllWithSelect(appCollectionName, bson.M{"retention": bson.M{"$exists": true}}, &apps,
+		bson.M{"_id": 1, "name": 1, "retention": 1}, 0, 0)
+	if err != nil {
+		beego.Error("failed to get apps for the data retention: " + err.Error())
+		return
+	}
+	applied := 0
+	for _, app := range apps {
+		if app.Retention == nil {
+			continue
+		}
+		if applied > 0 {
+			time.Sleep(appInterval)
+		}
+		applyRetentionOfApp(app)
+		applied++
+	}
+}
+
+func applyRetentionOfApp(app *App) {
+	for esType, days := range app.Retention.alarmDays() {
+		if days <= 0 {
+			continue
+		}
+		deleted, taskId, err := logs.RemoveExpiredAlarms(esType, app.Id, days)
+		if err != nil {
+			beego.Error("failed to delete " + esType + " of app " + app.Name + " out of the retention: " +
+				err.Error())
+		} else if taskId != "" {
+			beego.Info("start to delete " + esType + " of app " + app.Name + " older than " +
+				strconv.Itoa(days) + " days in background, task: " + taskId)
+		} else {
+			beego.Info("delete " + esType + " of app " + app.Name + " older than " + strconv.Itoa(days) +
+				" days, total: " + strconv.FormatInt(deleted, 10))
+		}
+	}
+}
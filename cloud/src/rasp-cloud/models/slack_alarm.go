@@ -0,0 +1,195 @@
+//Copyright 2017-2019 Baidu Inc.
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//http: //www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/astaxie/beego"
+	"net/http"
+	"net/url"
+	"rasp-cloud/models/logs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlackAlarmConf pushes the alarms to the slack incoming webhook, the channel overrides the default channel
+// of the webhook, the mentions are the slack user ids, here or channel
+type SlackAlarmConf struct {
+	Enable     bool     `json:"enable" bson:"enable"`
+	WebhookUrl string   `json:"webhook_url" bson:"webhook_url"`
+	Channel    string   `json:"channel" bson:"channel"`
+	Mentions   []string `json:"mentions" bson:"mentions"`
+}
+
+type slackMessage struct {
+	Channel     string             `json:"channel,omitempty"`
+	Text        string             `json:"text"`
+	Attachments []*slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color    string        `json:"color"`
+	Title    string        `json:"title"`
+	Fallback string        `json:"fallback"`
+	Fields   []*slackField `json:"fields"`
+	Ts       int64         `json:"ts,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+const (
+	slackColorDanger  = "danger"
+	slackColorWarning = "warning"
+)
+
+var (
+	slackMaxAttachments = 10
+	slackRetryBaseWait  = time.Second
+	// the alarms are pushed in the alarm ticker, which is at least 10 seconds,
+	// so the total wait of the retries is kept well below it
+	slackRetryTotalWait = 5 * time.Second
+)
+
+func (c *SlackAlarmConf) Valid() error {
+	webhookUrl, err := url.Parse(c.WebhookUrl)
+	if err != nil || (webhookUrl.Scheme != "https" && webhookUrl.Scheme != "http") || webhookUrl.Host == "" {
+		return errors.New("the slack webhook_url must be a http or https url")
+	}
+	return nil
+}
+
+func PushSlackAttackAlarm(app *App, total int64, alarms []map[string]interface{}, isTest bool) error {
+	conf := app.SlackAlarmConf
+	if conf.WebhookUrl == "" {
+		return handleError("failed to send slack alarm: the slack webhook_url can not be empty")
+	}
+	if isTest {
+		alarms = getTestAlarmData()
+		total = int64(len(alarms))
+	}
+	content, err := json.Marshal(formatSlackMessage(app, total, alarms))
+	if err != nil {
+		return handleError("failed to encode slack alarm: " + err.Error())
+	}
+	err = sendSlackMessage(conf.WebhookUrl, content)
+	if err != nil {
+		return handleError("failed to push slack alarm for app " + app.Name + ": " + err.Error())
+	}
+	beego.Debug("succeed in pushing slack alarm for app: " + app.Name)
+	return nil
+}
+
+func formatSlackMessage(app *App, total int64, alarms []map[string]interface{}) *slackMessage {
+	mentions := make([]string, 0, len(app.SlackAlarmConf.Mentions))
+	for _, mention := range app.SlackAlarmConf.Mentions {
+		if mention == "here" || mention == "channel" {
+			mentions = append(mentions, "<!"+mention+">")
+		} else {
+			mentions = append(mentions, "<@"+mention+">")
+		}
+	}
+	text := "OpenRASP: " + strconv.FormatInt(total, 10) + " attack alarms of app " + app.Name
+	if len(alarms) > slackMaxAttachments {
+		text += ", the latest " + strconv.Itoa(slackMaxAttachments) + " are shown"
+		alarms = alarms[:slackMaxAttachments]
+	}
+	if len(mentions) > 0 {
+		text = strings.Join(mentions, " ") + " " + text
+	}
+	message := &slackMessage{
+		Channel:     app.SlackAlarmConf.Channel,
+		Text:        text,
+		Attachments: make([]*slackAttachment, 0, len(alarms)),
+	}
+	for _, alarm := range alarms {
+		message.Attachments = append(message.Attachments, formatSlackAttackAlarm(alarm))
+	}
+	return message
+}
+
+// the alarms may be translated by the other channels before, so both the raw and the translated values are handled
+func formatSlackAttackAlarm(alarm map[string]interface{}) *slackAttachment {
+	attackType := getSlackAlarmValue(alarm, "attack_type")
+	if name, ok := logs.AttackTypeMap[alarm["attack_type"]]; ok {
+		attackType = name
+	}
+	interceptState := getSlackAlarmValue(alarm, "intercept_state")
+	color := slackColorWarning
+	if interceptState == "block" || interceptState == logs.AttackInterceptMap["block"] {
+		color = slackColorDanger
+	}
+	if name, ok := logs.AttackInterceptMap[alarm["intercept_state"]]; ok {
+		interceptState = name
+	}
+	return &slackAttachment{
+		Color:    color,
+		Title:    attackType,
+		Fallback: attackType + " " + getSlackAlarmValue(alarm, "url"),
+		Fields: []*slackField{
+			{Title: "URL", Value: getSlackAlarmValue(alarm, "url")},
+			{Title: "Attack Source", Value: getSlackAlarmValue(alarm, "attack_source"), Short: true},
+			{Title: "Intercept State", Value: interceptState, Short: true},
+			{Title: "Event Time", Value: getSlackAlarmValue(alarm, "event_time"), Short: true},
+		},
+	}
+}
+
+func getSlackAlarmValue(alarm map[string]interface{}, key string) string {
+	if value, ok := alarm[key]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return "-"
+}
+
+// sendSlackMessage retries with backoff when the slack returns 429 or 5xx, the Retry-After of 429 is honored,
+// the message is given up when the total wait would exceed slackRetryTotalWait
+func sendSlackMessage(webhookUrl string, content []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	wait := slackRetryBaseWait
+	var totalWait time.Duration
+	for {
+		response, err := client.Post(webhookUrl, "application/json", bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 200 && response.StatusCode <= 299 {
+			return nil
+		}
+		statusErr := errors.New("unexpected status code " + strconv.Itoa(response.StatusCode))
+		if response.StatusCode != http.StatusTooManyRequests && response.StatusCode < 500 {
+			return statusErr
+		}
+		if response.StatusCode == http.StatusTooManyRequests {
+			if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		if totalWait+wait > slackRetryTotalWait {
+			return statusErr
+		}
+		time.Sleep(wait)
+		totalWait += wait
+		wait *= 2
+	}
+}
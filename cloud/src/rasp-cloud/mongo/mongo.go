@@ -131,6 +131,19 @@ func FindAllWithSelect(collection string, query interface{}, result interface{},
 	return
 }
 
+// Iterate walks the documents matched by the query with fn, the documents are fetched in batches
+func Iterate(collection string, query interface{}, batchSize int, fn func(iter *mgo.Iter) error,
+	sortFields ...string) error {
+	newSession := NewSession()
+	defer newSession.Close()
+	iter := newSession.DB(DbName).C(collection).Find(query).Sort(sortFields...).Batch(batchSize).Iter()
+	err := fn(iter)
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func FindId(collection string, id string, result interface{}) error {
 	newSession := NewSession()
 	defer newSession.Close()
@@ -160,6 +173,13 @@ func UpdateId(collection string, id interface{}, doc interface{}) error {
 	return newSession.DB(DbName).C(collection).UpdateId(id, bson.M{"$set": doc})
 }
 
+// UpdateAll applies the update with the operators such as $addToSet to all the matched documents
+func UpdateAll(collection string, selector interface{}, update interface{}) (*mgo.ChangeInfo, error) {
+	newSession := NewSession()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).UpdateAll(selector, update)
+}
+
 func RemoveId(collection string, id interface{}) error {
 	newSession := NewSession()
 	defer newSession.Close()
@@ -172,8 +192,27 @@ func RemoveAll(collection string, selector interface{}) (*mgo.ChangeInfo, error)
 	return newSession.DB(DbName).C(collection).RemoveAll(selector)
 }
 
+func Aggregate(collection string, pipeline interface{}, result interface{}) error {
+	newSession := NewSession()
+	defer newSession.Close()
+	return newSession.DB(DbName).C(collection).Pipe(pipeline).AllowDiskUse().All(result)
+}
+
 func GenerateObjectId() string {
 	random := string(bson.NewObjectId()) +
 		strconv.FormatInt(time.Now().UnixNano(), 10) + strconv.Itoa(rand.Intn(10000))
 	return fmt.Sprintf("%x", sha1.Sum([]byte(random)))
 }
+
+// Ping checks the connectivity of MongoDB and returns its version
+func Ping(timeout time.Duration) (string, error) {
+	newSession := NewSession()
+	defer newSession.Close()
+	newSession.SetSyncTimeout(timeout)
+	newSession.SetSocketTimeout(timeout)
+	info, err := newSession.BuildInfo()
+	if err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
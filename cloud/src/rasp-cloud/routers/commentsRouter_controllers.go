@@ -16,4 +16,13 @@ func init() {
             Filters: nil,
             Params: nil})
 
+    beego.GlobalControllerRouter["rasp-cloud/controllers:SystemController"] = append(beego.GlobalControllerRouter["rasp-cloud/controllers:SystemController"],
+        beego.ControllerComments{
+            Method: "Health",
+            Router: `/health`,
+            AllowHTTPMethods: []string{"get"},
+            MethodParams: param.Make(),
+            Filters: nil,
+            Params: nil})
+
 }
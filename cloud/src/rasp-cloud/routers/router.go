@@ -117,8 +117,9 @@ func InitRouter() {
 	)
 	userNS := beego.NewNamespace("/user", beego.NSInclude(&api.UserController{}))
 	pingNS := beego.NewNamespace("/ping", beego.NSInclude(&controllers.PingController{}))
+	systemNS := beego.NewNamespace("/system", beego.NSInclude(&controllers.SystemController{}))
 	ns := beego.NewNamespace("/v1")
-	ns.Namespace(pingNS)
+	ns.Namespace(pingNS, systemNS)
 	startType := *conf.AppConfig.Flag.StartType
 	if startType == conf.StartTypeForeground {
 		ns.Namespace(foregroudNS, userNS)
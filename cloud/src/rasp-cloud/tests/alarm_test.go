@@ -20,6 +20,7 @@ import (
 	"rasp-cloud/models/logs"
 	"errors"
 	"rasp-cloud/mongo"
+	"rasp-cloud/tests/inits"
 )
 
 type writerCloser struct {
@@ -258,3 +259,82 @@ func TestAlarmDetect(t *testing.T) {
 		})
 	})
 }
+
+func TestAlarmDedup(t *testing.T) {
+	Convey("Subject: Test Alarm Dedup\n", t, func() {
+		type pushRecord struct {
+			total  int64
+			alarms int
+		}
+		records := make([]pushRecord, 0)
+		monkey.Patch(models.PushHttpAttackAlarm,
+			func(app *models.App, total int64, alarms []map[string]interface{}, isTest bool) error {
+				records = append(records, pushRecord{total, len(alarms)})
+				return nil
+			})
+		defer monkey.Unpatch(models.PushHttpAttackAlarm)
+		app := &models.App{
+			Id:             "dedup_" + time.Now().Format("20060102150405.000000"),
+			HttpAlarmConf:  models.HttpAlarmConf{Enable: true},
+			AlarmDedupConf: &models.AlarmDedupConf{Window: 3600},
+		}
+		first := map[string]interface{}{"attack_type": "sql", "url": "http://a.example.com/", "attack_source": "1.1.1.1"}
+		second := map[string]interface{}{"attack_type": "xss", "url": "http://a.example.com/", "attack_source": "1.1.1.1"}
+		third := map[string]interface{}{"attack_type": "sql", "url": "http://b.example.com/", "attack_source": "1.1.1.1"}
+
+		Convey("when the duplicated alarms are in the window", func() {
+			models.PushAttackAlarm(app, 2, []map[string]interface{}{first, second}, false)
+			So(records, ShouldResemble, []pushRecord{{2, 2}})
+
+			models.PushAttackAlarm(app, 5, []map[string]interface{}{first, second}, false)
+			So(len(records), ShouldEqual, 1)
+
+			models.PushAttackAlarm(app, 3, []map[string]interface{}{first, third}, false)
+			So(records, ShouldResemble, []pushRecord{{2, 2}, {8, 1}})
+		})
+
+		Convey("when the push is failed", func() {
+			monkey.Patch(models.PushHttpAttackAlarm,
+				func(app *models.App, total int64, alarms []map[string]interface{}, isTest bool) error {
+					records = append(records, pushRecord{total, len(alarms)})
+					return errors.New("the receiver is down")
+				})
+			models.PushAttackAlarm(app, 1, []map[string]interface{}{first}, false)
+			models.PushAttackAlarm(app, 1, []map[string]interface{}{first}, false)
+			So(records, ShouldResemble, []pushRecord{{1, 1}, {1, 1}})
+		})
+
+		Convey("when the fingerprint fields are configured", func() {
+			app.AlarmDedupConf.Fields = []string{"attack_source"}
+			models.PushAttackAlarm(app, 1, []map[string]interface{}{first}, false)
+			models.PushAttackAlarm(app, 1, []map[string]interface{}{third}, false)
+			So(records, ShouldResemble, []pushRecord{{1, 1}})
+		})
+
+		Convey("when the dedup window is 0", func() {
+			app.AlarmDedupConf.Window = 0
+			models.PushAttackAlarm(app, 1, []map[string]interface{}{first}, false)
+			models.PushAttackAlarm(app, 1, []map[string]interface{}{first}, false)
+			So(len(records), ShouldEqual, 2)
+		})
+
+		Convey("when the dedup config is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/alarm/config", inits.GetJson(map[string]interface{}{
+				"app_id":           start.TestApp.Id,
+				"alarm_dedup_conf": map[string]interface{}{"window": -1},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = inits.GetResponse("POST", "/v1/api/app/alarm/config", inits.GetJson(map[string]interface{}{
+				"app_id":           start.TestApp.Id,
+				"alarm_dedup_conf": map[string]interface{}{"window": 60, "fields": []string{""}},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = inits.GetResponse("POST", "/v1/api/app", inits.GetJson(map[string]interface{}{
+				"name":             "dedup_app",
+				"language":         "java",
+				"alarm_dedup_conf": map[string]interface{}{"window": models.MaxAlarmDedupWindow + 1},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
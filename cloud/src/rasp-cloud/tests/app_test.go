@@ -12,6 +12,16 @@ import (
 	"rasp-cloud/tests/start"
 	"rasp-cloud/mongo"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"rasp-cloud/models/logs"
+	"crypto/hmac"
+	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 )
 
 func getValidApp() map[string]interface{} {
@@ -294,6 +304,73 @@ func TestRegenerateSecrete(t *testing.T) {
 	})
 }
 
+func TestRotateSecret(t *testing.T) {
+	Convey("Subject: Test App Rotate Secret Api\n", t, func() {
+
+		Convey("when app_id is empty", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/secret/rotate", inits.GetJson(map[string]interface{}{
+				"app_id": "",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when grace_period is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/secret/rotate", inits.GetJson(map[string]interface{}{
+				"app_id":       start.TestApp.Id,
+				"grace_period": -1,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = inits.GetResponse("POST", "/v1/api/app/secret/rotate", inits.GetJson(map[string]interface{}{
+				"app_id":       start.TestApp.Id,
+				"grace_period": 30*24*3600 + 1,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the old secret is kept for the grace period", func() {
+			oldApp, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			r := inits.GetResponse("POST", "/v1/api/app/secret/rotate", inits.GetJson(map[string]interface{}{
+				"app_id":       start.TestApp.Id,
+				"grace_period": 3600,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["old_secret_expire_time"], ShouldBeGreaterThan, float64(time.Now().Unix()))
+
+			app, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			So(app.Secret, ShouldEqual, data["secret"])
+			So(app.OldSecret, ShouldEqual, oldApp.Secret)
+			So(models.IsValidSecret(app, app.Secret), ShouldBeTrue)
+			So(models.IsValidSecret(app, oldApp.Secret), ShouldBeTrue)
+			So(models.IsValidSecret(app, ""), ShouldBeFalse)
+			So(models.IsValidSecret(app, "invalid"), ShouldBeFalse)
+
+			app.OldSecretExpireTime = time.Now().Unix() - 1
+			So(models.IsValidSecret(app, oldApp.Secret), ShouldBeFalse)
+
+			detail, err := models.GetAppById(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			So(detail.OldSecretExpireTime, ShouldEqual, int64(data["old_secret_expire_time"].(float64)))
+		})
+
+		Convey("when the secret is rotated without the grace period", func() {
+			oldApp, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			r := inits.GetResponse("POST", "/v1/api/app/secret/rotate", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			app, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			So(models.IsValidSecret(app, oldApp.Secret), ShouldBeFalse)
+			So(models.IsValidSecret(app, app.Secret), ShouldBeTrue)
+			So(app.OldSecretExpireTime, ShouldEqual, 0)
+		})
+	})
+}
+
 func TestConfigGenerate(t *testing.T) {
 	Convey("Subject: Test App Generate Config Api\n", t, func() {
 
@@ -1399,3 +1476,315 @@ func TestTestHttp(t *testing.T) {
 
 	})
 }
+
+func TestCloneApp(t *testing.T) {
+	Convey("Subject: Test Clone App Api\n", t, func() {
+
+		Convey("when app_id is empty", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": "",
+				"name":   "test_clone",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when name is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"name":   "",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"name":   inits.GetLongString(65),
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the source app doesn't exist", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": "0000000000000000000",
+				"name":   "test_clone",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the name is used by another app", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"name":   start.TestApp.Name,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the plugin fails to be copied", func() {
+			monkey.Patch(models.SetSelectedPlugin, func(appId string, pluginId string) (*models.Plugin, error) {
+				return nil, errors.New("mongo is down")
+			})
+			defer monkey.Unpatch(models.SetSelectedPlugin)
+			name := "test_clone_" + time.Now().String()
+			r := inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"name":   name,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			var apps []*models.App
+			_, err := mongo.FindAllWithoutLimit("app", bson.M{"name": name}, &apps)
+			So(err, ShouldEqual, nil)
+			So(len(apps), ShouldEqual, 0)
+		})
+
+		Convey("when param is valid", func() {
+			name := "test_clone_" + time.Now().String()
+			r := inits.GetResponse("POST", "/v1/api/app/clone", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"name":   name,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			appId := data["id"].(string)
+			defer models.RemovePluginByAppId(appId)
+			defer mongo.RemoveId("app", appId)
+
+			source, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			app, err := models.GetAppByIdWithoutMask(appId)
+			So(err, ShouldEqual, nil)
+			So(app.Name, ShouldEqual, name)
+			So(app.Id, ShouldNotEqual, source.Id)
+			So(app.Secret, ShouldNotEqual, source.Secret)
+			So(app.Language, ShouldEqual, source.Language)
+			So(app.GeneralConfig, ShouldResemble, source.GeneralConfig)
+			So(app.EmailAlarmConf, ShouldResemble, source.EmailAlarmConf)
+			So(app.SelectedPluginId, ShouldNotEqual, source.SelectedPluginId)
+
+			sourcePlugin, err := models.GetPluginById(source.SelectedPluginId, true)
+			So(err, ShouldEqual, nil)
+			plugin, err := models.GetPluginById(app.SelectedPluginId, true)
+			So(err, ShouldEqual, nil)
+			So(plugin.AppId, ShouldEqual, appId)
+			So(plugin.Md5, ShouldEqual, sourcePlugin.Md5)
+			So(plugin.AlgorithmConfig, ShouldResemble, sourcePlugin.AlgorithmConfig)
+		})
+	})
+}
+
+func TestAppRetention(t *testing.T) {
+	Convey("Subject: Test App Data Retention\n", t, func() {
+		defer mongo.UpdateAll("app", bson.M{"_id": start.TestApp.Id}, bson.M{"$unset": bson.M{"retention": 1}})
+		app, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+		So(err, ShouldEqual, nil)
+		getParam := func(retention map[string]interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"app_id":      app.Id,
+				"language":    app.Language,
+				"name":        app.Name,
+				"description": app.Description,
+				"retention":   retention,
+			}
+		}
+
+		Convey("when the retention days are invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/config", inits.GetJson(getParam(map[string]interface{}{
+				"attack_alarm_days": -1,
+			})))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = inits.GetResponse("POST", "/v1/api/app/config", inits.GetJson(getParam(map[string]interface{}{
+				"error_alarm_days": models.MaxRetentionDays + 1,
+			})))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the retention is applied", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/config", inits.GetJson(getParam(map[string]interface{}{
+				"attack_alarm_days": 365,
+				"error_alarm_days":  7,
+			})))
+			So(r.Status, ShouldEqual, 0)
+
+			removed := make(map[string]int)
+			monkey.Patch(logs.RemoveExpiredAlarms, func(esType string, appId string, days int) (int64, string, error) {
+				if appId == app.Id {
+					removed[esType] = days
+				}
+				return 1, "", nil
+			})
+			defer monkey.Unpatch(logs.RemoveExpiredAlarms)
+			models.ApplyDataRetention()
+			So(removed, ShouldResemble, map[string]int{"attack-alarm": 365, "error-alarm": 7})
+		})
+	})
+}
+
+// verifyHttpAlarm is the example of the verification on the receiver of the signed http alarms
+func verifyHttpAlarm(secret string, r *http.Request, body []byte, window time.Duration) bool {
+	timestamp := r.Header.Get("X-OpenRASP-Timestamp")
+	sendTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sendTime, 0)) > window {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-OpenRASP-Signature")))
+}
+
+func TestHttpAlarmSignature(t *testing.T) {
+	Convey("Subject: Test Http Alarm Signature\n", t, func() {
+		var (
+			verified  bool
+			signature string
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			signature = r.Header.Get("X-OpenRASP-Signature")
+			verified = verifyHttpAlarm("test-secret", r, body, 5*time.Minute)
+		}))
+		defer server.Close()
+		app := &models.App{
+			Id:            start.TestApp.Id,
+			HttpAlarmConf: models.HttpAlarmConf{Enable: true, RecvAddr: []string{server.URL}},
+		}
+
+		Convey("when the sign secret is empty", func() {
+			err := models.PushHttpAttackAlarm(app, 0, nil, true)
+			So(err, ShouldEqual, nil)
+			So(signature, ShouldEqual, "")
+			So(verified, ShouldBeFalse)
+		})
+
+		Convey("when the sign secret is set", func() {
+			app.HttpAlarmConf.SignSecret = "test-secret"
+			err := models.PushHttpAttackAlarm(app, 0, nil, true)
+			So(err, ShouldEqual, nil)
+			So(verified, ShouldBeTrue)
+		})
+
+		Convey("when the signature is computed", func() {
+			body := []byte(`{"app_id":"test"}`)
+			So(models.SignHttpAlarm("a", "1", body), ShouldNotEqual, models.SignHttpAlarm("a", "2", body))
+			So(models.SignHttpAlarm("a", "1", body), ShouldNotEqual, models.SignHttpAlarm("b", "1", body))
+		})
+
+		Convey("when the sign secret is masked in the response", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/alarm/config", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"http_alarm_conf": map[string]interface{}{
+					"enable":      false,
+					"recv_addr":   []string{"http://alarm.example.com"},
+					"sign_secret": "test-secret",
+				},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["http_alarm_conf"].(map[string]interface{})["sign_secret"], ShouldEqual, models.SecreteMask)
+
+			r = inits.GetResponse("POST", "/v1/api/app/alarm/config", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"http_alarm_conf": map[string]interface{}{
+					"enable":      false,
+					"recv_addr":   []string{"http://alarm.example.com"},
+					"sign_secret": models.SecreteMask,
+				},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			app, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			So(app.HttpAlarmConf.SignSecret, ShouldEqual, "test-secret")
+		})
+	})
+}
+
+func TestSlackAlarm(t *testing.T) {
+	Convey("Subject: Test Slack Alarm\n", t, func() {
+		var (
+			count    int
+			messages []map[string]interface{}
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count++
+			if count == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			var message map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&message)
+			messages = append(messages, message)
+		}))
+		defer server.Close()
+		app := &models.App{
+			Id:   start.TestApp.Id,
+			Name: "test_app",
+			SlackAlarmConf: models.SlackAlarmConf{
+				Enable:     true,
+				WebhookUrl: server.URL,
+				Channel:    "#security",
+				Mentions:   []string{"U123", "here"},
+			},
+		}
+
+		Convey("when the alarms are pushed after 429", func() {
+			alarms := []map[string]interface{}{
+				{"attack_type": "sql", "intercept_state": "block", "url": "http://www.example.com/?id=1"},
+			}
+			err := models.PushSlackAttackAlarm(app, 1, alarms, false)
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 2)
+			So(len(messages), ShouldEqual, 1)
+			So(messages[0]["channel"], ShouldEqual, "#security")
+			So(messages[0]["text"], ShouldStartWith, "<@U123> <!here> ")
+			attachments := messages[0]["attachments"].([]interface{})
+			So(len(attachments), ShouldEqual, 1)
+			So(attachments[0].(map[string]interface{})["color"], ShouldEqual, "danger")
+		})
+
+		Convey("when the slack keeps returning 429", func() {
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				count++
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+			})
+			err := models.PushSlackAttackAlarm(app, 1, []map[string]interface{}{{}}, false)
+			So(err, ShouldNotEqual, nil)
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("when the slack config is invalid", func() {
+			for _, conf := range []map[string]interface{}{
+				{"enable": true, "webhook_url": "ftp://hooks.slack.com/a"},
+				{"enable": true, "webhook_url": "https://hooks.slack.com/a", "channel": inits.GetLongString(129)},
+			} {
+				r := inits.GetResponse("POST", "/v1/api/app/alarm/config", inits.GetJson(map[string]interface{}{
+					"app_id":           start.TestApp.Id,
+					"slack_alarm_conf": conf,
+				}))
+				So(r.Status, ShouldBeGreaterThan, 0)
+			}
+		})
+
+		Convey("when the webhook url is masked in the response", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/alarm/config", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"slack_alarm_conf": map[string]interface{}{
+					"enable":      false,
+					"webhook_url": "https://hooks.slack.com/services/T/B/secret",
+				},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["slack_alarm_conf"].(map[string]interface{})["webhook_url"], ShouldEqual, models.SecreteMask)
+			app, err := models.GetAppByIdWithoutMask(start.TestApp.Id)
+			So(err, ShouldEqual, nil)
+			So(app.SlackAlarmConf.WebhookUrl, ShouldEqual, "https://hooks.slack.com/services/T/B/secret")
+		})
+
+		Convey("when the slack alarm is tested without enabling it", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/slack/test", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
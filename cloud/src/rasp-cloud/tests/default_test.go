@@ -181,6 +181,12 @@ func TestAppConfigValidation(t *testing.T) {
 			conf.ValidRaspConf(&config)
 		})
 
+		Convey("when the alarm export max rows is 0", func() {
+			config := *conf.AppConfig
+			config.AlarmExportMaxRows = 0
+			conf.ValidRaspConf(&config)
+		})
+
 		Convey("when the cookie life time is 0", func() {
 			config := *conf.AppConfig
 			config.CookieLifeTime = 0
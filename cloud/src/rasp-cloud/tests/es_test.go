@@ -0,0 +1,928 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"strconv"
+	"testing"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/es"
+	"github.com/olivere/elastic"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"errors"
+	"time"
+	"rasp-cloud/conf"
+	"rasp-cloud/tests/inits"
+	"rasp-cloud/mongo"
+	"rasp-cloud/models"
+	"rasp-cloud/models/logs"
+	"rasp-cloud/tests/start"
+)
+
+func newStubEsClient(handler http.HandlerFunc) (*httptest.Server, *elastic.Client) {
+	server := httptest.NewServer(handler)
+	client, err := elastic.NewSimpleClient(elastic.SetURL(server.URL))
+	So(err, ShouldEqual, nil)
+	return server, client
+}
+
+func TestBulkInsertRetry(t *testing.T) {
+	Convey("Subject: Test ES Bulk Insert Retry\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		docs := []map[string]interface{}{
+			{"app_id": "1234567890abc", "event_time": 1551882976000},
+		}
+
+		Convey("when es returns 429 twice then 200", func() {
+			var count int32
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if atomic.AddInt32(&count, 1) <= 2 {
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write([]byte(`{"error":{"type":"es_rejected_execution_exception",` +
+						`"reason":"rejected execution"},"status":429}`))
+					return
+				}
+				w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			err := es.BulkInsert("attack-alarm", docs)
+			So(err, ShouldEqual, nil)
+			So(atomic.LoadInt32(&count), ShouldEqual, 3)
+		})
+
+		Convey("when es returns a non-retryable error", func() {
+			var count int32
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&count, 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"type":"mapper_parsing_exception",` +
+					`"reason":"failed to parse"},"status":400}`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			err := es.BulkInsert("attack-alarm", docs)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "mapper_parsing_exception")
+			So(atomic.LoadInt32(&count), ShouldEqual, 1)
+		})
+
+		Convey("when es rejects some of the docs", func() {
+			var count int32
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if atomic.AddInt32(&count, 1) == 1 {
+					w.Write([]byte(`{"took":1,"errors":true,"items":[` +
+						`{"index":{"_index":"real-openrasp-attack-alarm-a","status":201}},` +
+						`{"index":{"_index":"real-openrasp-attack-alarm-b","status":400,"error":` +
+						`{"type":"mapper_parsing_exception","reason":"failed to parse [event_time]"}}},` +
+						`{"index":{"_index":"real-openrasp-attack-alarm-c","status":429,"error":` +
+						`{"type":"es_rejected_execution_exception","reason":"rejected execution"}}}]}`))
+					return
+				}
+				w.Write([]byte(`{"took":1,"errors":false,"items":[` +
+					`{"index":{"_index":"real-openrasp-attack-alarm-c","status":201}}]}`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			err := es.BulkInsert("attack-alarm", []map[string]interface{}{
+				{"app_id": "a", "rasp_id": "1", "event_time": 1551882976000},
+				{"app_id": "b", "rasp_id": "2", "event_time": "invalid"},
+				{"app_id": "c", "rasp_id": "3", "event_time": 1551882976000},
+			})
+			So(err, ShouldNotEqual, nil)
+			bulkErr, ok := err.(*es.BulkError)
+			So(ok, ShouldBeTrue)
+			So(bulkErr.Total, ShouldEqual, 3)
+			So(len(bulkErr.Failures), ShouldEqual, 1)
+			So(bulkErr.Failures[0].Position, ShouldEqual, 1)
+			So(bulkErr.Failures[0].Status, ShouldEqual, http.StatusBadRequest)
+			So(bulkErr.Failures[0].Type, ShouldEqual, "mapper_parsing_exception")
+			So(bulkErr.Failures[0].Doc["rasp_id"], ShouldEqual, "2")
+			So(atomic.LoadInt32(&count), ShouldEqual, 2)
+		})
+
+		Convey("when es keeps rejecting all the docs", func() {
+			var count int32
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&count, 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"took":1,"errors":true,"items":[` +
+					`{"index":{"_index":"real-openrasp-attack-alarm-1234567890abc","status":429,"error":` +
+					`{"type":"es_rejected_execution_exception","reason":"rejected execution"}}}]}`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			err := es.BulkInsert("attack-alarm", docs)
+			So(err, ShouldNotEqual, nil)
+			So(err.Error(), ShouldContainSubstring, "es_rejected_execution_exception")
+			So(atomic.LoadInt32(&count), ShouldEqual, conf.AppConfig.EsBulkMaxRetry+1)
+		})
+
+		Convey("when es keeps returning 503", func() {
+			var count int32
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&count, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			err := es.BulkInsert("attack-alarm", docs)
+			So(err, ShouldNotEqual, nil)
+			So(atomic.LoadInt32(&count), ShouldBeLessThanOrEqualTo, 4)
+		})
+	})
+}
+
+func TestEsVersion(t *testing.T) {
+	Convey("Subject: Test ES Version Compatibility\n", t, func() {
+		originMajor, originMinor := es.MajorVersion, es.MinorVersion
+		defer func() {
+			es.MajorVersion, es.MinorVersion = originMajor, originMinor
+		}()
+
+		Convey("when the version is valid", func() {
+			major, minor, err := es.ParseVersion("5.6.16")
+			So(err, ShouldEqual, nil)
+			So(major, ShouldEqual, 5)
+			So(minor, ShouldEqual, 6)
+
+			major, minor, err = es.ParseVersion("7.10.2")
+			So(err, ShouldEqual, nil)
+			So(major, ShouldEqual, 7)
+			So(minor, ShouldEqual, 10)
+
+			major, minor, err = es.ParseVersion("6.8.0-SNAPSHOT")
+			So(err, ShouldEqual, nil)
+			So(major, ShouldEqual, 6)
+			So(minor, ShouldEqual, 8)
+		})
+
+		Convey("when the version is invalid", func() {
+			_, _, err := es.ParseVersion("7")
+			So(err, ShouldNotEqual, nil)
+			_, _, err = es.ParseVersion("x.y.z")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("when the version is compared", func() {
+			es.MajorVersion, es.MinorVersion = 10, 0
+			So(es.IsVersionAtLeast(5, 6), ShouldBeTrue)
+			es.MajorVersion, es.MinorVersion = 5, 5
+			So(es.IsVersionAtLeast(5, 6), ShouldBeFalse)
+		})
+
+		Convey("when the doc type is used", func() {
+			es.MajorVersion = 6
+			So(es.GetDocType("attack-alarm"), ShouldEqual, "attack-alarm")
+			es.MajorVersion = 7
+			So(es.GetDocType("attack-alarm"), ShouldEqual, "_doc")
+		})
+	})
+}
+
+func TestScrollSearch(t *testing.T) {
+	Convey("Subject: Test ES Scroll Search\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		pages := []string{
+			`{"_scroll_id":"scroll-1","hits":{"total":5,"hits":[` +
+				`{"_id":"1","_source":{}},{"_id":"2","_source":{}}]}}`,
+			`{"_scroll_id":"scroll-1","hits":{"total":5,"hits":[` +
+				`{"_id":"3","_source":{}},{"_id":"4","_source":{}}]}}`,
+			`{"_scroll_id":"scroll-1","hits":{"total":5,"hits":[{"_id":"5","_source":{}}]}}`,
+			`{"_scroll_id":"scroll-1","hits":{"total":5,"hits":[]}}`,
+		}
+		var pageIndex, clearCount int32
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == "DELETE" {
+				atomic.AddInt32(&clearCount, 1)
+				w.Write([]byte(`{"succeeded":true,"num_freed":1}`))
+				return
+			}
+			index := atomic.AddInt32(&pageIndex, 1) - 1
+			w.Write([]byte(pages[index]))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		Convey("when all pages are walked", func() {
+			ids := make([]string, 0)
+			err := es.ScrollSearch("real-openrasp-attack-alarm-test", "attack-alarm",
+				elastic.NewMatchAllQuery(), 2, func(hits []*elastic.SearchHit) error {
+					for _, hit := range hits {
+						ids = append(ids, hit.Id)
+					}
+					return nil
+				})
+			So(err, ShouldEqual, nil)
+			So(ids, ShouldResemble, []string{"1", "2", "3", "4", "5"})
+			So(atomic.LoadInt32(&clearCount), ShouldEqual, 1)
+		})
+
+		Convey("when fn stops the walk", func() {
+			count := 0
+			err := es.ScrollSearch("real-openrasp-attack-alarm-test", "attack-alarm",
+				elastic.NewMatchAllQuery(), 2, func(hits []*elastic.SearchHit) error {
+					count += len(hits)
+					return errors.New("stop")
+				})
+			So(err, ShouldNotEqual, nil)
+			So(count, ShouldEqual, 2)
+			So(atomic.LoadInt32(&pageIndex), ShouldEqual, 1)
+			So(atomic.LoadInt32(&clearCount), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestEsIndex(t *testing.T) {
+	Convey("Subject: Test ES Index Name\n", t, func() {
+		Convey("when the write alias is used", func() {
+			index, err := es.GetIndex("openrasp-attack-alarm", "test")
+			So(err, ShouldEqual, nil)
+			So(index, ShouldEqual, "real-openrasp-attack-alarm-test")
+			index, err = es.GetIndex("openrasp-attack-alarm", "TEST_1")
+			So(err, ShouldEqual, nil)
+			So(index, ShouldEqual, "real-openrasp-attack-alarm-test_1")
+		})
+
+		Convey("when the search index is used", func() {
+			index, err := es.GetSearchIndex("openrasp-attack-alarm", "test")
+			So(err, ShouldEqual, nil)
+			So(index, ShouldEqual, "openrasp-attack-alarm-test,openrasp-attack-alarm-test-*")
+			index, err = es.GetSearchIndex("openrasp-attack-alarm", "*")
+			So(err, ShouldEqual, nil)
+			So(index, ShouldEqual, "openrasp-attack-alarm-*")
+		})
+
+		Convey("when the app id is invalid", func() {
+			for _, appId := range []string{"", "a*", "*a", "a,b", "a/b", "../a", "a b", "a-b", "a?", "a#b",
+				inits.GetLongString(129)} {
+				_, err := es.GetIndex("openrasp-attack-alarm", appId)
+				So(err, ShouldNotEqual, nil)
+				_, err = es.GetSearchIndex("openrasp-attack-alarm", appId)
+				So(err, ShouldNotEqual, nil)
+			}
+		})
+
+		Convey("when the index info is fetched", func() {
+			originClient := es.ElasticClient
+			defer func() {
+				es.ElasticClient = originClient
+			}()
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`[` +
+					`{"index":"openrasp-attack-alarm-b-20190102000000","creation.date":"3","docs.count":"1"},` +
+					`{"index":"openrasp-attack-alarm-a","creation.date":"1","docs.count":"1"},` +
+					`{"index":"openrasp-attack-alarm-b","creation.date":"1","docs.count":"1"},` +
+					`{"index":"openrasp-attack-alarm-a-20190101000000","creation.date":"2","docs.count":"1"}]`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			infos, err := es.GetIndexInfo("openrasp-attack-alarm", "*")
+			So(err, ShouldEqual, nil)
+			So(len(infos), ShouldEqual, 4)
+			So(infos[0].Index, ShouldEqual, "openrasp-attack-alarm-a")
+			So(infos[0].AppId, ShouldEqual, "a")
+			So(infos[0].IsWriteIndex, ShouldBeFalse)
+			So(infos[1].AppId, ShouldEqual, "a")
+			So(infos[1].IsWriteIndex, ShouldBeTrue)
+			So(infos[3].Index, ShouldEqual, "openrasp-attack-alarm-b-20190102000000")
+			So(infos[3].IsWriteIndex, ShouldBeTrue)
+		})
+	})
+}
+
+func TestSearchContext(t *testing.T) {
+	Convey("Subject: Test ES Search Context\n", t, func() {
+		Convey("when the deadline of every kind is used", func() {
+			So(es.GetTimeout(es.ContextSearch), ShouldEqual,
+				time.Duration(conf.AppConfig.EsSearchTimeout)*time.Second)
+			So(es.GetTimeout(es.ContextAggregation), ShouldEqual,
+				time.Duration(conf.AppConfig.EsAggrTimeout)*time.Second)
+			So(es.GetTimeout(es.ContextExport), ShouldEqual,
+				time.Duration(conf.AppConfig.EsExportTimeout)*time.Second)
+			So(es.GetTimeout(es.ContextIngest), ShouldEqual,
+				time.Duration(conf.AppConfig.EsBulkTimeout)*time.Second)
+			ctx, cancel := es.SearchContext(es.ContextSearch)
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			So(ok, ShouldBeTrue)
+			So(deadline.After(time.Now()), ShouldBeTrue)
+		})
+	})
+}
+
+func TestBulkProcessor(t *testing.T) {
+	Convey("Subject: Test ES Bulk Processor\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		var count int32
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&count, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		Convey("when the pending docs are flushed on close", func() {
+			processor := es.NewBulkProcessor("attack-alarm", 10)
+			err := processor.Add(map[string]interface{}{"app_id": "1234567890abc"})
+			So(err, ShouldEqual, nil)
+			err = processor.Close(10 * time.Second)
+			So(err, ShouldEqual, nil)
+			So(processor.Stats().Indexed, ShouldEqual, 1)
+			So(processor.Stats().Pending, ShouldEqual, 0)
+			So(atomic.LoadInt32(&count), ShouldBeGreaterThanOrEqualTo, 1)
+
+			err = processor.Add(map[string]interface{}{"app_id": "1234567890abc"})
+			So(err, ShouldEqual, es.ErrBulkProcessorClosed)
+		})
+	})
+}
+
+func TestMultiSearch(t *testing.T) {
+	Convey("Subject: Test ES Multi Search\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"responses":[` +
+				`{"hits":{"total":1,"hits":[{"_id":"1","_source":{}}]}},` +
+				`{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}]}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		Convey("when one of the searches fails", func() {
+			results, err := es.MultiSearch(es.ContextSearch, []*es.SearchItem{
+				{Index: "openrasp-attack-alarm-a*", Query: elastic.NewMatchAllQuery(), Size: 10},
+				{Index: "openrasp-attack-alarm-b*", Query: elastic.NewMatchAllQuery(), Size: 10},
+			})
+			So(err, ShouldEqual, nil)
+			So(len(results), ShouldEqual, 2)
+			So(results[0].Err, ShouldEqual, nil)
+			So(results[0].Result.Hits.TotalHits, ShouldEqual, 1)
+			So(results[1].Err, ShouldNotEqual, nil)
+			So(results[1].Err.Error(), ShouldContainSubstring, "index_not_found_exception")
+		})
+	})
+}
+
+func TestSearchAttackAlarmWithApps(t *testing.T) {
+	Convey("Subject: Test Attack Alarm Search Of Apps\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		var searches int32
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			body, _ := ioutil.ReadAll(r.Body)
+			atomic.StoreInt32(&searches, int32(strings.Count(string(body), `"index"`)))
+			w.Write([]byte(`{"responses":[` +
+				`{"hits":{"total":1,"hits":[{"_id":"1","_source":{"attack_type":"sql"}}]}},` +
+				`{"hits":{"total":0,"hits":[]}}]}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		Convey("when one of the app ids is invalid", func() {
+			alarms, err := logs.SearchAttackAlarmWithApps(0, 1, 10, []string{"a", "a*", "b"})
+			So(err, ShouldEqual, nil)
+			So(atomic.LoadInt32(&searches), ShouldEqual, 2)
+			So(len(alarms), ShouldEqual, 2)
+			So(alarms["a"].Total, ShouldEqual, 1)
+			So(alarms["b"].Total, ShouldEqual, 0)
+			_, ok := alarms["a*"]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("when all the app ids are invalid", func() {
+			alarms, err := logs.SearchAttackAlarmWithApps(0, 1, 10, []string{"a*"})
+			So(err, ShouldEqual, nil)
+			So(len(alarms), ShouldEqual, 0)
+			So(atomic.LoadInt32(&searches), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestDeleteTaskStatus(t *testing.T) {
+	Convey("Subject: Test ES Delete Task Status\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+
+		Convey("when the task is running", func() {
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"completed":false,"task":{"node":"n","id":1,` +
+					`"status":{"total":1000,"deleted":300,"version_conflicts":0}}}`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			status, err := es.GetDeleteTaskStatus("n:1")
+			So(err, ShouldEqual, nil)
+			So(status.Completed, ShouldBeFalse)
+			So(status.Total, ShouldEqual, 1000)
+			So(status.Deleted, ShouldEqual, 300)
+		})
+
+		Convey("when the task is completed with failures", func() {
+			server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"completed":true,"task":{"node":"n","id":1,"status":{"total":1000,"deleted":900}},` +
+					`"response":{"total":1000,"deleted":999,"failures":[{"id":"x"}]}}`))
+			})
+			defer server.Close()
+			es.ElasticClient = client
+			status, err := es.GetDeleteTaskStatus("n:1")
+			So(err, ShouldEqual, nil)
+			So(status.Completed, ShouldBeTrue)
+			So(status.Deleted, ShouldEqual, 999)
+			So(len(status.Failures), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestEsMultiNode(t *testing.T) {
+	Convey("Subject: Test ES Multiple Nodes\n", t, func() {
+		config := *conf.AppConfig
+		config.EsUser, config.EsPwd, config.EsApiKey = "", "", ""
+		config.EsSniff = false
+		config.EsHealthCheck = true
+
+		Convey("when the addrs are split", func() {
+			addrs := es.GetEsAddrs(" http://10.0.0.1:9200, http://10.0.0.2:9200,,")
+			So(addrs, ShouldResemble, []string{"http://10.0.0.1:9200", "http://10.0.0.2:9200"})
+		})
+
+		Convey("when one of the nodes is down", func() {
+			var count int32
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&count, 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"name":"node-1","version":{"number":"6.8.0"},"tagline":"You Know, for Search"}`))
+			}))
+			defer up.Close()
+			down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			down.Close()
+
+			config.EsAddr = down.URL + "," + up.URL
+			client, upAddrs, err := es.NewEsClient(&config)
+			So(err, ShouldEqual, nil)
+			So(upAddrs, ShouldResemble, []string{up.URL})
+			defer client.Stop()
+
+			version, err := client.ElasticsearchVersion(down.URL)
+			So(err, ShouldNotEqual, nil)
+			_, err = client.ClusterHealth().Do(context.Background())
+			So(err, ShouldEqual, nil)
+			So(atomic.LoadInt32(&count), ShouldBeGreaterThan, 0)
+			version, err = client.ElasticsearchVersion(up.URL)
+			So(err, ShouldEqual, nil)
+			So(version, ShouldEqual, "6.8.0")
+		})
+
+		Convey("when the credentials are rejected", func() {
+			unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error":{"type":"security_exception"},"status":401}`))
+			}))
+			defer unauthorized.Close()
+			config.EsAddr = unauthorized.URL
+			_, _, err := es.NewEsClient(&config)
+			So(err, ShouldEqual, es.ErrAuthRejected)
+		})
+
+		Convey("when all the nodes are down", func() {
+			down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			down.Close()
+			config.EsAddr = down.URL
+			_, _, err := es.NewEsClient(&config)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestEsSlowQuery(t *testing.T) {
+	Convey("Subject: Test ES Slow Query\n", t, func() {
+		originThreshold := conf.AppConfig.EsSlowQueryThreshold
+		defer func() {
+			conf.AppConfig.EsSlowQueryThreshold = originThreshold
+		}()
+		config := *conf.AppConfig
+		config.EsUser, config.EsPwd, config.EsApiKey = "", "", ""
+		config.EsSniff = false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path == "/" {
+				w.Write([]byte(`{"name":"node-1","version":{"number":"6.8.0"}}`))
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte(`{"took":50,"hits":{"total":0,"hits":[]}}`))
+		}))
+		defer server.Close()
+		config.EsAddr = server.URL
+		client, _, err := es.NewEsClient(&config)
+		So(err, ShouldEqual, nil)
+		defer client.Stop()
+
+		getStat := func() *es.QueryStat {
+			for _, stat := range es.GetQueryStats() {
+				if strings.Contains(stat.Caller, "TestEsSlowQuery") {
+					return stat
+				}
+			}
+			return nil
+		}
+
+		conf.AppConfig.EsSlowQueryThreshold = 10
+		_, err = client.Search("openrasp-attack-alarm-1").
+			Query(elastic.NewMatchAllQuery()).Do(context.Background())
+		So(err, ShouldEqual, nil)
+		stat := getStat()
+		So(stat, ShouldNotEqual, nil)
+		So(stat.Count, ShouldEqual, 1)
+		So(stat.SlowCount, ShouldEqual, 1)
+		So(stat.LastIndex, ShouldEqual, "openrasp-attack-alarm-1")
+		So(stat.MaxTook, ShouldBeGreaterThanOrEqualTo, 50)
+
+		conf.AppConfig.EsSlowQueryThreshold = 60000
+		_, err = client.Search("openrasp-attack-alarm-2").Do(context.Background())
+		So(err, ShouldEqual, nil)
+		stat = getStat()
+		So(stat.Count, ShouldEqual, 2)
+		So(stat.SlowCount, ShouldEqual, 1)
+		So(stat.LastIndex, ShouldEqual, "openrasp-attack-alarm-2")
+	})
+}
+
+func TestEsMigration(t *testing.T) {
+	Convey("Subject: Test ES Index Migration\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		// the sequence numbers of the requests, so that their order can be checked
+		var taskPolls, seq, closed, published, reindexedToCopy int32
+		copyDocs := 3
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/_alias/"):
+				// the target and the copy are left by the interrupted migration
+				w.Write([]byte(`{"openrasp-report-data-test-20190102000000":` +
+					`{"aliases":{"migrating-openrasp-report-data-test":{}}},` +
+					`"migrated-openrasp-report-data-test-20190101235959":` +
+					`{"aliases":{"migrating-openrasp-report-data-test":{}}}}`))
+			case strings.HasPrefix(r.URL.Path, "/_cat/indices/"):
+				w.Write([]byte(`[` +
+					`{"index":"openrasp-report-data-test","status":"open","creation.date":"1","docs.count":"3"},` +
+					`{"index":"openrasp-report-data-test-20190101000000","status":"close","creation.date":"2"},` +
+					`{"index":"openrasp-report-data-test-20190102000000","status":"open","creation.date":"3",` +
+					`"docs.count":"1"}]`))
+			case strings.HasPrefix(r.URL.Path, "/migrated-") && strings.HasSuffix(r.URL.Path, "/_count"):
+				w.Write([]byte(`{"count":` + strconv.Itoa(copyDocs) + `}`))
+			case strings.HasSuffix(r.URL.Path, "/_count"):
+				w.Write([]byte(`{"count":3}`))
+			case r.URL.Path == "/_reindex":
+				body, _ := ioutil.ReadAll(r.Body)
+				if strings.Contains(string(body), `"migrated-openrasp-report-data-test-20190101235959"`) {
+					atomic.StoreInt32(&reindexedToCopy, 1)
+				}
+				w.Write([]byte(`{"task":"node:1"}`))
+			case strings.HasPrefix(r.URL.Path, "/_tasks/"):
+				completed := atomic.AddInt32(&taskPolls, 1) > 1
+				w.Write([]byte(`{"completed":` + strconv.FormatBool(completed) +
+					`,"task":{"status":{"total":3,"created":2,"version_conflicts":1}}}`))
+			case strings.HasSuffix(r.URL.Path, "/_close"):
+				atomic.StoreInt32(&closed, atomic.AddInt32(&seq, 1))
+				w.Write([]byte(`{"acknowledged":true}`))
+			case r.URL.Path == "/_aliases":
+				body, _ := ioutil.ReadAll(r.Body)
+				if strings.Contains(string(body), `"openrasp-report-data-test-20190101235959-migrated"`) {
+					atomic.StoreInt32(&published, atomic.AddInt32(&seq, 1))
+				}
+				w.Write([]byte(`{"acknowledged":true}`))
+			default:
+				w.Write([]byte(`{"acknowledged":true,"_shards":{"total":1,"successful":1,"failed":0}}`))
+			}
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		waitMigration := func() *es.Migration {
+			for i := 0; i < 100; i++ {
+				for _, m := range es.GetMigrations() {
+					if m.AppId == "test" && !m.Running {
+						return m
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			return nil
+		}
+
+		Convey("when the migration is dry run", func() {
+			m, err := es.MigrateIndex("openrasp-report-data", "TEST", true, false)
+			So(err, ShouldEqual, nil)
+			So(m.Resumed, ShouldBeTrue)
+			So(m.Target, ShouldEqual, "openrasp-report-data-test-20190102000000")
+			So(m.Copy, ShouldEqual, "migrated-openrasp-report-data-test-20190101235959")
+			So(m.Sources, ShouldResemble, []string{"openrasp-report-data-test"})
+			So(m.SourceDocs, ShouldEqual, 3)
+			So(atomic.LoadInt32(&taskPolls), ShouldEqual, 0)
+			So(atomic.LoadInt32(&closed), ShouldEqual, 0)
+		})
+
+		Convey("when the migration is resumed", func() {
+			_, err := es.MigrateIndex("openrasp-report-data", "test", false, false)
+			So(err, ShouldEqual, nil)
+			_, err = es.MigrateIndex("openrasp-report-data", "test", false, false)
+			So(err, ShouldEqual, es.ErrMigrationRunning)
+
+			migration := waitMigration()
+			So(migration, ShouldNotEqual, nil)
+			So(migration.Error, ShouldEqual, "")
+			So(migration.Completed, ShouldBeTrue)
+			So(migration.TaskId, ShouldEqual, "node:1")
+			So(migration.Created, ShouldEqual, 2)
+			So(migration.CopyDocs, ShouldEqual, 3)
+			So(atomic.LoadInt32(&reindexedToCopy), ShouldEqual, 1)
+			// the sources are closed before the copy is published, so no document is searched twice
+			So(atomic.LoadInt32(&closed), ShouldBeGreaterThan, 0)
+			So(atomic.LoadInt32(&published), ShouldBeGreaterThan, atomic.LoadInt32(&closed))
+		})
+
+		Convey("when the copy is not verified", func() {
+			copyDocs = 2
+			_, err := es.MigrateIndex("openrasp-report-data", "test", false, false)
+			So(err, ShouldEqual, nil)
+
+			migration := waitMigration()
+			So(migration, ShouldNotEqual, nil)
+			So(migration.Error, ShouldNotEqual, "")
+			So(migration.Completed, ShouldBeFalse)
+			So(migration.CopyDocs, ShouldEqual, 2)
+			// the copy stays out of the searches, and the sources stay searchable
+			So(atomic.LoadInt32(&closed), ShouldEqual, 0)
+			So(atomic.LoadInt32(&published), ShouldEqual, 0)
+		})
+
+		Convey("when the app id is invalid", func() {
+			_, err := es.MigrateIndex("openrasp-report-data", "a*", true, false)
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
+
+func TestBulkProcessorSpool(t *testing.T) {
+	Convey("Subject: Test ES Bulk Processor Spool\n", t, func() {
+		originClient := es.ElasticClient
+		originSpoolDir := conf.AppConfig.EsSpoolDir
+		spoolDir, err := ioutil.TempDir("", "openrasp-es-spool")
+		So(err, ShouldEqual, nil)
+		defer func() {
+			es.ElasticClient = originClient
+			conf.AppConfig.EsSpoolDir = originSpoolDir
+			os.RemoveAll(spoolDir)
+		}()
+		conf.AppConfig.EsSpoolDir = spoolDir
+		var available int32
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&available) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		Convey("when es is unavailable and then recovers", func() {
+			processor := es.NewBulkProcessor("error-alarm", 10)
+			err := processor.Add(map[string]interface{}{"app_id": "1234567890abc", "seq": 1})
+			So(err, ShouldEqual, nil)
+			So(processor.Close(30*time.Second), ShouldEqual, nil)
+			So(processor.Stats().Spooled, ShouldEqual, 1)
+			So(processor.Stats().Failed, ShouldEqual, 0)
+
+			// the new docs are appended to the spool until it is drained
+			atomic.StoreInt32(&available, 1)
+			processor = es.NewBulkProcessor("error-alarm", 10)
+			defer processor.Close(time.Second)
+			err = processor.Add(map[string]interface{}{"app_id": "1234567890abc", "seq": 2})
+			So(err, ShouldEqual, nil)
+			for i := 0; i < 150 && processor.Stats().Spooled != 0; i++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+			So(processor.Stats().Spooled, ShouldEqual, 0)
+			So(processor.Stats().SpoolDropped, ShouldEqual, 0)
+			files, err := ioutil.ReadDir(spoolDir + "/error-alarm")
+			So(err, ShouldEqual, nil)
+			So(len(files), ShouldEqual, 0)
+		})
+	})
+}
+
+// newStubEsCluster serves the alias, cat and delete apis over the indices, the write alias of every app
+// points to the last index of the app in the list
+func newStubEsCluster(indices *[]string, aliases map[string]string) (*httptest.Server, *elastic.Client) {
+	return newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		switch {
+		case r.Method == "GET" && strings.HasPrefix(path, "_alias/"):
+			alias := strings.TrimPrefix(path, "_alias/")
+			index, ok := aliases[alias]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":"alias [` + alias + `] missing","status":404}`))
+				return
+			}
+			w.Write([]byte(`{"` + index + `":{"aliases":{"` + alias + `":{}}}}`))
+		case r.Method == "GET" && strings.HasPrefix(path, "_cat/indices/"):
+			rows := make([]string, 0)
+			for _, pattern := range strings.Split(strings.TrimPrefix(path, "_cat/indices/"), ",") {
+				prefix := strings.TrimSuffix(pattern, "*")
+				for _, index := range *indices {
+					if strings.HasPrefix(index, prefix) {
+						rows = append(rows, `{"index":"`+index+`"}`)
+					}
+				}
+			}
+			w.Write([]byte("[" + strings.Join(rows, ",") + "]"))
+		case r.Method == "DELETE":
+			for i, index := range *indices {
+				if index == path {
+					*indices = append((*indices)[:i], (*indices)[i+1:]...)
+					for alias, aliasIndex := range aliases {
+						if aliasIndex == index {
+							delete(aliases, alias)
+						}
+					}
+					w.Write([]byte(`{"acknowledged":true}`))
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"no such index [` + path + `]","status":404}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+}
+
+func TestDeleteAppIndex(t *testing.T) {
+	Convey("Subject: Test ES Delete App Index\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+
+		Convey("when the app index has rolled over", func() {
+			indices := []string{
+				"openrasp-attack-alarm-a",
+				"openrasp-attack-alarm-a-20190101000000",
+				"openrasp-attack-alarm-ab",
+				"migrated-openrasp-attack-alarm-a-20190102000000",
+			}
+			aliases := map[string]string{
+				"real-openrasp-attack-alarm-a":  "openrasp-attack-alarm-a-20190101000000",
+				"real-openrasp-attack-alarm-ab": "openrasp-attack-alarm-ab",
+			}
+			server, client := newStubEsCluster(&indices, aliases)
+			defer server.Close()
+			es.ElasticClient = client
+
+			deleted, err := es.DeleteAppIndex("openrasp-attack-alarm", "A")
+			So(err, ShouldEqual, nil)
+			So(deleted, ShouldResemble, []string{"migrated-openrasp-attack-alarm-a-20190102000000",
+				"openrasp-attack-alarm-a", "openrasp-attack-alarm-a-20190101000000"})
+			So(indices, ShouldResemble, []string{"openrasp-attack-alarm-ab"})
+			_, ok := aliases["real-openrasp-attack-alarm-a"]
+			So(ok, ShouldBeFalse)
+
+			deleted, err = es.DeleteAppIndex("openrasp-attack-alarm", "a")
+			So(err, ShouldEqual, nil)
+			So(len(deleted), ShouldEqual, 0)
+		})
+
+		Convey("when the app id is invalid", func() {
+			_, err := es.DeleteAppIndex("openrasp-attack-alarm", "a*")
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("when the app is deleted", func() {
+			appId := "delete_index_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			mongo.UpsertId("app", appId, map[string]interface{}{
+				"name":     "test_delete_index" + appId,
+				"language": "java",
+			})
+			defer mongo.RemoveId("app", appId)
+			indices := make([]string, 0)
+			aliases := make(map[string]string)
+			for _, index := range []string{"openrasp-attack-alarm", "openrasp-policy-alarm",
+				"openrasp-error-alarm", models.ReportIndexName} {
+				indices = append(indices, index+"-"+appId, index+"-"+appId+"-20190101000000")
+				aliases["real-"+index+"-"+appId] = index + "-" + appId + "-20190101000000"
+			}
+			indices = append(indices, "openrasp-attack-alarm-"+start.TestApp.Id)
+			server, client := newStubEsCluster(&indices, aliases)
+			defer server.Close()
+			es.ElasticClient = client
+
+			r := inits.GetResponse("POST", "/v1/api/app/delete", inits.GetJson(map[string]interface{}{
+				"id": appId,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(indices, ShouldResemble, []string{"openrasp-attack-alarm-" + start.TestApp.Id})
+			So(len(aliases), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestPolicyAlarmUpsert(t *testing.T) {
+	Convey("Subject: Test Policy Alarm Upsert\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		var body string
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			content, _ := ioutil.ReadAll(r.Body)
+			body = string(content)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		err := es.BulkInsert("policy-alarm", []map[string]interface{}{
+			{"app_id": start.TestApp.Id, "upsert_id": "abc", "policy_id": "3006"},
+		})
+		So(err, ShouldEqual, nil)
+		So(body, ShouldContainSubstring, `"_id":"abc"`)
+		// the status is only set for the first detection, a resolved one is reopened by the script
+		So(body, ShouldContainSubstring, `"status":"open"`)
+		So(body, ShouldContainSubstring, `reopened_count`)
+		So(body, ShouldContainSubstring, `"lang":"painless"`)
+		So(body, ShouldNotContainSubstring, `doc_as_upsert`)
+	})
+}
+
+func TestIgnoreUnavailableIndex(t *testing.T) {
+	Convey("Subject: Test the requests skip the unavailable generations\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		paths := make([]string, 0)
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("ignore_unavailable") == "true" {
+				paths = append(paths, r.URL.Path)
+			}
+			if strings.HasSuffix(r.URL.Path, "/_count") {
+				w.Write([]byte(`{"count":1}`))
+				return
+			}
+			w.Write([]byte(`{"took":1,"deleted":1,"total":1,"failures":[]}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		// the first generation named explicitly may be deleted by the retention or closed by the migration
+		index, err := es.GetSearchIndex("openrasp-attack-alarm", start.TestApp.Id)
+		So(err, ShouldEqual, nil)
+		deleted, _, err := es.DeleteByQuery(index, elastic.NewMatchAllQuery())
+		So(err, ShouldEqual, nil)
+		So(deleted, ShouldEqual, 1)
+		So(len(paths), ShouldEqual, 2)
+		So(paths[0], ShouldEndWith, "/_count")
+		So(paths[1], ShouldEndWith, "/_delete_by_query")
+	})
+}
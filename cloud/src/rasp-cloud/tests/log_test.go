@@ -12,6 +12,16 @@ import (
 	"reflect"
 	"github.com/olivere/elastic"
 	"context"
+	"net"
+	"bufio"
+	"strconv"
+	"strings"
+	"io"
+	"rasp-cloud/models"
+	"encoding/csv"
+	"rasp-cloud/conf"
+	"rasp-cloud/es"
+	"net/http"
 )
 
 func TestPostLog(t *testing.T) {
@@ -209,6 +219,38 @@ func TestLogSearch(t *testing.T) {
 			monkey.Unpatch(logs.SearchLogs)
 		})
 
+		Convey("when the search data has rasp_tag", func() {
+			var query map[string]interface{}
+			monkey.Patch(logs.SearchLogs, func(startTime int64, endTime int64, isAttachAggr bool, q map[string]interface{}, sortField string,
+				page int, perpage int, ascending bool, index ...string) (int64, []map[string]interface{}, error) {
+				query = q
+				return 0, nil, nil
+			})
+			monkey.Patch(models.GetRaspIdsByTag, func(appId string, tag string) ([]string, error) {
+				return []string{"rasp1", "rasp2"}, nil
+			})
+			data := getNormalSearchData()
+			data["data"].(map[string]interface{})["rasp_tag"] = "payment"
+			r := inits.GetResponse("POST", "/v1/api/log/error/search", inits.GetJson(data))
+			So(r.Status, ShouldEqual, 0)
+			So(query["rasp_tag"], ShouldBeNil)
+			So(query["rasp_id"], ShouldResemble, []interface{}{"rasp1", "rasp2"})
+
+			data["data"].(map[string]interface{})["rasp_id"] = "rasp2"
+			r = inits.GetResponse("POST", "/v1/api/log/attack/search", inits.GetJson(data))
+			So(r.Status, ShouldEqual, 0)
+			So(query["rasp_id"], ShouldResemble, []interface{}{"rasp2"})
+			monkey.Unpatch(models.GetRaspIdsByTag)
+
+			monkey.Patch(models.GetRaspIdsByTag, func(appId string, tag string) ([]string, error) {
+				return nil, errors.New("")
+			})
+			r = inits.GetResponse("POST", "/v1/api/log/policy/search", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			monkey.Unpatch(models.GetRaspIdsByTag)
+			monkey.Unpatch(logs.SearchLogs)
+		})
+
 		Convey("when log type is policy", func() {
 			r := inits.GetResponse("POST", "/v1/api/log/policy/search",
 				inits.GetJson(getPolicyLogSearchData()))
@@ -302,6 +344,20 @@ func getAggrParam() map[string]interface{} {
 	}
 }
 
+func getHistogramParam() map[string]interface{} {
+	return map[string]interface{}{
+		"interval":  "hour",
+		"time_zone": "+08:00",
+		"size":      10,
+		"data": map[string]interface{}{
+			"app_id":          start.TestApp.Id,
+			"start_time":      1551882976000 - 7*24*3600*1000,
+			"end_time":        1551882976000,
+			"intercept_state": []string{"block", "log"},
+		},
+	}
+}
+
 func TestAttackLogAggr(t *testing.T) {
 	Convey("Subject: Test Attack Log Aggr Api\n", t, func() {
 
@@ -320,6 +376,47 @@ func TestAttackLogAggr(t *testing.T) {
 			So(r.Status, ShouldEqual, 0)
 		})
 
+		Convey("when aggr with histogram", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/histogram",
+				inits.GetJson(getHistogramParam()))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["labels"], ShouldNotBeNil)
+			So(r.Data.(map[string]interface{})["attack_type"], ShouldNotBeNil)
+			So(r.Data.(map[string]interface{})["intercept_state"], ShouldNotBeNil)
+		})
+
+		Convey("when the interval of histogram is invalid", func() {
+			data := getHistogramParam()
+			data["interval"] = "1x"
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/histogram", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the histogram has too many buckets", func() {
+			data := getHistogramParam()
+			data["interval"] = "1m"
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/histogram", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the size of histogram is too large", func() {
+			data := getHistogramParam()
+			data["size"] = logs.MaxHistogramSize + 1
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/histogram", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when count the buckets of histogram", func() {
+			count, err := logs.GetHistogramBucketCount(0, 7*24*3600*1000, "hour")
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 7*24+2)
+			count, err = logs.GetHistogramBucketCount(0, 7*24*3600*1000, "30m")
+			So(err, ShouldEqual, nil)
+			So(count, ShouldEqual, 7*24*2+2)
+			_, err = logs.GetHistogramBucketCount(0, 7*24*3600*1000, "0h")
+			So(err, ShouldNotEqual, nil)
+		})
+
 		Convey("when aggr app_id does not exist", func() {
 			data := getAggrParam()
 			data["app_id"] = "222222222222222222"
@@ -528,3 +625,431 @@ func TestAddLogWithFile(t *testing.T) {
 	})
 
 }
+
+func TestSyslogForward(t *testing.T) {
+	Convey("Subject: Test Syslog Forward\n", t, func() {
+		originGetter := logs.SyslogConfGetter
+		defer func() {
+			logs.SyslogConfGetter = originGetter
+		}()
+
+		Convey("when the syslog config is invalid", func() {
+			conf := &logs.SyslogConf{Protocol: "http", Addr: "127.0.0.1:514"}
+			So(conf.Valid(), ShouldNotEqual, nil)
+			conf = &logs.SyslogConf{Protocol: "udp", Addr: "127.0.0.1"}
+			So(conf.Valid(), ShouldNotEqual, nil)
+			conf = &logs.SyslogConf{Protocol: "tcp", Addr: "127.0.0.1:514", Facility: 24}
+			So(conf.Valid(), ShouldNotEqual, nil)
+			conf = &logs.SyslogConf{Protocol: "tcp", Addr: "127.0.0.1:514", LogTypes: []string{"report-data"}}
+			So(conf.Valid(), ShouldNotEqual, nil)
+			conf = &logs.SyslogConf{Protocol: "tls", Addr: "127.0.0.1:514", Facility: 16,
+				LogTypes: []string{"attack-alarm"}}
+			So(conf.Valid(), ShouldEqual, nil)
+		})
+
+		Convey("when the alarms are forwarded over tcp", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldEqual, nil)
+			defer listener.Close()
+			logs.SyslogConfGetter = func(appId string) (*logs.SyslogConf, error) {
+				return &logs.SyslogConf{Enable: true, Protocol: "tcp", Addr: listener.Addr().String(),
+					Facility: 16, LogTypes: []string{"attack-alarm"}}, nil
+			}
+			// the policy alarm is not selected
+			err = logs.AddLogWithFile("policy-alarm", map[string]interface{}{"app_id": "syslog_test", "seq": 1})
+			So(err, ShouldEqual, nil)
+			err = logs.AddLogWithFile("attack-alarm", map[string]interface{}{"app_id": "syslog_test", "seq": 2})
+			So(err, ShouldEqual, nil)
+
+			conn, err := listener.Accept()
+			So(err, ShouldEqual, nil)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(conn)
+			length, err := reader.ReadString(' ')
+			So(err, ShouldEqual, nil)
+			size, err := strconv.Atoi(strings.TrimSpace(length))
+			So(err, ShouldEqual, nil)
+			message := make([]byte, size)
+			_, err = io.ReadFull(reader, message)
+			So(err, ShouldEqual, nil)
+			So(string(message), ShouldStartWith, "<132>1 ")
+			So(string(message), ShouldContainSubstring,
+				`[openrasp@32473 app_id="syslog_test" log_type="attack-alarm"] {"app_id":"syslog_test","seq":2}`)
+
+			var stats []*logs.ForwardStat
+			for i := 0; i < 50; i++ {
+				stats, _, _ = logs.GetForwardStats("syslog_test")
+				if len(stats) > 0 {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			So(len(stats), ShouldEqual, 1)
+			So(stats[0].Channel, ShouldEqual, logs.ForwardChannelSyslog)
+			So(stats[0].LogType, ShouldEqual, "attack-alarm")
+			So(stats[0].Published, ShouldEqual, 1)
+		})
+
+		Convey("when the syslog config is updated with the app", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldEqual, nil)
+			defer listener.Close()
+			logs.SyslogConfGetter = func(appId string) (*logs.SyslogConf, error) {
+				return nil, errors.New("mongo is down")
+			}
+			logs.UpdateSyslogConf("syslog_update_test",
+				&logs.SyslogConf{Enable: true, Protocol: "tcp", Addr: listener.Addr().String()})
+			defer logs.UpdateSyslogConf("syslog_update_test", nil)
+			err = logs.AddLogWithFile("error-alarm", map[string]interface{}{"app_id": "syslog_update_test"})
+			So(err, ShouldEqual, nil)
+
+			conn, err := listener.Accept()
+			So(err, ShouldEqual, nil)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			length, err := bufio.NewReader(conn).ReadString(' ')
+			So(err, ShouldEqual, nil)
+			So(strings.TrimSpace(length), ShouldNotBeEmpty)
+		})
+
+		Convey("when the syslog server is unreachable", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldEqual, nil)
+			addr := listener.Addr().String()
+			listener.Close()
+			logs.SyslogConfGetter = func(appId string) (*logs.SyslogConf, error) {
+				return &logs.SyslogConf{Enable: true, Protocol: "tcp", Addr: addr}, nil
+			}
+			err = logs.AddLogWithFile("error-alarm", map[string]interface{}{"app_id": "syslog_down_test"})
+			So(err, ShouldEqual, nil)
+
+			var stats []*logs.ForwardStat
+			var failures []*logs.ForwardFailure
+			for i := 0; i < 50; i++ {
+				stats, failures, _ = logs.GetForwardStats("syslog_down_test")
+				if len(failures) > 0 {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			So(len(stats), ShouldEqual, 1)
+			So(stats[0].Retried, ShouldBeGreaterThanOrEqualTo, 1)
+			So(stats[0].Published, ShouldEqual, 0)
+			So(failures[0].LogType, ShouldEqual, "error-alarm")
+			So(failures[0].Reason, ShouldContainSubstring, addr)
+
+			logs.ResetForwardStats()
+			stats, failures, _ = logs.GetForwardStats("syslog_down_test")
+			So(len(stats), ShouldEqual, 0)
+			So(len(failures), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestPolicyAlarmStatus(t *testing.T) {
+	Convey("Subject: Test Policy Alarm Status Api\n", t, func() {
+		var query map[string]interface{}
+		monkey.Patch(logs.SearchLogs, func(startTime int64, endTime int64, isAttachAggr bool, q map[string]interface{}, sortField string,
+			page int, perpage int, ascending bool, index ...string) (int64, []map[string]interface{}, error) {
+			query = q
+			return 0, nil, nil
+		})
+		defer monkey.Unpatch(logs.SearchLogs)
+
+		Convey("when the ignored alarms are hidden by default", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/policy/search", inits.GetJson(getPolicyLogSearchData()))
+			So(r.Status, ShouldEqual, 0)
+			So(query["status"], ShouldResemble, []interface{}{"open", "resolved"})
+		})
+
+		Convey("when the ignored alarms are requested", func() {
+			data := getPolicyLogSearchData()
+			data["data"].(map[string]interface{})["status"] = []string{"ignored"}
+			r := inits.GetResponse("POST", "/v1/api/log/policy/search", inits.GetJson(data))
+			So(r.Status, ShouldEqual, 0)
+			So(query["status"], ShouldResemble, []interface{}{"ignored"})
+		})
+
+		Convey("when the status of search is invalid", func() {
+			data := getPolicyLogSearchData()
+			data["data"].(map[string]interface{})["status"] = []string{"closed"}
+			r := inits.GetResponse("POST", "/v1/api/log/policy/search", inits.GetJson(data))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when update the status of policy alarms", func() {
+			var updateStatus, updateUser string
+			var updateIds []string
+			monkey.Patch(logs.UpdatePolicyAlarmStatus, func(appId string, ids []string, status string,
+				user string) (int64, error) {
+				updateIds, updateStatus, updateUser = ids, status, user
+				return int64(len(ids)), nil
+			})
+			defer monkey.Unpatch(logs.UpdatePolicyAlarmStatus)
+			r := inits.GetResponse("POST", "/v1/api/log/policy/status", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{"id1", "id2"},
+				"status": "resolved",
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["updated"], ShouldEqual, 2)
+			So(updateIds, ShouldResemble, []string{"id1", "id2"})
+			So(updateStatus, ShouldEqual, "resolved")
+			So(updateUser, ShouldNotEqual, "")
+		})
+
+		Convey("when the status to update is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/policy/status", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{"id1"},
+				"status": "closed",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the ids to update are empty", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/policy/status", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{},
+				"status": "ignored",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the app of status update does not exist", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/policy/status", inits.GetJson(map[string]interface{}{
+				"app_id": "222222222222222222",
+				"ids":    []string{"id1"},
+				"status": "ignored",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestAttackFalsePositive(t *testing.T) {
+	Convey("Subject: Test Attack Alarm False Positive Api\n", t, func() {
+		var query map[string]interface{}
+		monkey.Patch(logs.SearchLogs, func(startTime int64, endTime int64, isAttachAggr bool, q map[string]interface{}, sortField string,
+			page int, perpage int, ascending bool, index ...string) (int64, []map[string]interface{}, error) {
+			query = q
+			return 0, nil, nil
+		})
+		defer monkey.Unpatch(logs.SearchLogs)
+
+		Convey("when the false positives are excluded by default", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/search", inits.GetJson(getNormalSearchData()))
+			So(r.Status, ShouldEqual, 0)
+			So(query["false_positive"], ShouldEqual, false)
+		})
+
+		Convey("when the false positives are included", func() {
+			data := getNormalSearchData()
+			data["data"].(map[string]interface{})["include_false_positive"] = true
+			r := inits.GetResponse("POST", "/v1/api/log/attack/search", inits.GetJson(data))
+			So(r.Status, ShouldEqual, 0)
+			_, ok := query["false_positive"]
+			So(ok, ShouldBeFalse)
+			_, ok = query["include_false_positive"]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("when mark the false positives by ids", func() {
+			var markIds []string
+			var markFalsePositive bool
+			monkey.Patch(logs.MarkFalsePositiveByIds, func(appId string, ids []string, falsePositive bool,
+				user string) (int64, error) {
+				markIds, markFalsePositive = ids, falsePositive
+				return int64(len(ids)), nil
+			})
+			defer monkey.Unpatch(logs.MarkFalsePositiveByIds)
+			r := inits.GetResponse("POST", "/v1/api/log/attack/false_positive", inits.GetJson(map[string]interface{}{
+				"app_id":         start.TestApp.Id,
+				"ids":            []string{"id1", "id2"},
+				"false_positive": true,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["updated"], ShouldEqual, 2)
+			So(markIds, ShouldResemble, []string{"id1", "id2"})
+			So(markFalsePositive, ShouldBeTrue)
+		})
+
+		Convey("when mark the false positives by filter", func() {
+			var markQuery map[string]interface{}
+			monkey.Patch(logs.MarkFalsePositiveByQuery, func(appId string, startTime int64, endTime int64,
+				q map[string]interface{}, falsePositive bool, user string) (string, error) {
+				markQuery = q
+				return "node:5", nil
+			})
+			defer monkey.Unpatch(logs.MarkFalsePositiveByQuery)
+			data := getNormalSearchData()["data"].(map[string]interface{})
+			data["attack_type"] = []string{"sql"}
+			r := inits.GetResponse("POST", "/v1/api/log/attack/false_positive", inits.GetJson(map[string]interface{}{
+				"data":           data,
+				"false_positive": true,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["task_id"], ShouldEqual, "node:5")
+			So(markQuery["attack_type"], ShouldResemble, []interface{}{"sql"})
+		})
+
+		Convey("when both ids and filter are provided", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/false_positive", inits.GetJson(map[string]interface{}{
+				"app_id":         start.TestApp.Id,
+				"ids":            []string{"id1"},
+				"data":           getNormalSearchData()["data"],
+				"false_positive": true,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when neither ids nor filter is provided", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/false_positive", inits.GetJson(map[string]interface{}{
+				"app_id":         start.TestApp.Id,
+				"false_positive": true,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the filter has no app_id", func() {
+			data := getNormalSearchData()["data"].(map[string]interface{})
+			data["app_id"] = ""
+			r := inits.GetResponse("POST", "/v1/api/log/attack/false_positive", inits.GetJson(map[string]interface{}{
+				"data":           data,
+				"false_positive": true,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestAttackAlarmExport(t *testing.T) {
+	Convey("Subject: Test Attack Alarm Export Api\n", t, func() {
+		alarms := []map[string]interface{}{
+			{
+				"event_time":      float64(1551882976000),
+				"attack_type":     "sql",
+				"intercept_state": "block",
+				"url":             "http://localhost/vulns?id=1",
+				"attack_source":   "10.0.0.1",
+				"server_hostname": "host-1",
+				"plugin_message":  "SQLi\r\nquery altered",
+				"stack_md5":       "abc",
+			},
+			{
+				"event_time":     "2019-03-06T14:36:16+08:00",
+				"attack_type":    "command",
+				"attack_source":  []interface{}{"10.0.0.2", "10.0.0.3"},
+				"plugin_message": "=cmd|calc",
+			},
+		}
+		var maxRows int64
+		monkey.Patch(logs.CountAttackAlarm, func(appId string, startTime int64, endTime int64,
+			query map[string]interface{}) (int64, error) {
+			return int64(len(alarms)), nil
+		})
+		monkey.Patch(logs.ExportAttackAlarm, func(appId string, startTime int64, endTime int64,
+			query map[string]interface{}, max int64, fn func(alarm map[string]interface{}) error) error {
+			maxRows = max
+			for _, alarm := range alarms {
+				if err := fn(alarm); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		defer monkey.Unpatch(logs.CountAttackAlarm)
+		defer monkey.Unpatch(logs.ExportAttackAlarm)
+
+		Convey("when the param is valid", func() {
+			r := inits.GetResponseRecorder("POST", "/v1/api/log/attack/export", inits.GetJson(map[string]interface{}{
+				"data":      getNormalSearchData()["data"],
+				"time_zone": "+08:00",
+			}))
+			So(r.Header().Get("Content-Type"), ShouldStartWith, "text/csv")
+			records, err := csv.NewReader(r.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 3)
+			So(records[0], ShouldResemble, []string{"time", "attack_type", "intercept_state", "url",
+				"attack_source", "server_hostname", "plugin_message", "stack_md5"})
+			So(records[1][0], ShouldEqual, "2019-03-06 22:36:16")
+			So(records[1][6], ShouldEqual, `SQLi\nquery altered`)
+			So(records[2][0], ShouldEqual, "2019-03-06T14:36:16+08:00")
+			So(records[2][4], ShouldEqual, "10.0.0.2;10.0.0.3")
+			So(records[2][6], ShouldEqual, "'=cmd|calc")
+			So(maxRows, ShouldEqual, conf.AppConfig.AlarmExportMaxRows)
+		})
+
+		Convey("when there are too many alarms to export", func() {
+			monkey.Patch(logs.CountAttackAlarm, func(appId string, startTime int64, endTime int64,
+				query map[string]interface{}) (int64, error) {
+				return conf.AppConfig.AlarmExportMaxRows + 1, nil
+			})
+			r := inits.GetResponse("POST", "/v1/api/log/attack/export", inits.GetJson(map[string]interface{}{
+				"data": getNormalSearchData()["data"],
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			So(r.Desc, ShouldContainSubstring, "too many alarms")
+		})
+
+		Convey("when the time zone is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/export", inits.GetJson(map[string]interface{}{
+				"data":      getNormalSearchData()["data"],
+				"time_zone": "Asia/Shanghai",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestAttackSourceAggr(t *testing.T) {
+	Convey("Subject: Test Attack Source Aggr Api\n", t, func() {
+		originClient := es.ElasticClient
+		defer func() {
+			es.ElasticClient = originClient
+		}()
+		server, client := newStubEsClient(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"took":1,"hits":{"total":4,"hits":[]},"aggregations":{"aggr_source":{"buckets":[` +
+				`{"key":"8.8.8.8","doc_count":4,` +
+				`"aggr_type":{"buckets":[{"key":"sql","doc_count":3},{"key":"xss","doc_count":1}]},` +
+				`"aggr_intercept":{"buckets":[{"key":"block","doc_count":3},{"key":"log","doc_count":1}]}}]}}}`))
+		})
+		defer server.Close()
+		es.ElasticClient = client
+
+		Convey("when the param is valid", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/source", inits.GetJson(map[string]interface{}{
+				"size": 10,
+				"data": getNormalSearchData()["data"],
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.([]interface{})
+			So(len(data), ShouldEqual, 1)
+			item := data[0].(map[string]interface{})
+			So(item["attack_source"], ShouldEqual, "8.8.8.8")
+			So(item["count"], ShouldEqual, 4)
+			So(item["block"], ShouldEqual, 3)
+			So(item["log"], ShouldEqual, 1)
+			So(item["block_ratio"], ShouldEqual, 0.75)
+			So(len(item["attack_type"].([]interface{})), ShouldEqual, 2)
+			So(item["location"], ShouldNotBeNil)
+		})
+
+		Convey("when the size is too large", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/source", inits.GetJson(map[string]interface{}{
+				"size": logs.MaxAttackSourceSize + 1,
+				"data": getNormalSearchData()["data"],
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the search data is empty", func() {
+			r := inits.GetResponse("POST", "/v1/api/log/attack/aggr/source", inits.GetJson(map[string]interface{}{
+				"size": 10,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
@@ -10,6 +10,13 @@ import (
 	"rasp-cloud/tests/start"
 	"rasp-cloud/models"
 	"errors"
+	"time"
+	"strconv"
+	"net/http"
+	"encoding/csv"
+	"rasp-cloud/conf"
+	"rasp-cloud/mongo"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestRaspRegister(t *testing.T) {
@@ -183,7 +190,7 @@ func TestSearchRasp(t *testing.T) {
 		})
 
 		Convey("when the mongodb has errors", func() {
-			monkey.Patch(models.FindRasp, func(*models.Rasp, int, int) (int, []*models.Rasp, error) {
+			monkey.Patch(models.FindRasp, func(*models.Rasp, *models.RaspFilter, int, int) (int, []*models.Rasp, error) {
 				return 0, nil, errors.New("")
 			})
 			r := inits.GetResponse("POST", "/v1/api/rasp/search", inits.GetJson(
@@ -218,7 +225,7 @@ func TestDeleteRasp(t *testing.T) {
 				RegisterTime:      1551781949000,
 				Environ:           map[string]string{},
 			}
-			monkey.Patch(models.FindRasp, func(*models.Rasp, int, int) (int, []*models.Rasp, error) {
+			monkey.Patch(models.FindRasp, func(*models.Rasp, *models.RaspFilter, int, int) (int, []*models.Rasp, error) {
 				return 0, nil, errors.New("")
 			})
 			r := inits.GetResponse("POST", "/v1/api/rasp/delete", inits.GetJson(map[string]interface{}{
@@ -320,3 +327,676 @@ func TestDeleteRasp(t *testing.T) {
 		})
 	})
 }
+
+func TestBatchDeleteRasp(t *testing.T) {
+	Convey("Subject: Test Rasp Batch Delete Api\n", t, func() {
+		newRasp := func(id string, lastHeartbeatTime int64) *models.Rasp {
+			return &models.Rasp{
+				Id:                id,
+				AppId:             start.TestApp.Id,
+				Language:          "java",
+				Version:           "1.0",
+				HostName:          "ubuntu",
+				RegisterIp:        "10.23.25.36",
+				LanguageVersion:   "1.8",
+				ServerType:        "tomcat",
+				RaspHome:          "/home/work/tomcat8",
+				PluginVersion:     "2019-03-10-10000",
+				HeartbeatInterval: 180,
+				LastHeartbeatTime: lastHeartbeatTime,
+				RegisterTime:      lastHeartbeatTime,
+				Environ:           map[string]string{},
+			}
+		}
+
+		Convey("delete the rasps with ids", func() {
+			offline := newRasp("batch0000000000000000000000001", time.Now().Unix()-10*24*3600)
+			online := newRasp("batch0000000000000000000000002", time.Now().Unix())
+			models.UpsertRaspById(offline.Id, offline)
+			models.UpsertRaspById(online.Id, online)
+			r := inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{offline.Id, online.Id, "batch0000000000000000000000003"},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["count"], ShouldEqual, float64(1))
+			results := data["data"].([]interface{})
+			So(len(results), ShouldEqual, 3)
+			So(results[0].(map[string]interface{})["success"], ShouldEqual, true)
+			So(results[1].(map[string]interface{})["success"], ShouldEqual, false)
+			So(results[2].(map[string]interface{})["error"], ShouldEqual, "rasp not found")
+			removeTestRasps("batch")
+		})
+
+		Convey("delete the rasps offline for more than n days", func() {
+			expired := newRasp("batch0000000000000000000000004", time.Now().Unix()-10*24*3600)
+			recent := newRasp("batch0000000000000000000000005", time.Now().Unix()-2*24*3600)
+			models.UpsertRaspById(expired.Id, expired)
+			models.UpsertRaspById(recent.Id, recent)
+			r := inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"app_id":       start.TestApp.Id,
+				"offline_days": 7,
+			}))
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["count"], ShouldEqual, float64(1))
+			_, err := models.GetRaspById(recent.Id)
+			So(err, ShouldBeNil)
+			removeTestRasps("batch")
+		})
+
+		Convey("when the param is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"ids": []string{"batch0000000000000000000000001"},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"app_id":       start.TestApp.Id,
+				"offline_days": -1,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    make([]string, models.MaxRaspBatchSize+1),
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the mongodb has errors", func() {
+			monkey.Patch(models.RemoveRaspByIds, func(string, []string) ([]*models.RaspRemoveResult, int, error) {
+				return nil, 0, errors.New("")
+			})
+			r := inits.GetResponse("POST", "/v1/api/rasp/batch_delete", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{"batch0000000000000000000000001"},
+			}))
+			monkey.Unpatch(models.RemoveRaspByIds)
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestRaspCleanup(t *testing.T) {
+	Convey("Subject: Test Offline Rasp Cleanup\n", t, func() {
+		rasp := &models.Rasp{
+			Id:                "cleanup00000000000000000000001",
+			AppId:             start.TestApp.Id,
+			Language:          "java",
+			Version:           "1.0",
+			HostName:          "ubuntu",
+			RegisterIp:        "10.23.25.36",
+			LanguageVersion:   "1.8",
+			HeartbeatInterval: 180,
+			LastHeartbeatTime: time.Now().Unix() - 10*24*3600,
+			RegisterTime:      time.Now().Unix() - 10*24*3600,
+		}
+		cleanupDays := conf.AppConfig.RaspCleanupDays
+		defer func() {
+			conf.AppConfig.RaspCleanupDays = cleanupDays
+			session := mongo.NewSession()
+			defer session.Close()
+			session.DB(mongo.DbName).C("app").UpdateId(start.TestApp.Id,
+				bson.M{"$unset": bson.M{"rasp_cleanup_days": 1}})
+		}()
+
+		Convey("when the cleanup is disabled", func() {
+			conf.AppConfig.RaspCleanupDays = 0
+			models.UpsertRaspById(rasp.Id, rasp)
+			models.CleanupOfflineRasps()
+			_, err := models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			removeTestRasps("cleanup")
+		})
+
+		Convey("when the rasp is offline for more than the cleanup days", func() {
+			conf.AppConfig.RaspCleanupDays = 7
+			models.UpsertRaspById(rasp.Id, rasp)
+			models.CleanupOfflineRasps()
+			_, err := models.GetRaspById(rasp.Id)
+			So(err, ShouldNotBeNil)
+
+			r := inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(start.TestRasp))
+			So(r.Status, ShouldEqual, 0)
+			removeTestRasps("cleanup")
+		})
+
+		Convey("when the app overrides the cleanup days", func() {
+			conf.AppConfig.RaspCleanupDays = 7
+			_, err := models.UpdateAppById(start.TestApp.Id, bson.M{"rasp_cleanup_days": 0})
+			So(err, ShouldBeNil)
+			models.UpsertRaspById(rasp.Id, rasp)
+			models.CleanupOfflineRasps()
+			_, err = models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			removeTestRasps("cleanup")
+		})
+	})
+}
+
+func TestRaspTags(t *testing.T) {
+	Convey("Subject: Test Rasp Tag Api\n", t, func() {
+		rasp := *start.TestRasp
+		rasp.Id = "tag000000000000000000000000001"
+		rasp.AppId = start.TestApp.Id
+		models.UpsertRaspById(rasp.Id, &rasp)
+		defer removeTestRasps("tag0")
+
+		Convey("add and remove the tags", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/tag/add", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{rasp.Id},
+				"tags":   []string{"payment", "frontend"},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			result, err := models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			So(result.Tags, ShouldResemble, []string{"payment", "frontend"})
+
+			_, rasps, err := models.FindRasp(&models.Rasp{AppId: start.TestApp.Id, Tags: []string{"payment"}}, nil, 1, 10)
+			So(err, ShouldBeNil)
+			So(len(rasps), ShouldEqual, 1)
+			ids, err := models.GetRaspIdsByTag(start.TestApp.Id, "frontend")
+			So(err, ShouldBeNil)
+			So(ids, ShouldResemble, []string{rasp.Id})
+
+			// the tags are kept when the agent registers again
+			models.UpsertRaspById(rasp.Id, &rasp)
+			result, err = models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			So(len(result.Tags), ShouldEqual, 2)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/tag/remove", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{rasp.Id},
+				"tags":   []string{"payment"},
+			}))
+			So(r.Status, ShouldEqual, 0)
+			result, err = models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			So(result.Tags, ShouldResemble, []string{"frontend"})
+		})
+
+		Convey("when the param is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/tag/add", inits.GetJson(map[string]interface{}{
+				"ids":  []string{rasp.Id},
+				"tags": []string{"payment"},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/tag/add", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"tags":   []string{"payment"},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/tag/remove", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{rasp.Id},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/tag/add", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{rasp.Id},
+				"tags":   []string{inits.GetLongString(65)},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/tag/add", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+				"ids":    []string{rasp.Id},
+				"tags":   make([]string, models.MaxRaspTags+1),
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestRaspVersionKey(t *testing.T) {
+	Convey("Subject: Test Rasp Version Key\n", t, func() {
+		getKey := func(version string) string {
+			key, err := models.GetVersionKey(version)
+			So(err, ShouldBeNil)
+			return key
+		}
+
+		Convey("when the version has three components", func() {
+			So(getKey("1.3.10"), ShouldBeGreaterThan, getKey("1.3.9"))
+			So(getKey("1.3.7"), ShouldBeLessThan, getKey("1.4.0"))
+		})
+
+		Convey("when the version has two components", func() {
+			So(getKey("1.3"), ShouldEqual, getKey("1.3.0"))
+			So(getKey("1.10"), ShouldBeGreaterThan, getKey("1.9.9"))
+		})
+
+		Convey("when the version has four components", func() {
+			So(getKey("1.3.7.1"), ShouldBeGreaterThan, getKey("1.3.7"))
+			So(getKey("1.3.7.10"), ShouldBeGreaterThan, getKey("1.3.7.9"))
+			So(getKey("1.3.0.0"), ShouldEqual, getKey("1.3"))
+		})
+
+		Convey("when the version has a suffix", func() {
+			So(getKey("1.2.0-beta"), ShouldEqual, getKey("1.2.0"))
+		})
+
+		Convey("when the version is invalid", func() {
+			_, err := models.GetVersionKey("abc")
+			So(err, ShouldNotBeNil)
+			_, err = models.GetVersionKey("1.2.3.4.5")
+			So(err, ShouldNotBeNil)
+			_, err = models.GetVersionKey("1.123456789")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSearchRaspWithFilter(t *testing.T) {
+	Convey("Subject: Test Rasp Search With Filter\n", t, func() {
+		now := time.Now().Unix()
+		for i, version := range []string{"1.3.9", "1.3.10", "1.2"} {
+			rasp := *start.TestRasp
+			rasp.Id = "filter00000000000000000000000" + strconv.Itoa(i)
+			rasp.AppId = start.TestApp.Id
+			rasp.Version = version
+			rasp.HostName = "prod-db-" + strconv.Itoa(i)
+			rasp.LastHeartbeatTime = now - int64(i)
+			models.UpsertRaspById(rasp.Id, &rasp)
+		}
+		rasp := *start.TestRasp
+		rasp.Id = "filter000000000000000000000009"
+		rasp.AppId = start.TestApp.Id
+		rasp.Version = "1.3.7"
+		rasp.HostName = "prod-dbx01"
+		models.UpsertRaspById(rasp.Id, &rasp)
+		defer removeTestRasps("filter")
+
+		search := func(filter map[string]interface{}) *inits.Response {
+			return inits.GetResponse("POST", "/v1/api/rasp/search", inits.GetJson(map[string]interface{}{
+				"data":    map[string]interface{}{"app_id": start.TestApp.Id},
+				"filter":  filter,
+				"page":    1,
+				"perpage": 10,
+			}))
+		}
+
+		Convey("when the version range is set", func() {
+			r := search(map[string]interface{}{"version_min": "1.1", "version_max": "1.3.7"})
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldEqual, float64(1))
+
+			r = search(map[string]interface{}{"version_min": "1.3.9", "version_max": "1.3.10.1"})
+			So(r.Status, ShouldEqual, 0)
+			So(r.Data.(map[string]interface{})["total"], ShouldEqual, float64(2))
+		})
+
+		Convey("when the hostname pattern is set", func() {
+			r := search(map[string]interface{}{"hostname_pattern": "prod-db-*",
+				"sort_by": "last_heartbeat_time", "ascending": true})
+			So(r.Status, ShouldEqual, 0)
+			data := r.Data.(map[string]interface{})
+			So(data["total"], ShouldEqual, float64(3))
+			So(data["data"].([]interface{})[0].(map[string]interface{})["hostname"], ShouldEqual, "prod-db-2")
+		})
+
+		Convey("when the filter is invalid", func() {
+			r := search(map[string]interface{}{"version_min": "abc"})
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = search(map[string]interface{}{"sort_by": "hostname"})
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = search(map[string]interface{}{"hostname_pattern": inits.GetLongString(1025)})
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestRaspStats(t *testing.T) {
+	Convey("Subject: Test Rasp Stats Api\n", t, func() {
+		getStats := func() map[string]interface{} {
+			r := inits.GetResponse("POST", "/v1/api/rasp/stats", inits.GetJson(map[string]interface{}{
+				"app_id":    start.TestApp.Id,
+				"time_zone": "+08:00",
+			}))
+			So(r.Status, ShouldEqual, 0)
+			return r.Data.(map[string]interface{})
+		}
+		getCount := func(items interface{}, name string) float64 {
+			for _, item := range items.([]interface{}) {
+				if item.(map[string]interface{})["name"] == name {
+					return item.(map[string]interface{})["count"].(float64)
+				}
+			}
+			return 0
+		}
+		before := getStats()
+		for i, version := range []string{"stats-1.2", "stats-1.2", "stats-1.3"} {
+			rasp := *start.TestRasp
+			rasp.Id = "stats000000000000000000000000" + strconv.Itoa(i)
+			rasp.AppId = start.TestApp.Id
+			rasp.Version = version
+			rasp.LastHeartbeatTime = time.Now().Unix()
+			if i == 2 {
+				rasp.LastHeartbeatTime = time.Now().Unix() - 2*24*3600
+			}
+			models.UpsertRaspById(rasp.Id, &rasp)
+			mongo.UpdateId("rasp", rasp.Id, bson.M{"register_time": time.Now().Unix()})
+		}
+		defer removeTestRasps("stats")
+
+		Convey("when the param is valid", func() {
+			after := getStats()
+			So(after["total"].(float64)-before["total"].(float64), ShouldEqual, 3)
+			So(after["online"].(float64)-before["online"].(float64), ShouldEqual, 2)
+			So(after["offline"].(float64)-before["offline"].(float64), ShouldEqual, 1)
+			So(getCount(after["versions"], "stats-1.2"), ShouldEqual, 2)
+			So(getCount(after["versions"], "stats-1.3"), ShouldEqual, 1)
+			registrations := after["registrations"].([]interface{})
+			So(len(registrations), ShouldEqual, 30)
+			So(registrations[29].(map[string]interface{})["count"].(float64)-
+				before["registrations"].([]interface{})[29].(map[string]interface{})["count"].(float64),
+				ShouldEqual, 3)
+		})
+
+		Convey("when the param is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/stats", inits.GetJson(map[string]interface{}{}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+			r = inits.GetResponse("POST", "/v1/api/rasp/stats", inits.GetJson(map[string]interface{}{
+				"app_id":    start.TestApp.Id,
+				"time_zone": "Asia/Shanghai",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+
+		Convey("when the mongodb has errors", func() {
+			monkey.Patch(models.GetRaspStats, func(string, int) (*models.RaspStats, error) {
+				return nil, errors.New("")
+			})
+			r := inits.GetResponse("POST", "/v1/api/rasp/stats", inits.GetJson(map[string]interface{}{
+				"app_id": start.TestApp.Id,
+			}))
+			monkey.Unpatch(models.GetRaspStats)
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func removeTestRasps(idPrefix string) {
+	mongo.RemoveAll("rasp", bson.M{"_id": bson.M{"$regex": "^" + idPrefix}})
+}
+
+func TestRaspMergeByHost(t *testing.T) {
+	Convey("Subject: Test Rasp Merge By Host\n", t, func() {
+		monkey.PatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header",
+			func(input *context.BeegoInput, key string) string {
+				return start.TestApp.Id
+			},
+		)
+		defer monkey.UnpatchInstanceMethod(reflect.TypeOf(&context.BeegoInput{}), "Header")
+		defer removeTestRasps("merge")
+		defer models.UpdateAppById(start.TestApp.Id, bson.M{"rasp_identity": models.RaspIdentityId})
+
+		oldRasp := *start.TestRasp
+		oldRasp.Id = "merge000000000000000000000001"
+		oldRasp.HostName = "merge-host"
+		oldRasp.RegisterIp = "10.23.25.99"
+		newRasp := oldRasp
+		newRasp.Id = "merge000000000000000000000002"
+
+		Convey("when the app identifies the rasps by host", func() {
+			_, err := models.UpdateAppById(start.TestApp.Id, bson.M{"rasp_identity": models.RaspIdentityHost})
+			So(err, ShouldBeNil)
+			r := inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(oldRasp))
+			So(r.Status, ShouldEqual, 0)
+			_, err = models.AddRaspTags(start.TestApp.Id, []string{oldRasp.Id}, []string{"payment"})
+			So(err, ShouldBeNil)
+			err = mongo.UpdateId("rasp", oldRasp.Id, bson.M{"last_heartbeat_time": time.Now().Unix() - 86400})
+			So(err, ShouldBeNil)
+
+			r = inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(newRasp))
+			So(r.Status, ShouldEqual, 0)
+			_, err = models.GetRaspById(oldRasp.Id)
+			So(err, ShouldNotBeNil)
+			rasp, err := models.GetRaspById(newRasp.Id)
+			So(err, ShouldBeNil)
+			So(rasp.Tags, ShouldResemble, []string{"payment"})
+		})
+
+		Convey("when the old rasp of the host is still online", func() {
+			_, err := models.UpdateAppById(start.TestApp.Id, bson.M{"rasp_identity": models.RaspIdentityHost})
+			So(err, ShouldBeNil)
+			r := inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(oldRasp))
+			So(r.Status, ShouldEqual, 0)
+			_, err = models.AddRaspTags(start.TestApp.Id, []string{oldRasp.Id}, []string{"payment"})
+			So(err, ShouldBeNil)
+			old, err := models.GetRaspById(oldRasp.Id)
+			So(err, ShouldBeNil)
+			So(*old.Online, ShouldBeTrue)
+
+			r = inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(newRasp))
+			So(r.Status, ShouldEqual, 0)
+			_, err = models.GetRaspById(oldRasp.Id)
+			So(err, ShouldNotBeNil)
+			rasp, err := models.GetRaspById(newRasp.Id)
+			So(err, ShouldBeNil)
+			So(rasp.Tags, ShouldResemble, []string{"payment"})
+		})
+
+		Convey("when several old rasps of the host have annotations", func() {
+			_, err := models.UpdateAppById(start.TestApp.Id, bson.M{"rasp_identity": models.RaspIdentityHost})
+			So(err, ShouldBeNil)
+			olderRasp := oldRasp
+			olderRasp.Id = "merge000000000000000000000003"
+			r := inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(olderRasp))
+			So(r.Status, ShouldEqual, 0)
+			r = inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(oldRasp))
+			So(r.Status, ShouldEqual, 0)
+			now := time.Now().Unix()
+			err = mongo.UpdateId("rasp", olderRasp.Id, bson.M{"last_heartbeat_time": now - 7200,
+				"description": "older description", "owner": "team-x"})
+			So(err, ShouldBeNil)
+			err = mongo.UpdateId("rasp", oldRasp.Id, bson.M{"last_heartbeat_time": now - 3600,
+				"description": "latest description"})
+			So(err, ShouldBeNil)
+
+			r = inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(newRasp))
+			So(r.Status, ShouldEqual, 0)
+			rasp, err := models.GetRaspById(newRasp.Id)
+			So(err, ShouldBeNil)
+			So(rasp.Description, ShouldEqual, "latest description")
+			So(rasp.Owner, ShouldEqual, "team-x")
+		})
+
+		Convey("when the app identifies the rasps by id", func() {
+			r := inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(oldRasp))
+			So(r.Status, ShouldEqual, 0)
+			r = inits.GetResponse("POST", "/v1/agent/rasp", inits.GetJson(newRasp))
+			So(r.Status, ShouldEqual, 0)
+			_, err := models.GetRaspById(oldRasp.Id)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("when the rasp_identity is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/app/config", inits.GetJson(map[string]interface{}{
+				"app_id":        start.TestApp.Id,
+				"name":          start.TestApp.Name,
+				"language":      start.TestApp.Language,
+				"rasp_identity": "mac",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestUpdateRasp(t *testing.T) {
+	Convey("Subject: Test Rasp Update Api\n", t, func() {
+		rasp := *start.TestRasp
+		rasp.Id = "update00000000000000000000001"
+		rasp.AppId = start.TestApp.Id
+		models.UpsertRaspById(rasp.Id, &rasp)
+		defer removeTestRasps("update")
+
+		Convey("when the param is valid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":          rasp.Id,
+				"app_id":      start.TestApp.Id,
+				"description": "pending decommission",
+				"owner":       "team-x",
+			}))
+			So(r.Status, ShouldEqual, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":     rasp.Id,
+				"app_id": start.TestApp.Id,
+				"owner":  "team-y",
+			}))
+			So(r.Status, ShouldEqual, 0)
+			result, err := models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			So(result.Description, ShouldEqual, "pending decommission")
+			So(result.Owner, ShouldEqual, "team-y")
+
+			_, rasps, err := models.FindRasp(&models.Rasp{AppId: start.TestApp.Id, Owner: "team-y"}, nil, 1, 10)
+			So(err, ShouldBeNil)
+			So(len(rasps), ShouldEqual, 1)
+
+			// the annotation is kept when the agent registers again
+			models.UpsertRaspById(rasp.Id, &rasp)
+			result, err = models.GetRaspById(rasp.Id)
+			So(err, ShouldBeNil)
+			So(result.Owner, ShouldEqual, "team-y")
+		})
+
+		Convey("when the param is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":     rasp.Id,
+				"app_id": start.TestApp.Id,
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":          rasp.Id,
+				"app_id":      start.TestApp.Id,
+				"description": inits.GetLongString(1025),
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":     rasp.Id,
+				"app_id": start.TestApp.Id,
+				"owner":  inits.GetLongString(129),
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":     rasp.Id,
+				"app_id": "another_app",
+				"owner":  "team-x",
+			}))
+			So(r.Status, ShouldEqual, http.StatusForbidden)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/update", inits.GetJson(map[string]interface{}{
+				"id":     "update00000000000000000000009",
+				"app_id": start.TestApp.Id,
+				"owner":  "team-x",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestExportRasp(t *testing.T) {
+	Convey("Subject: Test Rasp Export Api\n", t, func() {
+		for i, hostname := range []string{"export-host", "=cmd|calc"} {
+			rasp := *start.TestRasp
+			rasp.Id = "export00000000000000000000000" + strconv.Itoa(i)
+			rasp.AppId = start.TestApp.Id
+			rasp.HostName = hostname
+			rasp.LastHeartbeatTime = 1551781949
+			rasp.RegisterTime = 1551781949
+			models.UpsertRaspById(rasp.Id, &rasp)
+		}
+		defer removeTestRasps("export")
+
+		Convey("when the param is valid", func() {
+			r := inits.GetResponseRecorder("POST", "/v1/api/rasp/export", inits.GetJson(map[string]interface{}{
+				"data":      map[string]interface{}{"app_id": start.TestApp.Id},
+				"filter":    map[string]interface{}{"hostname_pattern": "*", "sort_by": "register_time"},
+				"time_zone": "+08:00",
+			}))
+			So(r.Header().Get("Content-Type"), ShouldStartWith, "text/csv")
+			records, err := csv.NewReader(r.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(records[0][0], ShouldEqual, "id")
+			rows := make(map[string][]string)
+			for _, record := range records[1:] {
+				rows[record[0]] = record
+			}
+			row := rows["export000000000000000000000000"]
+			So(row[1], ShouldEqual, "export-host")
+			So(row[5], ShouldEqual, "false")
+			So(row[6], ShouldEqual, "2019-03-05 18:32:29")
+			So(rows["export000000000000000000000001"][1], ShouldEqual, "'=cmd|calc")
+		})
+
+		Convey("when the param is invalid", func() {
+			r := inits.GetResponse("POST", "/v1/api/rasp/export", inits.GetJson(map[string]interface{}{
+				"data": map[string]interface{}{},
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+
+			r = inits.GetResponse("POST", "/v1/api/rasp/export", inits.GetJson(map[string]interface{}{
+				"data":      map[string]interface{}{"app_id": start.TestApp.Id},
+				"time_zone": "Asia/Shanghai",
+			}))
+			So(r.Status, ShouldBeGreaterThan, 0)
+		})
+	})
+}
+
+func TestRaspOnlineThreshold(t *testing.T) {
+	Convey("Subject: Test Rasp Online Threshold Of Apps\n", t, func() {
+		suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+		fastAppId := "test-fast-" + suffix
+		slowAppId := "test-slow-" + suffix
+		legacyAppId := "test-legacy-" + suffix
+		monkey.Patch(models.GetAppByIdWithoutMask, func(id string) (*models.App, error) {
+			switch id {
+			case fastAppId:
+				return &models.App{Id: id, GeneralConfig: map[string]interface{}{"cloud.heartbeat_interval": float64(60)}}, nil
+			case slowAppId:
+				return &models.App{Id: id, GeneralConfig: map[string]interface{}{"cloud.heartbeat_interval": 600}}, nil
+			}
+			return &models.App{Id: id, GeneralConfig: map[string]interface{}{}}, nil
+		})
+		defer monkey.Unpatch(models.GetAppByIdWithoutMask)
+
+		factor := int64(conf.AppConfig.RaspOnlineFactor)
+
+		Convey("the threshold is read from the general config of each app", func() {
+			So(models.GetOnlineThreshold(fastAppId), ShouldEqual, 60*factor)
+			So(models.GetOnlineThreshold(slowAppId), ShouldEqual, 600*factor)
+			So(models.GetOnlineThreshold(legacyAppId), ShouldEqual, 0)
+		})
+
+		Convey("the rasps of the apps with different intervals coexist", func() {
+			lastHeartbeatTime := time.Now().Unix() - 60*factor - 10
+			fastRasp := &models.Rasp{AppId: fastAppId, LastHeartbeatTime: lastHeartbeatTime, HeartbeatInterval: 60}
+			slowRasp := &models.Rasp{AppId: slowAppId, LastHeartbeatTime: lastHeartbeatTime, HeartbeatInterval: 60}
+			legacyRasp := &models.Rasp{AppId: legacyAppId, LastHeartbeatTime: lastHeartbeatTime,
+				HeartbeatInterval: 60*factor + 10}
+			models.HandleRasp(fastRasp)
+			models.HandleRasp(slowRasp)
+			models.HandleRasp(legacyRasp)
+			So(*fastRasp.Online, ShouldBeFalse)
+			So(*slowRasp.Online, ShouldBeTrue)
+			So(*legacyRasp.Online, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,34 @@
+package test
+
+import (
+	"testing"
+	"rasp-cloud/tests/inits"
+	. "github.com/smartystreets/goconvey/convey"
+	"rasp-cloud/models"
+	"github.com/bouk/monkey"
+	"net/http"
+)
+
+func TestSystemHealth(t *testing.T) {
+	Convey("Subject: Test System Health Api\n", t, func() {
+		Convey("when all the components are ok", func() {
+			r := inits.GetResponseRecorder("GET", "/v1/system/health", "")
+			So(r.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("when an essential component is down", func() {
+			monkey.Patch(models.GetSystemHealth, func() *models.SystemHealth {
+				return &models.SystemHealth{
+					Status: models.HealthStatusDown,
+					Ready:  false,
+					Components: map[string]*models.ComponentHealth{
+						"elasticsearch": {Status: models.HealthStatusDown, Essential: true},
+					},
+				}
+			})
+			r := inits.GetResponseRecorder("GET", "/v1/system/health", "")
+			So(r.Code, ShouldEqual, http.StatusServiceUnavailable)
+			monkey.Unpatch(models.GetSystemHealth)
+		})
+	})
+}
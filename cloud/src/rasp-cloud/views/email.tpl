@@ -56,6 +56,13 @@
                 </td>
             </tr>
             {{end}}
+            {{if gt .Total 0}}
+            <tr>
+                <td bgcolor="#ffffff" style="padding: 20px 20px 20px 20px; color: #555555; font-family: Arial, sans-serif; font-size: 15px; line-height: 24px;">
+                    另有 {{.Total}} 条报警未展示
+                </td>
+            </tr>
+            {{end}}
 
             <tr>
                 <td align="center" bgcolor="#f9f9f9" style="padding: 30px 20px 30px 20px; font-family: Arial, sans-serif;">